@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/skabbass1/logstore/logstore"
+)
+
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	producers := fs.Int("producers", 1, "number of concurrent producers")
+	consumers := fs.Int("consumers", 1, "number of concurrent consumers, each reading every record")
+	records := fs.Int("records", 10000, "records written by each producer")
+	size := fs.Int("size", 100, "record size in bytes")
+	codecName := fs.String("codec", "none", "none, gzip or deflate")
+	mem := fs.Bool("mem", false, "keep the store in memory instead of the data directory")
+	fs.Parse(args)
+
+	opts := storeOpts
+	switch *codecName {
+	case "none":
+	case "gzip":
+		opts = append(opts, logstore.WithCodec(logstore.GzipCodec{}))
+	case "deflate":
+		opts = append(opts, logstore.WithCodec(logstore.DeflateCodec{}))
+	default:
+		return fmt.Errorf("bench: unknown codec %q", *codecName)
+	}
+	if *mem {
+		opts = append(opts, logstore.WithFS(logstore.NewMemFS()))
+	}
+
+	// the benchmark writes its own records, so it needs a log to itself
+	bases, err := logstore.Segments(opts...)
+	if err != nil {
+		return err
+	}
+	if len(bases) > 0 {
+		return fmt.Errorf("bench: data directory already holds %d segments", len(bases))
+	}
+
+	queue := make(chan logstore.Event, 100)
+	store, err := logstore.NewLogStore(queue, opts...)
+	if err != nil {
+		return err
+	}
+	store.Run()
+	defer func() { queue <- logstore.Event{Type: logstore.Terminate} }()
+
+	total := int64(*producers * *records)
+	value := bytes.Repeat([]byte("x"), *size)
+
+	// acked is the highest offset acknowledged, below which every offset
+	// has been written since the store appends one event at a time
+	var acked int64
+	var wg sync.WaitGroup
+	errs := make(chan error, *producers+*consumers)
+
+	putLatencies := make([][]time.Duration, *producers)
+	start := time.Now()
+	for p := 0; p < *producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			responses := make(chan logstore.Event, 1)
+			latencies := make([]time.Duration, 0, *records)
+			for i := 0; i < *records; i++ {
+				sent := time.Now()
+				queue <- logstore.Event{Type: logstore.Put, Data: value, ResponseChan: responses}
+				response := <-responses
+				latencies = append(latencies, time.Since(sent))
+				if response.Error != nil {
+					errs <- response.Error
+					return
+				}
+
+				offset, _ := binary.Varint(response.Data)
+				for {
+					current := atomic.LoadInt64(&acked)
+					if offset <= current || atomic.CompareAndSwapInt64(&acked, current, offset) {
+						break
+					}
+				}
+			}
+			putLatencies[p] = latencies
+		}(p)
+	}
+
+	getLatencies := make([][]time.Duration, *consumers)
+	for c := 0; c < *consumers; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			responses := make(chan logstore.Event, 1)
+			latencies := make([]time.Duration, 0, total)
+			for offset := int64(1); offset <= total; {
+				if offset > atomic.LoadInt64(&acked) {
+					time.Sleep(100 * time.Microsecond)
+					continue
+				}
+				sent := time.Now()
+				queue <- logstore.Event{Type: logstore.Get, Data: varint(offset), ResponseChan: responses}
+				response := <-responses
+				latencies = append(latencies, time.Since(sent))
+				if response.Error != nil {
+					errs <- response.Error
+					return
+				}
+				offset++
+			}
+			getLatencies[c] = latencies
+		}(c)
+	}
+
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	responses := make(chan logstore.Event, 1)
+	queue <- logstore.Event{Type: logstore.FlushMetaData, ResponseChan: responses}
+	if err := (<-responses).Error; err != nil {
+		return err
+	}
+
+	fmt.Printf("%d producers, %d consumers, %d byte records in %v\n", *producers, *consumers, *size, elapsed.Round(time.Millisecond))
+	printBench("put", putLatencies, *size, elapsed)
+	if *consumers > 0 {
+		printBench("get", getLatencies, *size, elapsed)
+	}
+	return nil
+}
+
+// printBench reports the throughput and latency percentiles of one kind
+// of operation across all the workers that made it.
+func printBench(op string, perWorker [][]time.Duration, size int, elapsed time.Duration) {
+	var latencies []time.Duration
+	for _, l := range perWorker {
+		latencies = append(latencies, l...)
+	}
+	if len(latencies) == 0 {
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	percentile := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))].Round(time.Microsecond)
+	}
+	rate := float64(len(latencies)) / elapsed.Seconds()
+	fmt.Printf(
+		"%s: %d ops  %.0f ops/s  %.2f MB/s  p50 %v  p90 %v  p99 %v  max %v\n",
+		op,
+		len(latencies),
+		rate,
+		rate*float64(size)/1e6,
+		percentile(0.5),
+		percentile(0.9),
+		percentile(0.99),
+		latencies[len(latencies)-1].Round(time.Microsecond),
+	)
+}
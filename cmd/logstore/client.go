@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/skabbass1/logstore/logstore"
+)
+
+// client talks to a store run by logstore serve.
+type client struct {
+	base string
+}
+
+func newClient(server string) *client {
+	if !strings.Contains(server, "://") {
+		server = "http://" + server
+	}
+	return &client{strings.TrimSuffix(server, "/")}
+}
+
+// produce appends records, all in one transaction when asked to, and
+// returns their offsets.
+func (c *client) produce(records []logstore.Record, transaction bool) ([]int64, error) {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, record := range records {
+		if err := enc.Encode(logstore.NewExportRecord(record)); err != nil {
+			return nil, err
+		}
+	}
+
+	u := c.base + "/records"
+	if transaction {
+		u += "?transaction=1"
+	}
+	resp, err := http.Post(u, "application/x-ndjson", &body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Offsets []int64 `json:"offsets"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.Offsets, nil
+}
+
+// fetch returns the records the server holds from offset from on, up to
+// its limit, and the offset to fetch next.
+func (c *client) fetch(from int64, readCommitted bool) ([]logstore.ExportRecord, int64, error) {
+	q := url.Values{"from": {strconv.FormatInt(from, 10)}}
+	if readCommitted {
+		q.Set("read_committed", "1")
+	}
+	resp, err := http.Get(c.base + "/records?" + q.Encode())
+	if err != nil {
+		return nil, from, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return nil, from, err
+	}
+
+	next, err := strconv.ParseInt(resp.Header.Get("Next-Offset"), 10, 64)
+	if err != nil {
+		return nil, from, fmt.Errorf("server sent no next offset")
+	}
+	var records []logstore.ExportRecord
+	dec := json.NewDecoder(resp.Body)
+	for dec.More() {
+		var record logstore.ExportRecord
+		if err := dec.Decode(&record); err != nil {
+			return nil, from, err
+		}
+		records = append(records, record)
+	}
+	return records, next, nil
+}
+
+// offset resolves an offset, earliest, latest or a time on the server.
+func (c *client) offset(at string) (int64, error) {
+	resp, err := http.Get(c.base + "/offset?" + url.Values{"at": {at}}.Encode())
+	if err != nil {
+		return -1, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return -1, err
+	}
+
+	var result struct {
+		Offset int64 `json:"offset"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return -1, err
+	}
+	return result.Offset, nil
+}
+
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(resp.Body)
+	return fmt.Errorf("server: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/skabbass1/logstore/logstore"
+)
+
+func runConsume(args []string) error {
+	fs := flag.NewFlagSet("consume", flag.ExitOnError)
+	from := fs.String("from", "earliest", "offset, earliest, latest or an RFC3339 time")
+	follow := fs.Bool("follow", false, "keep polling for new records")
+	asJSON := fs.Bool("json", false, "print records as JSON with offset metadata")
+	poll := fs.Duration("poll", 500*time.Millisecond, "poll interval with -follow")
+	readCommitted := fs.Bool("read-committed", false, "hide records from aborted and open transactions")
+	serverAddr := fs.String("server", "", "consume from the logstore serve running at this address")
+	fs.Parse(args)
+
+	if *serverAddr != "" {
+		return consumeFromServer(newClient(*serverAddr), *from, *follow, *asJSON, *poll, *readCommitted)
+	}
+
+	opts := storeOpts
+	if *readCommitted {
+		opts = append(opts, logstore.WithIsolation(logstore.ReadCommitted))
+	}
+
+	next, err := resolveStart(*from)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for {
+		// a store may be appending past the flushed metadata
+		metadata, err := logstore.ReadMetaData(opts...)
+		if err != nil {
+			return err
+		}
+		next, err = logstore.ScanRecords(next, metadata.NextOffset, func(record logstore.Record) error {
+			if record.Control != 0 {
+				return nil
+			}
+			if *asJSON {
+				return enc.Encode(logstore.NewExportRecord(record))
+			}
+			_, err := fmt.Printf("%s\n", record.Value)
+			return err
+		}, opts...)
+		if err != nil {
+			return err
+		}
+		if !*follow {
+			return nil
+		}
+		time.Sleep(*poll)
+	}
+}
+
+// consumeFromServer prints records fetched from a running server, asking
+// for more until it has none or, with follow, indefinitely.
+func consumeFromServer(c *client, from string, follow, asJSON bool, poll time.Duration, readCommitted bool) error {
+	next, err := c.offset(from)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for {
+		var records []logstore.ExportRecord
+		last := next
+		records, next, err = c.fetch(next, readCommitted)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			if asJSON {
+				err = enc.Encode(record)
+			} else {
+				_, err = fmt.Printf("%s\n", record.Value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if next > last {
+			continue
+		}
+		if !follow {
+			return nil
+		}
+		time.Sleep(poll)
+	}
+}
+
+// resolveStart turns the -from flag into an offset. A time resolves to the
+// first record with a timestamp at or after it.
+func resolveStart(from string) (int64, error) {
+	bases, err := logstore.Segments(storeOpts...)
+	if err != nil {
+		return -1, err
+	}
+
+	switch from {
+	case "earliest":
+		if len(bases) == 0 {
+			return 1, nil
+		}
+		return bases[0], nil
+	case "latest":
+		return endOfLog(bases)
+	}
+
+	if offset, err := strconv.ParseInt(from, 10, 64); err == nil {
+		return offset, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, from)
+	if err != nil {
+		return -1, fmt.Errorf("consume: invalid -from %q", from)
+	}
+	return logstore.OffsetForTime(t.UnixNano()/int64(time.Millisecond), storeOpts...)
+}
+
+func endOfLog(bases []int64) (int64, error) {
+	if len(bases) == 0 {
+		return 1, nil
+	}
+
+	last := bases[len(bases)-1]
+	info, err := inspectSegment(last)
+	if err != nil {
+		return -1, err
+	}
+
+	return last + int64(info.records), nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/skabbass1/logstore/logstore"
+)
+
+func parseFormat(name string) (logstore.ExportFormat, error) {
+	switch name {
+	case "jsonl":
+		return logstore.JSONLines, nil
+	case "tar":
+		return logstore.TarArchive, nil
+	}
+
+	return -1, fmt.Errorf("unknown format %q", name)
+}
+
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	formatName := fs.String("format", "jsonl", "jsonl or tar")
+	from := fs.Int64("from", 1, "first offset to export")
+	to := fs.Int64("to", -1, "offset to stop before, -1 for the end of the log")
+	fs.Parse(args)
+
+	format, err := parseFormat(*formatName)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	if err := logstore.Export(w, *from, *to, format, storeOpts...); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	formatName := fs.String("format", "jsonl", "jsonl or tar")
+	preserve := fs.Bool("preserve-offsets", false, "keep the original record offsets")
+	fs.Parse(args)
+
+	format, err := parseFormat(*formatName)
+	if err != nil {
+		return err
+	}
+
+	return logstore.Import(bufio.NewReader(os.Stdin), format, *preserve, storeOpts...)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"unicode/utf8"
+
+	"github.com/skabbass1/logstore/logstore"
+)
+
+type segmentInfo struct {
+	base    int64
+	size    int64
+	records int
+}
+
+func inspectSegment(base int64) (segmentInfo, error) {
+	segment, err := logstore.OpenSegment(base, storeOpts...)
+	if err != nil {
+		return segmentInfo{}, err
+	}
+	defer segment.Close()
+
+	size, err := segment.Size()
+	if err != nil {
+		return segmentInfo{}, err
+	}
+	entries, err := segment.Index.Entries()
+	if err != nil {
+		return segmentInfo{}, err
+	}
+
+	return segmentInfo{base, size, len(entries)}, nil
+}
+
+func runSegments(args []string) error {
+	bases, err := logstore.Segments(storeOpts...)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "BASE\tSIZE\tRECORDS")
+	for _, base := range bases {
+		info, err := inspectSegment(base)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%020d\t%d\t%d\n", info.base, info.size, info.records)
+	}
+
+	return w.Flush()
+}
+
+// parseWithArg parses a command's flags on either side of its one
+// positional argument, so "dump <segment> -hex" and "dump -hex <segment>"
+// both work. It reports false unless exactly one argument was given.
+func parseWithArg(fs *flag.FlagSet, args []string) (string, bool) {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		fs.Parse(args[1:])
+		return args[0], fs.NArg() == 0
+	}
+	fs.Parse(args)
+	return fs.Arg(0), fs.NArg() == 1
+}
+
+func runDump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	asHex := fs.Bool("hex", false, "print payloads as hex")
+	arg, ok := parseWithArg(fs, args)
+	if !ok {
+		return fmt.Errorf("dump: expected a segment base offset")
+	}
+	base, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return fmt.Errorf("dump: invalid segment %q", arg)
+	}
+
+	segment, err := logstore.OpenSegment(base, storeOpts...)
+	if err != nil {
+		return err
+	}
+	defer segment.Close()
+
+	entries, err := segment.Index.Entries()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.Length == 0 {
+			fmt.Printf("offset:%d removed by compaction\n", entry.Offset)
+			continue
+		}
+		record, err := segment.GetRecord(entry.Offset)
+		if err != nil {
+			return err
+		}
+		fmt.Printf(
+			"offset:%d position:%d length:%d timestamp:%d",
+			entry.Offset,
+			entry.Position,
+			entry.Length,
+			record.Timestamp,
+		)
+		if record.Key != nil {
+			fmt.Printf(" key:%q", record.Key)
+		}
+		if record.ExpiresAt != 0 {
+			fmt.Printf(" expires:%d", record.ExpiresAt)
+		}
+		for _, h := range record.Headers {
+			fmt.Printf(" %s:%q", h.Key, h.Value)
+		}
+		fmt.Println()
+		printPayload(record.Value, *asHex)
+	}
+
+	return nil
+}
+
+func runGet(args []string) error {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	asHex := fs.Bool("hex", false, "print payload as hex")
+	arg, ok := parseWithArg(fs, args)
+	if !ok {
+		return fmt.Errorf("get: expected an offset")
+	}
+	offset, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return fmt.Errorf("get: invalid offset %q", arg)
+	}
+
+	data, err := readOffset(offset)
+	if err != nil {
+		return err
+	}
+	printPayload(data, *asHex)
+
+	return nil
+}
+
+func runFind(args []string) error {
+	fs := flag.NewFlagSet("find", flag.ExitOnError)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("find: expected a key")
+	}
+
+	offsets, err := logstore.FindByKey([]byte(fs.Arg(0)), storeOpts...)
+	if err != nil {
+		return err
+	}
+	for _, offset := range offsets {
+		fmt.Println(offset)
+	}
+
+	return nil
+}
+
+func readOffset(offset int64) ([]byte, error) {
+	base, err := logstore.FindSegment(offset, storeOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	segment, err := logstore.OpenSegment(base, storeOpts...)
+	if err != nil {
+		return nil, err
+	}
+	defer segment.Close()
+
+	entries, err := segment.Index.Entries()
+	if err != nil {
+		return nil, err
+	}
+	if offset >= base+int64(len(entries)) {
+		return nil, fmt.Errorf("offset %d not found", offset)
+	}
+
+	return segment.Get(offset)
+}
+
+func runStats(args []string) error {
+	bases, err := logstore.Segments(storeOpts...)
+	if err != nil {
+		return err
+	}
+	metadata, err := logstore.ReadMetaData(storeOpts...)
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	var records int
+	for _, base := range bases {
+		info, err := inspectSegment(base)
+		if err != nil {
+			return err
+		}
+		size += info.size
+		records += info.records
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "segments:\t%d\n", len(bases))
+	fmt.Fprintf(w, "records:\t%d\n", records)
+	fmt.Fprintf(w, "log bytes:\t%d\n", size)
+	if len(bases) > 0 {
+		fmt.Fprintf(w, "first offset:\t%d\n", bases[0])
+	}
+	fmt.Fprintf(w, "metadata next offset:\t%d\n", metadata.NextOffset)
+
+	return w.Flush()
+}
+
+func printPayload(data []byte, asHex bool) {
+	if asHex || !utf8.Valid(data) {
+		fmt.Print(hex.Dump(data))
+		return
+	}
+	fmt.Printf("%s\n", data)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"testing"
+
+	"github.com/skabbass1/logstore/logstore"
+)
+
+// inTempStore runs the test in a fresh data directory holding one record.
+func inTempStore(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	queue := make(chan logstore.Event, 10)
+	store, err := logstore.NewLogStore(queue)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	store.Run()
+	responses := make(chan logstore.Event, 1)
+	queue <- logstore.Event{Type: logstore.Put, Data: []byte("foo"), ResponseChan: responses}
+	if err := (<-responses).Error; err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	queue <- logstore.Event{Type: logstore.FlushMetaData, ResponseChan: responses}
+	<-responses
+	queue <- logstore.Event{Type: logstore.Terminate}
+}
+
+func TestParseWithArg(t *testing.T) {
+	for _, args := range [][]string{{"1", "-hex"}, {"-hex", "1"}} {
+		fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+		asHex := fs.Bool("hex", false, "")
+		arg, ok := parseWithArg(fs, args)
+		if !ok || arg != "1" || !*asHex {
+			t.Errorf("Expected argument 1 with -hex from %v. Got %q %v %v\n", args, arg, ok, *asHex)
+		}
+	}
+
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	fs.Bool("hex", false, "")
+	if _, ok := parseWithArg(fs, []string{"1", "2"}); ok {
+		t.Errorf("Expected two arguments to be rejected\n")
+	}
+}
+
+func TestGetAndDump_FlagsAfterArgument(t *testing.T) {
+	inTempStore(t)
+
+	if err := runGet([]string{"1", "-hex"}); err != nil {
+		t.Errorf("get 1 -hex: %v\n", err)
+	}
+	if err := runDump([]string{"1", "-hex"}); err != nil {
+		t.Errorf("dump 1 -hex: %v\n", err)
+	}
+	if err := runGet([]string{"-hex", "1"}); err != nil {
+		t.Errorf("get -hex 1: %v\n", err)
+	}
+}
@@ -0,0 +1,153 @@
+// Command logstore inspects and manipulates a logstore data directory.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/skabbass1/logstore/logstore"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"segments", "list segments with sizes and record counts", runSegments},
+	{"dump", "dump <segment> [-hex]: print index entries and payloads", runDump},
+	{"get", "get <offset> [-hex]: print the record at offset", runGet},
+	{"stats", "print totals for the data directory", runStats},
+	{"find", "find <key>: print the offsets of records with key", runFind},
+	{"produce", "produce [-files] [-codec c] [-chain] [-key-separator s] [-ttl d] [-server addr] [file...]: append records", runProduce},
+	{"consume", "consume [-from offset|earliest|latest|time] [-follow] [-json] [-server addr]: print records", runConsume},
+	{"serve", "serve [-addr a] [-codec c] [-chain]: serve produce and consume requests over HTTP", runServe},
+	{"export", "export [-format jsonl|tar] [-from n] [-to n]: write records to stdout", runExport},
+	{"import", "import [-format jsonl|tar] [-preserve-offsets]: append records from stdin", runImport},
+	{"verify", "cross-check indexes, logs and metadata", runVerify},
+	{"verify-chain", "verify-chain [-from n] [-to n] [-manifest file]: check the audit hash chain", runVerifyChain},
+	{"repair", "truncate torn tails, rebuild indexes and rewrite metadata", runRepair},
+	{"compact", "drop expired records from closed segments", runCompact},
+	{"migrate", "rewrite segments written before record batches", runMigrate},
+	{"bench", "bench [-producers n] [-consumers n] [-records n] [-size n] [-codec c] [-mem]: measure throughput and latency", runBench},
+}
+
+// storeOpts carries the -keys, -metrics and -remote settings to every
+// library call that reads or writes the store.
+var storeOpts []logstore.Option
+
+func main() {
+	dir := flag.String("dir", ".", "data directory")
+	keyFile := flag.String("keys", "", "JSON key file for encrypted records")
+	metricsAddr := flag.String("metrics", "", "serve Prometheus metrics at /metrics on this address")
+	remoteDir := flag.String("remote", "", "directory closed segments are offloaded to")
+	localSegments := flag.Int("local-segments", 2, "closed segments kept locally once offloaded")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	if *keyFile != "" {
+		provider, err := loadKeys(*keyFile)
+		if err != nil {
+			fatal(err)
+		}
+		storeOpts = append(storeOpts, logstore.WithKeys(provider))
+	}
+
+	if *metricsAddr != "" {
+		metrics, err := serveMetrics(*metricsAddr)
+		if err != nil {
+			fatal(err)
+		}
+		storeOpts = append(storeOpts, logstore.WithMetrics(metrics))
+	}
+
+	if *remoteDir != "" {
+		// resolved before moving into the data directory
+		abs, err := filepath.Abs(*remoteDir)
+		if err != nil {
+			fatal(err)
+		}
+		remote, err := logstore.NewDirStorage(abs)
+		if err != nil {
+			fatal(err)
+		}
+		storeOpts = append(storeOpts, logstore.WithTieredStorage(&logstore.TieredStorage{
+			Remote:        remote,
+			LocalSegments: *localSegments,
+			CacheSegments: 8,
+		}))
+	}
+
+	// segment and metadata paths are relative to the working directory
+	if err := os.Chdir(*dir); err != nil {
+		fatal(err)
+	}
+
+	name := flag.Arg(0)
+	for _, cmd := range commands {
+		if cmd.name == name {
+			if err := cmd.run(flag.Args()[1:]); err != nil {
+				fatal(err)
+			}
+			return
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command: %s\n", name)
+	usage()
+	os.Exit(2)
+}
+
+// loadKeys reads a key file of the form
+// {"Current": 2, "Keys": {"1": "<base64 key>", "2": "<base64 key>"}}.
+func loadKeys(name string) (*logstore.StaticKeyProvider, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var provider logstore.StaticKeyProvider
+	if err := json.Unmarshal(data, &provider); err != nil {
+		return nil, fmt.Errorf("invalid key file: %v", err)
+	}
+	return &provider, nil
+}
+
+// serveMetrics listens on addr before returning, so a bad address fails
+// the command instead of going unnoticed.
+func serveMetrics(addr string) (*logstore.Metrics, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := logstore.NewMetrics()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	go http.Serve(l, mux)
+	return metrics, nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: logstore [-dir path] [-keys file] [-metrics addr] [-remote dir [-local-segments n]] <command> [args]\n\ncommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.usage)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "logstore: %v\n", err)
+	os.Exit(1)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/skabbass1/logstore/logstore"
+)
+
+// batchSize is how many records produce appends at a time.
+const batchSize = 100
+
+func runProduce(args []string) error {
+	fs := flag.NewFlagSet("produce", flag.ExitOnError)
+	files := fs.Bool("files", false, "treat each stdin line as the name of a file holding one record")
+	codecName := fs.String("codec", "none", "none, gzip or deflate")
+	chain := fs.Bool("chain", false, "hash chain records for audit")
+	keySep := fs.String("key-separator", "", "split stdin lines into key and value at the first separator")
+	transaction := fs.Bool("transaction", false, "write all records in one transaction")
+	ttl := fs.Duration("ttl", 0, "expire records this long after they are produced")
+	serverAddr := fs.String("server", "", "produce to the logstore serve running at this address")
+	fs.Parse(args)
+
+	newRecord := func(data []byte) logstore.Record {
+		record := logstore.Record{Value: data}
+		if *ttl > 0 {
+			record.ExpiresAt = time.Now().Add(*ttl).UnixNano() / int64(time.Millisecond)
+		}
+		if *keySep != "" && !*files {
+			if i := bytes.Index(data, []byte(*keySep)); i >= 0 {
+				record.Key = data[:i]
+				record.Value = data[i+len(*keySep):]
+			}
+		}
+		return record
+	}
+
+	if *serverAddr != "" {
+		if *codecName != "none" || *chain {
+			return fmt.Errorf("produce: -codec and -chain are set on the server")
+		}
+		return produceToServer(newClient(*serverAddr), fs, *files, *transaction, newRecord)
+	}
+
+	opts := storeOpts
+	if *chain {
+		opts = append(opts, logstore.WithHashChain())
+	}
+	switch *codecName {
+	case "none":
+	case "gzip":
+		opts = append(opts, logstore.WithCodec(logstore.GzipCodec{}))
+	case "deflate":
+		opts = append(opts, logstore.WithCodec(logstore.DeflateCodec{}))
+	default:
+		return fmt.Errorf("produce: unknown codec %q", *codecName)
+	}
+
+	queue := make(chan logstore.Event, 100)
+	store, err := logstore.NewLogStore(queue, opts...)
+	if err != nil {
+		return err
+	}
+	store.Run()
+	defer func() { queue <- logstore.Event{Type: logstore.Terminate} }()
+
+	responses := make(chan logstore.Event, 1)
+	var producer, sequence int64
+	if *transaction {
+		if producer, err = beginTransaction(queue, responses); err != nil {
+			return err
+		}
+	}
+
+	// records are appended in batches, which compress far better than
+	// single records
+	var batch []logstore.Record
+	send := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		_, err := putRecords(queue, responses, batch)
+		batch = batch[:0]
+		return err
+	}
+	put := func(data []byte) error {
+		record := newRecord(data)
+		if *transaction {
+			sequence++
+			record.ProducerID = producer
+			record.Sequence = sequence
+			record.Transactional = true
+		}
+
+		batch = append(batch, record)
+		if len(batch) == batchSize {
+			return send()
+		}
+		return nil
+	}
+
+	count, err := produceAll(fs, *files, put)
+	if err == nil {
+		err = send()
+	}
+	if *transaction {
+		var end logstore.EventType = logstore.CommitTransaction
+		if err != nil {
+			end = logstore.AbortTransaction
+		}
+		queue <- logstore.Event{Type: end, Data: varint(producer), ResponseChan: responses}
+		if endErr := (<-responses).Error; err == nil {
+			err = endErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	queue <- logstore.Event{Type: logstore.FlushMetaData, ResponseChan: responses}
+	if err := (<-responses).Error; err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "produced %d records\n", count)
+
+	return nil
+}
+
+// produceToServer sends records to a running server in batches, or all in
+// one request when they make up a transaction.
+func produceToServer(c *client, fs *flag.FlagSet, files, transaction bool, newRecord func([]byte) logstore.Record) error {
+	var batch []logstore.Record
+	send := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		_, err := c.produce(batch, transaction)
+		batch = batch[:0]
+		return err
+	}
+
+	count, err := produceAll(fs, files, func(data []byte) error {
+		batch = append(batch, newRecord(data))
+		if !transaction && len(batch) == batchSize {
+			return send()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := send(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "produced %d records\n", count)
+
+	return nil
+}
+
+// produceAll hands put every record named on the command line or read
+// from stdin and returns how many it accepted.
+func produceAll(fs *flag.FlagSet, files bool, put func([]byte) error) (int, error) {
+	var count int
+	switch {
+	case fs.NArg() > 0:
+		for _, name := range fs.Args() {
+			data, err := ioutil.ReadFile(name)
+			if err != nil {
+				return count, err
+			}
+			if err := put(data); err != nil {
+				return count, err
+			}
+			count++
+		}
+	default:
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			var err error
+			data := append([]byte(nil), scanner.Bytes()...)
+			if files {
+				if data, err = ioutil.ReadFile(string(data)); err != nil {
+					return count, err
+				}
+			}
+			if err := put(data); err != nil {
+				return count, err
+			}
+			count++
+		}
+		if err := scanner.Err(); err != nil {
+			return count, err
+		}
+	}
+
+	return count, nil
+}
+
+// beginTransaction registers a new producer and opens a transaction for
+// it, returning the producer ID.
+func beginTransaction(queue chan<- logstore.Event, responses chan logstore.Event) (int64, error) {
+	queue <- logstore.Event{Type: logstore.InitProducer, ResponseChan: responses}
+	response := <-responses
+	if response.Error != nil {
+		return 0, response.Error
+	}
+	producer, _ := binary.Varint(response.Data)
+
+	queue <- logstore.Event{Type: logstore.BeginTransaction, Data: response.Data, ResponseChan: responses}
+	return producer, (<-responses).Error
+}
+
+// putRecords appends records as one batch and returns the offset of the
+// first.
+func putRecords(queue chan<- logstore.Event, responses chan logstore.Event, records []logstore.Record) (int64, error) {
+	data, err := logstore.MarshalRecords(records)
+	if err != nil {
+		return -1, err
+	}
+	queue <- logstore.Event{Type: logstore.PutRecords, Data: data, ResponseChan: responses}
+	response := <-responses
+	offset, _ := binary.Varint(response.Data)
+	return offset, response.Error
+}
+
+func varint(v int64) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+	return b[:binary.PutVarint(b, v)]
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/skabbass1/logstore/logstore"
+)
+
+// maxFetch bounds the records a single consume request returns.
+const maxFetch = 1000
+
+var errFetchFull = errors.New("fetch full")
+
+// server answers produce and consume requests for the store it owns.
+// Records travel as JSON lines in the export format.
+type server struct {
+	queue chan<- logstore.Event
+	opts  []logstore.Option
+}
+
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", ":7070", "address to listen on")
+	codecName := fs.String("codec", "none", "none, gzip or deflate")
+	chain := fs.Bool("chain", false, "hash chain records for audit")
+	fs.Parse(args)
+
+	opts := storeOpts
+	if *chain {
+		opts = append(opts, logstore.WithHashChain())
+	}
+	switch *codecName {
+	case "none":
+	case "gzip":
+		opts = append(opts, logstore.WithCodec(logstore.GzipCodec{}))
+	case "deflate":
+		opts = append(opts, logstore.WithCodec(logstore.DeflateCodec{}))
+	default:
+		return fmt.Errorf("serve: unknown codec %q", *codecName)
+	}
+
+	queue := make(chan logstore.Event, 100)
+	store, err := logstore.NewLogStore(queue, opts...)
+	if err != nil {
+		return err
+	}
+	store.Run()
+	defer func() { queue <- logstore.Event{Type: logstore.Terminate} }()
+
+	s := &server{queue, opts}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/records", s.records)
+	mux.HandleFunc("/offset", s.offset)
+	httpServer := &http.Server{Addr: *addr, Handler: mux}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		httpServer.Shutdown(context.Background())
+	}()
+
+	fmt.Fprintf(os.Stderr, "serving on %s\n", *addr)
+	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+
+	responses := make(chan logstore.Event, 1)
+	queue <- logstore.Event{Type: logstore.FlushMetaData, ResponseChan: responses}
+	return (<-responses).Error
+}
+
+func (s *server) records(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		s.produce(w, r)
+	case http.MethodGet:
+		s.consume(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// produce appends the records in the request body, all in one transaction
+// when asked to, and answers with their offsets once they are durable.
+func (s *server) produce(w http.ResponseWriter, r *http.Request) {
+	var records []logstore.Record
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		var e logstore.ExportRecord
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			http.Error(w, fmt.Sprintf("invalid record: %v", err), http.StatusBadRequest)
+			return
+		}
+		records = append(records, e.Record())
+	}
+	if err := scanner.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	offsets, err := s.append(records, r.URL.Query().Get("transaction") != "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(struct {
+		Offsets []int64 `json:"offsets"`
+	}{offsets})
+}
+
+func (s *server) append(records []logstore.Record, transaction bool) ([]int64, error) {
+	responses := make(chan logstore.Event, 1)
+	var producer int64
+	if transaction {
+		var err error
+		if producer, err = beginTransaction(s.queue, responses); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range records {
+		records[i].Offset = 0
+		if transaction {
+			records[i].ProducerID = producer
+			records[i].Sequence = int64(i + 1)
+			records[i].Transactional = true
+		}
+	}
+
+	var offsets []int64
+	var err error
+	for len(records) > 0 {
+		batch := records
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		records = records[len(batch):]
+
+		var first int64
+		if first, err = putRecords(s.queue, responses, batch); err != nil {
+			break
+		}
+		for i := range batch {
+			offsets = append(offsets, first+int64(i))
+		}
+	}
+
+	if transaction {
+		var end logstore.EventType = logstore.CommitTransaction
+		if err != nil {
+			end = logstore.AbortTransaction
+		}
+		s.queue <- logstore.Event{Type: end, Data: varint(producer), ResponseChan: responses}
+		if endErr := (<-responses).Error; err == nil {
+			err = endErr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.queue <- logstore.Event{Type: logstore.FlushMetaData, ResponseChan: responses}
+	return offsets, (<-responses).Error
+}
+
+// consume answers with up to maxFetch flushed records from the from
+// parameter on, skipping control records, and the offset to ask for next
+// in the Next-Offset header.
+func (s *server) consume(w http.ResponseWriter, r *http.Request) {
+	from, err := strconv.ParseInt(r.URL.Query().Get("from"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid from offset", http.StatusBadRequest)
+		return
+	}
+	opts := s.opts
+	if r.URL.Query().Get("read_committed") != "" {
+		opts = append(opts[:len(opts):len(opts)], logstore.WithIsolation(logstore.ReadCommitted))
+	}
+
+	// records past the flushed metadata may still be being appended
+	metadata, err := logstore.ReadMetaData(s.opts...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var records []logstore.ExportRecord
+	next, err := logstore.ScanRecords(from, metadata.NextOffset, func(record logstore.Record) error {
+		if record.Control != 0 {
+			return nil
+		}
+		if len(records) == maxFetch {
+			return errFetchFull
+		}
+		records = append(records, logstore.NewExportRecord(record))
+		return nil
+	}, opts...)
+	if err != nil && err != errFetchFull {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Next-Offset", strconv.FormatInt(next, 10))
+	enc := json.NewEncoder(w)
+	for _, record := range records {
+		enc.Encode(record)
+	}
+}
+
+// offset resolves the at parameter, as consume -from does, to an offset.
+func (s *server) offset(w http.ResponseWriter, r *http.Request) {
+	offset, err := resolveStart(r.URL.Query().Get("at"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(struct {
+		Offset int64 `json:"offset"`
+	}{offset})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/skabbass1/logstore/logstore"
+)
+
+func runVerify(args []string) error {
+	problems, err := logstore.Verify(storeOpts...)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("verify: %d problems found", len(problems))
+	}
+	fmt.Println("ok")
+
+	return nil
+}
+
+func runVerifyChain(args []string) error {
+	fs := flag.NewFlagSet("verify-chain", flag.ExitOnError)
+	from := fs.Int64("from", 1, "first offset to verify")
+	to := fs.Int64("to", -1, "offset to stop before, -1 for the end of the log")
+	manifestFile := fs.String("manifest", "", "manifest recorded earlier to check segment tails against")
+	fs.Parse(args)
+
+	problems, err := logstore.VerifyChain(*from, *to, storeOpts...)
+	if err != nil {
+		return err
+	}
+
+	if *manifestFile != "" {
+		data, err := ioutil.ReadFile(*manifestFile)
+		if err != nil {
+			return err
+		}
+		manifest, err := logstore.DecodeManifest(data)
+		if err != nil {
+			return fmt.Errorf("invalid manifest: %v", err)
+		}
+
+		tails, err := logstore.VerifyManifest(manifest, storeOpts...)
+		if err != nil {
+			return err
+		}
+		problems = append(problems, tails...)
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("verify-chain: %d problems found", len(problems))
+	}
+	fmt.Println("ok")
+
+	return nil
+}
+
+func runRepair(args []string) error {
+	if err := logstore.Repair(storeOpts...); err != nil {
+		return err
+	}
+
+	problems, err := logstore.Verify(storeOpts...)
+	if err != nil {
+		return err
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	fmt.Printf("repaired, %d problems remaining\n", len(problems))
+
+	return nil
+}
+
+func runCompact(args []string) error {
+	dropped, err := logstore.Compact(storeOpts...)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("dropped %d expired records\n", dropped)
+
+	return nil
+}
+
+func runMigrate(args []string) error {
+	migrated, err := logstore.MigrateSegments(storeOpts...)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("migrated %d records\n", migrated)
+
+	return nil
+}
@@ -0,0 +1,157 @@
+package logstore
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+var benchValue = bytes.Repeat([]byte("v"), 100)
+
+func BenchmarkLogSegment_Append(b *testing.B) {
+	for _, size := range []int{100, 1000, 10000} {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			defer removeTestFiles()
+			segment, err := NewLogSegment(1, 1<<62, false)
+			if err != nil {
+				b.Fatalf("%v\n", err)
+			}
+			defer segment.Close()
+
+			value := bytes.Repeat([]byte("v"), size)
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := segment.Append(value); err != nil {
+					b.Fatalf("%v\n", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkIndex_AddEntry(b *testing.B) {
+	defer removeTestFiles()
+	index, err := NewIndex("bench.index", 4096, false)
+	if err != nil {
+		b.Fatalf("%v\n", err)
+	}
+	defer index.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := index.AddEntry(IndexEntry{int64(i + 1), int64(i) * 100, 100}); err != nil {
+			b.Fatalf("%v\n", err)
+		}
+	}
+}
+
+func BenchmarkIndex_GetEntry(b *testing.B) {
+	defer removeTestFiles()
+	index, err := NewIndex("bench.index", 4096, false)
+	if err != nil {
+		b.Fatalf("%v\n", err)
+	}
+	defer index.Close()
+
+	const entries = 10000
+	for i := 0; i < entries; i++ {
+		index.AddEntry(IndexEntry{int64(i + 1), int64(i) * 100, 100})
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := index.GetEntry(int64(i%entries + 1)); err != nil {
+			b.Fatalf("%v\n", err)
+		}
+	}
+}
+
+// benchStore starts a store in the working directory and returns its
+// queue and a function that stops it and removes its files.
+func benchStore(b *testing.B, opts ...Option) (chan Event, func()) {
+	eventQueue := make(chan Event, 100)
+	store, err := NewLogStore(eventQueue, opts...)
+	if err != nil {
+		b.Fatalf("%v\n", err)
+	}
+	store.Run()
+
+	return eventQueue, func() {
+		eventQueue <- Event{Terminate, nil, nil, nil}
+		removeTestFiles()
+	}
+}
+
+func benchPut(b *testing.B, eventQueue chan Event, pchan chan Event, n int) {
+	for i := 0; i < n; i++ {
+		eventQueue <- Event{Put, benchValue, pchan, nil}
+		if err := (<-pchan).Error; err != nil {
+			b.Fatalf("%v\n", err)
+		}
+	}
+}
+
+// BenchmarkLogStore_Put includes rolling to a new segment whenever the
+// active one fills up.
+func BenchmarkLogStore_Put(b *testing.B) {
+	eventQueue, stop := benchStore(b)
+	defer stop()
+
+	pchan := make(chan Event, 1)
+	b.SetBytes(int64(len(benchValue)))
+	b.ResetTimer()
+	benchPut(b, eventQueue, pchan, b.N)
+}
+
+func BenchmarkLogStore_Get(b *testing.B) {
+	const records = 1000
+	for _, c := range []struct {
+		name string
+		from int64
+	}{
+		// a single segment holds about 25 of these records, so reads
+		// from the start of the log open closed segments
+		{"ClosedSegment", 1},
+		{"ActiveSegment", records + 1},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			eventQueue, stop := benchStore(b)
+			defer stop()
+
+			pchan := make(chan Event, 1)
+			benchPut(b, eventQueue, pchan, records+10)
+
+			b.SetBytes(int64(len(benchValue)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				offset := c.from + int64(i%10)
+				eventQueue <- Event{Get, varint(offset), pchan, nil}
+				if err := (<-pchan).Error; err != nil {
+					b.Fatalf("%v\n", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkLogStore_Roll measures closing a segment holding one record,
+// writing its caches and opening the next.
+func BenchmarkLogStore_Roll(b *testing.B) {
+	defer removeTestFiles()
+	store, err := NewLogStore(nil)
+	if err != nil {
+		b.Fatalf("%v\n", err)
+	}
+	defer store.CurrentSegment.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.append(Record{Value: benchValue}); err != nil {
+			b.Fatalf("%v\n", err)
+		}
+		if err := store.roll(store.CurrentSegment.NextOffset); err != nil {
+			b.Fatalf("%v\n", err)
+		}
+	}
+}
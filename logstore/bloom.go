@@ -0,0 +1,65 @@
+package logstore
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// BloomFilter answers whether a key may be in a set. False positives are
+// possible, false negatives are not.
+type BloomFilter struct {
+	Bits   []byte
+	Hashes uint32
+}
+
+// NewBloomFilter sizes a filter for n keys at the given false positive
+// rate.
+func NewBloomFilter(n int, falsePositiveRate float64) *BloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	bits := math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	hashes := math.Round(bits / float64(n) * math.Ln2)
+	if hashes < 1 {
+		hashes = 1
+	}
+
+	return &BloomFilter{
+		Bits:   make([]byte, (int(bits)+7)/8),
+		Hashes: uint32(hashes),
+	}
+}
+
+func (f *BloomFilter) Add(key []byte) {
+	f.each(key, func(bit uint64) bool {
+		f.Bits[bit/8] |= 1 << (bit % 8)
+		return true
+	})
+}
+
+func (f *BloomFilter) MayContain(key []byte) bool {
+	return f.each(key, func(bit uint64) bool {
+		return f.Bits[bit/8]&(1<<(bit%8)) != 0
+	})
+}
+
+// each derives the filter's bit positions for key from the two halves of
+// one 64 bit hash, stopping early when fn returns false.
+func (f *BloomFilter) each(key []byte, fn func(bit uint64) bool) bool {
+	size := uint64(len(f.Bits)) * 8
+	if size == 0 {
+		return false
+	}
+
+	h := fnv.New64a()
+	h.Write(key)
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32|1
+
+	for i := uint64(0); i < uint64(f.Hashes); i++ {
+		if !fn((h1 + i*h2) % size) {
+			return false
+		}
+	}
+	return true
+}
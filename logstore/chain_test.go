@@ -0,0 +1,177 @@
+package logstore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"testing"
+)
+
+func writeChainedLog(t *testing.T, n int) {
+	eventQueue := make(chan Event, 1000)
+	store, err := NewLogStore(eventQueue, WithHashChain())
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	store.Run()
+
+	pchan := make(chan Event, n)
+	for i := 1; i <= n; i++ {
+		eventQueue <- Event{Put, []byte(fmt.Sprintf("audit record %d", i)), pchan, nil}
+	}
+	for i := 1; i <= n; i++ {
+		<-pchan
+	}
+
+	eventQueue <- Event{FlushMetaData, nil, pchan, nil}
+	<-pchan
+	eventQueue <- Event{Terminate, nil, nil, nil}
+}
+
+func TestVerifyChain(t *testing.T) {
+	writeChainedLog(t, 300)
+
+	// a restarted store continues the chain from the last record on disk
+	writeChainedLog(t, 10)
+
+	problems, err := VerifyChain(1, -1)
+	if err != nil {
+		t.Errorf("%v\n", err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("Expected an intact chain. Got %v\n", problems)
+	}
+
+	problems, _ = VerifyChain(150, 200)
+	if len(problems) != 0 {
+		t.Errorf("Expected an intact chain in range. Got %v\n", problems)
+	}
+
+	removeTestFiles()
+}
+
+func TestVerifyChain_ModifiedRecord(t *testing.T) {
+	writeChainedLog(t, 300)
+
+	// rewrite the body of offset 10 and fix up its CRC so only the chain
+	// can tell
+	segment, _ := NewLogSegment(1, -1, true)
+	entry, _ := segment.Index.GetEntry(10)
+	data, _ := segment.readFrame(entry)
+	segment.Close()
+
+	body := data[BatchHeaderWidth+32:]
+	body[len(body)-1] = 'X'
+	binary.LittleEndian.PutUint32(data[14:18], crc32.ChecksumIEEE(body))
+
+	f, _ := os.OpenFile(segment.Name+".log", os.O_WRONLY, Perms)
+	f.WriteAt(data, entry.Position)
+	f.Close()
+
+	// the segment's recorded Merkle root no longer matches either
+	problems, _ := VerifyChain(1, -1)
+	if len(problems) != 2 || problems[0].Offset != 11 || problems[1].Message != "merkle root mismatch" {
+		t.Errorf("Expected chain break at offset %d and a root mismatch. Got %v\n", 11, problems)
+	}
+
+	removeTestFiles()
+}
+
+func TestVerifyChain_RemovedSegment(t *testing.T) {
+	writeChainedLog(t, 300)
+
+	bases, _ := Segments()
+	testConfig.removeSegment(fmt.Sprintf("%020d", bases[1]))
+
+	problems, _ := VerifyChain(1, -1)
+	if len(problems) != 1 || problems[0].Segment != bases[2] {
+		t.Errorf("Expected chain break at segment %d. Got %v\n", bases[2], problems)
+	}
+
+	removeTestFiles()
+}
+
+func TestVerifyManifest_TruncatedTail(t *testing.T) {
+	writeChainedLog(t, 20)
+
+	manifest, _ := BuildManifest()
+	if manifest.Segments[0].LastHash == "" {
+		t.Errorf("Expected manifest to record last batch hash\n")
+	}
+
+	segment, _ := NewLogSegment(1, -1, true)
+	entry, _ := segment.Index.GetEntry(20)
+	segment.Close()
+	os.Truncate(segment.Name+".log", entry.Position)
+	f, _ := os.OpenFile(segment.Name+".index", os.O_WRONLY, Perms)
+	f.WriteAt(make([]byte, IndexItemWidth), 19*IndexItemWidth)
+	f.Close()
+
+	problems, _ := VerifyChain(1, -1)
+	if len(problems) != 0 {
+		t.Errorf("Expected truncation to be invisible to the chain. Got %v\n", problems)
+	}
+
+	problems, _ = VerifyManifest(manifest)
+	if len(problems) != 1 || problems[0].Offset != 20 {
+		t.Errorf("Expected truncation at offset %d. Got %v\n", 20, problems)
+	}
+
+	removeTestFiles()
+}
+
+func TestVerifyChain_TruncatedClosedSegment(t *testing.T) {
+	writeChainedLog(t, 300)
+
+	// drop the last batch of the first segment, which no later link covers
+	// once the segment after it is gone too
+	bases, _ := Segments()
+	segment, _ := NewLogSegment(bases[0], -1, true)
+	last := bases[1] - 1
+	entry, _ := segment.Index.GetEntry(last)
+	segment.Close()
+	os.Truncate(segment.Name+".log", entry.Position)
+	f, _ := os.OpenFile(segment.Name+".index", os.O_WRONLY, Perms)
+	f.WriteAt(make([]byte, IndexItemWidth), (last-bases[0])*IndexItemWidth)
+	f.Close()
+
+	problems, _ := VerifyChain(1, bases[1])
+	var truncated bool
+	for _, p := range problems {
+		if p.Segment == bases[0] && p.Offset == last {
+			truncated = true
+		}
+	}
+	if !truncated {
+		t.Errorf("Expected truncation of segment %d at offset %d. Got %v\n", bases[0], last, problems)
+	}
+
+	removeTestFiles()
+}
+
+func TestVerifyChain_FromInsideBatch(t *testing.T) {
+	fsys := NewMemFS()
+	eventQueue := make(chan Event, 10)
+	store, _ := NewLogStore(eventQueue, WithFS(fsys), WithHashChain())
+	store.Run()
+
+	pchan := make(chan Event, 1)
+	putValues(t, eventQueue, 1, 1)
+	putRecords(eventQueue, pchan, []Record{{Value: []byte("a")}, {Value: []byte("b")}, {Value: []byte("c")}})
+	eventQueue <- Event{Terminate, nil, nil, nil}
+
+	// break the link from the final batch, at 2 to 4, to the one before
+	name := "00000000000000000001.log"
+	index, _ := readFile(fsys, "00000000000000000001.index")
+	entries, _ := decodeEntries(index)
+	log, _ := readFile(fsys, name)
+	log[entries[1].Position+BatchHeaderWidth] ^= 0xff
+	writeFile(fsys, name, log)
+
+	// starting inside the batch still checks it against the one before
+	problems, err := VerifyChain(3, -1, WithFS(fsys))
+	if err != nil || len(problems) != 1 || problems[0].Offset != 2 {
+		t.Errorf("Expected chain break at offset %d. Got %v %v\n", 2, problems, err)
+	}
+}
@@ -0,0 +1,48 @@
+package logstore
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the store the time when it stamps records and decides
+// whether they have expired.
+type Clock interface {
+	Now() time.Time
+}
+
+// ManualClock only moves when told to, letting tests fast-forward time.
+type ManualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+// now reads clock, falling back to the system time when there is none.
+func now(clock Clock) time.Time {
+	if clock == nil {
+		return time.Now()
+	}
+	return clock.Now()
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
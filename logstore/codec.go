@@ -0,0 +1,116 @@
+package logstore
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+)
+
+// Codec compresses record batches. The codec ID is stored in every batch
+// header so batches decode regardless of the codec a segment is written
+// with.
+type Codec interface {
+	ID() uint8
+	Encode(data []byte) ([]byte, error)
+	Decode(data []byte) ([]byte, error)
+}
+
+// Codec IDs fit in the low three bits of the batch attributes. Snappy, zstd
+// and lz4 are reserved for codecs registered with RegisterCodec.
+const (
+	NoCompression uint8 = iota
+	GzipCompression
+	DeflateCompression
+	SnappyCompression
+	ZstdCompression
+	LZ4Compression
+
+	codecMask = 0x07
+)
+
+var codecs = map[uint8]Codec{
+	GzipCompression:    GzipCodec{},
+	DeflateCompression: DeflateCodec{},
+}
+
+// RegisterCodec makes a codec available for decoding. Its ID must be one
+// of the reserved IDs from SnappyCompression up to the largest the batch
+// attributes hold, and not registered already. It is not safe to call
+// concurrently with reads and should be called during initialisation.
+func RegisterCodec(c Codec) error {
+	id := c.ID()
+	if id < SnappyCompression || id > codecMask {
+		return NewLogStoreErr(
+			InvalidCodec,
+			fmt.Sprintf("codec id %d is outside %d to %d", id, SnappyCompression, codecMask),
+			nil,
+		)
+	}
+	if _, ok := codecs[id]; ok {
+		return NewLogStoreErr(
+			InvalidCodec,
+			fmt.Sprintf("codec id %d is already registered", id),
+			nil,
+		)
+	}
+	codecs[id] = c
+	return nil
+}
+
+type GzipCodec struct{}
+
+func (GzipCodec) ID() uint8 {
+	return GzipCompression
+}
+
+func (GzipCodec) Encode(data []byte) ([]byte, error) {
+	buff := new(bytes.Buffer)
+	w := gzip.NewWriter(buff)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+func (GzipCodec) Decode(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+type DeflateCodec struct{}
+
+func (DeflateCodec) ID() uint8 {
+	return DeflateCompression
+}
+
+func (DeflateCodec) Encode(data []byte) ([]byte, error) {
+	buff := new(bytes.Buffer)
+	w, err := flate.NewWriter(buff, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+func (DeflateCodec) Decode(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,58 @@
+package logstore
+
+import "testing"
+
+// reverseCodec stands in for a codec registered by an application.
+type reverseCodec struct {
+	id uint8
+}
+
+func (c reverseCodec) ID() uint8 {
+	return c.id
+}
+
+func (reverseCodec) Encode(data []byte) ([]byte, error) {
+	out := make([]byte, len(data))
+	for i, b := range data {
+		out[len(data)-1-i] = b
+	}
+	return out, nil
+}
+
+func (c reverseCodec) Decode(data []byte) ([]byte, error) {
+	return c.Encode(data)
+}
+
+func TestRegisterCodec(t *testing.T) {
+	for _, id := range []uint8{NoCompression, GzipCompression, 8, 9} {
+		err := RegisterCodec(reverseCodec{id})
+		if err == nil || err.(LogStoreErr).ErrType != InvalidCodec {
+			t.Errorf("Expected InvalidCodec error for id %d. Got %v\n", id, err)
+		}
+	}
+
+	if err := RegisterCodec(reverseCodec{7}); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	t.Cleanup(func() { delete(codecs, 7) })
+	if err := RegisterCodec(reverseCodec{7}); err == nil {
+		t.Errorf("Expected registering id 7 twice to fail\n")
+	}
+
+	segment, _ := newLogSegment(NewMemFS(), 1, 8*1024, false)
+	defer segment.Close()
+	segment.Codec = reverseCodec{7}
+	if _, err := segment.Append([]byte("foo")); err != nil {
+		t.Errorf("%v\n", err)
+	}
+	if value, err := segment.Get(1); err != nil || string(value) != "foo" {
+		t.Errorf("Expected foo. Got %s %v\n", value, err)
+	}
+
+	// a codec readers could not find is never written
+	segment.Codec = reverseCodec{6}
+	_, err := segment.Append([]byte("bar"))
+	if err == nil || err.(LogStoreErr).ErrType != UnknownCodec {
+		t.Errorf("Expected UnknownCodec error. Got %v\n", err)
+	}
+}
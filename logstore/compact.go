@@ -0,0 +1,228 @@
+package logstore
+
+import (
+	"fmt"
+	"time"
+)
+
+// Compact drops batches whose records have all expired from the closed
+// segments in the working directory and returns the number of records
+// dropped. Offsets do not move: a dropped record keeps an empty index
+// entry, and reading it fails with RecordExpired. Hash chained batches are
+// kept so the chain still verifies.
+//
+// Each segment is rewritten to temporary files that replace the originals
+// once complete. Compact, Repair and NewLogStore finish a replacement
+// interrupted by a crash. Stores with tiered storage cannot be compacted.
+func Compact(opts ...Option) (int, error) {
+	c := newConfig(opts)
+	if c.Tiered != nil {
+		return 0, fmt.Errorf("cannot compact a store with tiered storage")
+	}
+
+	bases, err := c.segments()
+	if err != nil {
+		return 0, err
+	}
+
+	var dropped int
+	for i, base := range bases {
+		if err := c.finishCompaction(base); err != nil {
+			return dropped, err
+		}
+		if i+1 == len(bases) {
+			break
+		}
+
+		start := time.Now()
+		n, err := c.compactSegment(base)
+		if err != nil {
+			return dropped, err
+		}
+		c.Metrics.compacted(n, time.Since(start))
+		dropped += n
+	}
+
+	return dropped, nil
+}
+
+func (c *Config) compactSegment(base int64) (int, error) {
+	segment, err := c.openSegment(base, -1, true)
+	if err != nil {
+		return 0, err
+	}
+	defer segment.Close()
+
+	entries, err := segment.Index.Entries()
+	if err != nil {
+		return 0, err
+	}
+
+	fsys := c.fs()
+	names := compactionNames(base)
+	log, err := createFile(fsys, names.log)
+	if err != nil {
+		return 0, err
+	}
+	defer log.Close()
+
+	var kept []IndexEntry
+	var position int64
+	var dropped int
+	now := now(c.Clock)
+	for i := 0; i < len(entries); {
+		j := i + 1
+		for j < len(entries) && sameBatch(entries[j], entries[i]) {
+			j++
+		}
+		batch := entries[i:j]
+		i = j
+
+		expired := batch[0].Length == 0
+		var frame []byte
+		if !expired {
+			if frame, err = segment.readFrame(batch[0]); err != nil {
+				return 0, err
+			}
+			if expired, err = batchExpired(frame, c.Keys, now); err != nil {
+				return 0, err
+			}
+			if expired {
+				dropped += len(batch)
+			}
+		}
+
+		length := int64(len(frame))
+		if expired {
+			length = 0
+		} else if _, err := log.Write(frame); err != nil {
+			return 0, err
+		}
+		for _, entry := range batch {
+			kept = append(kept, IndexEntry{entry.Offset, position, length})
+		}
+		position += length
+	}
+
+	if dropped == 0 {
+		log.Close()
+		fsys.Remove(names.log)
+		return 0, nil
+	}
+	return dropped, c.replaceSegment(base, log, kept)
+}
+
+// replaceSegment swaps the log written to the segment's compaction log
+// file, indexed by entries, in for the segment at base.
+func (c *Config) replaceSegment(base int64, log File, entries []IndexEntry) error {
+	if err := log.Sync(); err != nil {
+		return err
+	}
+
+	fsys := c.fs()
+	names := compactionNames(base)
+	index, err := newIndex(fsys, names.partialIndex, int64(4096), false)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := index.AddEntry(entry); err != nil {
+			index.Close()
+			return err
+		}
+	}
+	if err := index.Close(); err != nil {
+		return err
+	}
+
+	// the caches describe the records being replaced
+	c.removeMerkleTree(base)
+	c.removeKeyIndex(base)
+
+	// the complete index is the commit point for the replacement
+	if err := fsys.Rename(names.partialIndex, names.index); err != nil {
+		return err
+	}
+	if err := c.finishCompaction(base); err != nil {
+		return err
+	}
+
+	// the replacement is deliberate, so the segment is recorded anew
+	if c.hasSegmentManifest(base) {
+		return c.writeSegmentManifest(base)
+	}
+	return nil
+}
+
+// batchExpired reports whether every record in an unchained batch has
+// expired.
+func batchExpired(frame []byte, keys KeyProvider, now time.Time) (bool, error) {
+	header, records, err := decodeBatch(frame, keys)
+	if err != nil {
+		return false, err
+	}
+	if header.Attributes&chainedAttr != 0 {
+		return false, nil
+	}
+
+	for _, record := range records {
+		if !record.Expired(now) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// finishCompaction moves a compacted segment's files into place once its
+// index is complete, and otherwise discards what a compaction left behind.
+func (c *Config) finishCompaction(base int64) error {
+	fsys := c.fs()
+	names := compactionNames(base)
+	if _, err := fsys.Stat(names.index); err != nil {
+		fsys.Remove(names.log)
+		fsys.Remove(names.partialIndex)
+		return nil
+	}
+
+	segment := fmt.Sprintf("%020d", base)
+	if _, err := fsys.Stat(names.log); err == nil {
+		if err := fsys.Rename(names.log, segment+".log"); err != nil {
+			return err
+		}
+	}
+	return fsys.Rename(names.index, segment+".index")
+}
+
+type compaction struct {
+	log          string
+	index        string
+	partialIndex string
+}
+
+func compactionNames(base int64) compaction {
+	segment := fmt.Sprintf("%020d", base)
+	return compaction{
+		log:          segment + ".log.compact",
+		index:        segment + ".index.compact",
+		partialIndex: segment + ".index.compact.tmp",
+	}
+}
+
+// liveEntries drops the empty entries left by compaction.
+func liveEntries(entries []IndexEntry) []IndexEntry {
+	live := entries[:0:0]
+	for _, entry := range entries {
+		if entry.Length > 0 {
+			live = append(live, entry)
+		}
+	}
+	return live
+}
+
+func compactedErr(offset int64) error {
+	return NewLogStoreErr(
+		RecordExpired,
+		fmt.Sprintf("offset %d was removed by compaction", offset),
+		nil,
+	)
+}
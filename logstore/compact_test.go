@@ -0,0 +1,171 @@
+package logstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLogStore_Get_Expired(t *testing.T) {
+	clock := NewManualClock(time.Unix(1546300800, 0))
+	eventQueue := make(chan Event, 1000)
+	store, _ := NewLogStore(eventQueue, WithClock(clock))
+	store.Run()
+
+	pchan := make(chan Event, 10)
+	record := Record{Value: []byte("59.0"), ExpiresAt: millis(clock.Now().Add(time.Minute))}
+	data, _ := record.MarshalBinary()
+	eventQueue <- Event{PutRecord, data, pchan, nil}
+	<-pchan
+	eventQueue <- Event{Put, []byte("60.0"), pchan, nil}
+	<-pchan
+
+	if err := getRecordErr(eventQueue, pchan, 1); err != nil {
+		t.Errorf("%v\n", err)
+	}
+
+	clock.Advance(2 * time.Minute)
+	err := getRecordErr(eventQueue, pchan, 1)
+	if err == nil || err.(LogStoreErr).ErrType != RecordExpired {
+		t.Errorf("Expected RecordExpired error. Got %v\n", err)
+	}
+
+	var values []string
+	ScanRecords(1, -1, func(record Record) error {
+		values = append(values, string(record.Value))
+		return nil
+	}, WithClock(clock))
+	if len(values) != 1 || values[0] != "60.0" {
+		t.Errorf("Expected the expired record to be skipped. Got %v\n", values)
+	}
+
+	eventQueue <- Event{Terminate, nil, nil, nil}
+	close(pchan)
+	close(eventQueue)
+	removeTestFiles()
+}
+
+func TestCompact(t *testing.T) {
+	clock := NewManualClock(time.Unix(1546300800, 0))
+	eventQueue := make(chan Event, 1000)
+	store, _ := NewLogStore(eventQueue, WithClock(clock))
+	store.Run()
+
+	pchan := make(chan Event, 10)
+	expires := millis(clock.Now().Add(time.Hour))
+	for i := 1; i <= 300; i++ {
+		record := Record{Value: []byte(fmt.Sprintf("value-%d", i))}
+		if i%2 == 0 {
+			record.ExpiresAt = expires
+		}
+		data, _ := record.MarshalBinary()
+		eventQueue <- Event{PutRecord, data, pchan, nil}
+		<-pchan
+	}
+	eventQueue <- Event{FlushMetaData, nil, pchan, nil}
+	<-pchan
+	eventQueue <- Event{Terminate, nil, nil, nil}
+
+	bases, _ := Segments()
+	before, _ := os.Stat(fmt.Sprintf("%020d.log", bases[0]))
+
+	if dropped, err := Compact(WithClock(clock)); err != nil || dropped != 0 {
+		t.Errorf("Expected nothing dropped before expiry. Got %d %v\n", dropped, err)
+	}
+
+	clock.Advance(2 * time.Hour)
+	dropped, err := Compact(WithClock(clock))
+	if err != nil {
+		t.Errorf("%v\n", err)
+	}
+	last := bases[len(bases)-1]
+	if expected := int(last-1) / 2; dropped != expected {
+		t.Errorf("Expected %d records dropped. Got %d\n", expected, dropped)
+	}
+
+	after, _ := os.Stat(fmt.Sprintf("%020d.log", bases[0]))
+	if after.Size() >= before.Size() {
+		t.Errorf("Expected log to shrink from %d bytes. Got %d\n", before.Size(), after.Size())
+	}
+
+	problems, err := Verify()
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Expected compacted segments to verify. Got %v %v\n", problems, err)
+	}
+
+	// compaction records the segments it rewrites anew
+	recorded, _ := testConfig.recordedManifest(1, -1)
+	problems, err = testConfig.verifyManifest(recorded)
+	if err != nil || len(recorded.Segments) == 0 || len(problems) != 0 {
+		t.Errorf("Expected compacted segments to match their records. Got %v %v\n", problems, err)
+	}
+
+	var count int
+	ScanRecords(1, -1, func(record Record) error {
+		if record.ExpiresAt != 0 {
+			t.Errorf("Expected expired record %d to be skipped\n", record.Offset)
+		}
+		count++
+		return nil
+	}, WithClock(clock))
+	if count != 150 {
+		t.Errorf("Expected %d records. Got %d\n", 150, count)
+	}
+
+	segment, _ := NewLogSegment(bases[0], -1, true)
+	_, err = segment.GetRecord(2)
+	if err == nil || err.(LogStoreErr).ErrType != RecordExpired {
+		t.Errorf("Expected RecordExpired error. Got %v\n", err)
+	}
+	segment.Close()
+
+	close(pchan)
+	close(eventQueue)
+	removeTestFiles()
+}
+
+func TestFinishCompaction(t *testing.T) {
+	names := compactionNames(1)
+
+	// a compaction that never wrote its index is discarded
+	ioutil.WriteFile(names.log, []byte("partial"), 0644)
+	if err := testConfig.finishCompaction(1); err != nil {
+		t.Errorf("%v\n", err)
+	}
+	if _, err := os.Stat(names.log); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to be removed\n", names.log)
+	}
+
+	// one whose index is complete is moved into place
+	ioutil.WriteFile(names.log, []byte("log"), 0644)
+	ioutil.WriteFile(names.index, []byte("index"), 0644)
+	if err := testConfig.finishCompaction(1); err != nil {
+		t.Errorf("%v\n", err)
+	}
+	if data, _ := ioutil.ReadFile("00000000000000000001.log"); string(data) != "log" {
+		t.Errorf("Expected the compacted log in place. Got %q\n", data)
+	}
+	if data, _ := ioutil.ReadFile("00000000000000000001.index"); string(data) != "index" {
+		t.Errorf("Expected the compacted index in place. Got %q\n", data)
+	}
+
+	removeTestFiles()
+}
+
+func TestRecord_MarshalBinary_ExpiresAt(t *testing.T) {
+	expected := Record{Value: []byte("foo"), ExpiresAt: 1546300800000}
+	data, _ := expected.MarshalBinary()
+
+	var got Record
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Errorf("%v\n", err)
+	}
+	if got.ExpiresAt != expected.ExpiresAt {
+		t.Errorf("Expected:%d Got:%d\n", expected.ExpiresAt, got.ExpiresAt)
+	}
+	if !got.Expired(time.Unix(1546300800, 0)) || got.Expired(time.Unix(1546300799, 0)) {
+		t.Errorf("Expected the record to expire at %d\n", expected.ExpiresAt)
+	}
+}
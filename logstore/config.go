@@ -0,0 +1,109 @@
+package logstore
+
+// Config holds the settings shared by a LogStore and the offline helpers
+// that read its directory.
+type Config struct {
+	Codec     Codec
+	Keys      KeyProvider
+	HashChain bool
+
+	LogAppendTime bool
+	Isolation     Isolation
+	Clock         Clock
+	FS            FS
+	Metrics       *Metrics
+	Observers     []Observer
+	Tiered        *TieredStorage
+
+	// spawn runs background work, such as asynchronous metadata writes.
+	// The simulation tests replace it to schedule that work themselves.
+	spawn func(func())
+}
+
+// Option configures a LogStore before its first segment is opened, or the
+// reads made by Scan, Export and Import.
+type Option func(*Config)
+
+// WithCodec compresses every batch the store appends with codec.
+func WithCodec(codec Codec) Option {
+	return func(c *Config) {
+		c.Codec = codec
+	}
+}
+
+// WithKeys encrypts appended batches with the provider's current key and
+// decrypts batches written under any key it still holds.
+func WithKeys(keys KeyProvider) Option {
+	return func(c *Config) {
+		c.Keys = keys
+	}
+}
+
+// WithHashChain makes every appended batch carry the hash of the batch
+// before it, so VerifyChain can detect tampering.
+func WithHashChain() Option {
+	return func(c *Config) {
+		c.HashChain = true
+	}
+}
+
+// WithLogAppendTime stamps records with the time they are written,
+// replacing any producer supplied timestamp.
+func WithLogAppendTime() Option {
+	return func(c *Config) {
+		c.LogAppendTime = true
+	}
+}
+
+// WithIsolation sets which records Get and the scans return.
+func WithIsolation(level Isolation) Option {
+	return func(c *Config) {
+		c.Isolation = level
+	}
+}
+
+// WithClock replaces the system clock used to stamp records and expire
+// them.
+func WithClock(clock Clock) Option {
+	return func(c *Config) {
+		c.Clock = clock
+	}
+}
+
+func (c *Config) goAsync(fn func()) {
+	if c.spawn == nil {
+		go fn()
+		return
+	}
+	c.spawn(fn)
+}
+
+func newConfig(opts []Option) Config {
+	var c Config
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+func (c *Config) openSegment(offset int64, maxSize int64, readOnly bool) (*LogSegment, error) {
+	return c.openSegmentIn(c.fs(), offset, maxSize, readOnly)
+}
+
+// openSegmentIn opens a segment held in fsys with the store's settings.
+func (c *Config) openSegmentIn(fsys FS, offset int64, maxSize int64, readOnly bool) (*LogSegment, error) {
+	segment, err := newLogSegment(fsys, offset, maxSize, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	segment.Codec = c.Codec
+	segment.Keys = c.Keys
+	segment.HashChain = c.HashChain
+	segment.LogAppendTime = c.LogAppendTime
+	segment.Clock = c.Clock
+	segment.Metrics = c.Metrics
+	segment.Observers = c.Observers
+	segment.Index.metrics = c.Metrics
+
+	return segment, nil
+}
@@ -0,0 +1,100 @@
+package logstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+)
+
+func TestLogSegment_Append_Encrypted(t *testing.T) {
+	keys := &StaticKeyProvider{
+		Current: 1,
+		Keys:    map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)},
+	}
+
+	segment, _ := NewLogSegment(1, 8*1024, false)
+	segment.Keys = keys
+	segment.Codec = GzipCodec{}
+	segment.Append([]byte("secret-one"))
+
+	// rotate to a new key, older batches stay readable
+	keys.Keys[2] = bytes.Repeat([]byte{2}, 32)
+	keys.Current = 2
+	segment.Append([]byte("secret-two"))
+	segment.Close()
+
+	raw, _ := ioutil.ReadFile(segment.Name + ".log")
+	if bytes.Contains(raw, []byte("secret")) {
+		t.Errorf("Expected log file not to contain plaintext\n")
+	}
+
+	rosegment, _ := NewLogSegment(1, -1, true)
+	defer rosegment.Close()
+
+	entries, _ := rosegment.Index.Entries()
+	if len(entries) != 2 {
+		t.Errorf("Expected index to stay readable with %d entries. Got %d\n", 2, len(entries))
+	}
+
+	if _, err := rosegment.Get(1); err == nil || err.(LogStoreErr).ErrType != KeyNotFound {
+		t.Errorf("Expected KeyNotFound error without keys. Got %v\n", err)
+	}
+
+	rosegment.Keys = keys
+	for offset, expected := range map[int64]string{1: "secret-one", 2: "secret-two"} {
+		data, err := rosegment.Get(offset)
+		if err != nil {
+			t.Errorf("%v\n", err)
+		}
+		if string(data) != expected {
+			t.Errorf("Expected offset %d to be %s. Got %s\n", offset, expected, data)
+		}
+	}
+
+	delete(keys.Keys, 1)
+	if _, err := rosegment.Get(1); err == nil || err.(LogStoreErr).ErrType != KeyNotFound {
+		t.Errorf("Expected KeyNotFound error for retired key. Got %v\n", err)
+	}
+
+	removeTestFiles()
+}
+
+func TestLogStore_Get_Encrypted_Closed_Segment(t *testing.T) {
+	keys := &StaticKeyProvider{
+		Current: 7,
+		Keys:    map[uint32][]byte{7: bytes.Repeat([]byte{7}, 16)},
+	}
+
+	eventQueue := make(chan Event, 1000)
+	store, _ := NewLogStore(eventQueue, WithKeys(keys))
+	store.Run()
+
+	pchan := make(chan Event, 500)
+	for i := 1; i <= 500; i++ {
+		data, _ := json.Marshal(TestMessage{"foo", i, 23.0, "bar"})
+		eventQueue <- Event{Put, data, pchan, nil}
+	}
+	for i := 1; i <= 500; i++ {
+		<-pchan
+	}
+
+	gchan := make(chan Event)
+	b := make([]byte, 8)
+	binary.PutVarint(b, 42)
+	eventQueue <- Event{Get, b, gchan, nil}
+
+	response := <-gchan
+	var m TestMessage
+	json.Unmarshal(response.Data, &m)
+	if response.Error != nil || m.V2 != 42 {
+		t.Errorf("Expected offset %d to hold message %d. Got %v %v\n", 42, 42, m, response.Error)
+	}
+
+	eventQueue <- Event{Terminate, nil, nil, nil}
+	close(pchan)
+	close(gchan)
+	close(eventQueue)
+	removeTestFiles()
+}
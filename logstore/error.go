@@ -9,6 +9,21 @@ const (
 	IndexIsReadOnly
 	SegmentIsReadOnly
 	OSErr
+	OffsetNotFound
+	CorruptRecord
+	UnknownCodec
+	KeyNotFound
+	OutOfOrderSequence
+	DuplicateSequence
+	InvalidTransactionState
+	NotCommitted
+	LeaseNotFound
+	RecordExpired
+	CorruptIndex
+	CorruptManifest
+	InvalidCodec
+	UnknownProducer
+	CorruptMetaData
 )
 
 type LogStoreErr struct {
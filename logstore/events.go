@@ -8,8 +8,26 @@ const (
 	Response
 	FlushMetaData
 	Terminate
+	Snapshot
+	PutRecord
+	GetRecord
+	InitProducer
+	BeginTransaction
+	CommitTransaction
+	AbortTransaction
+	PutRecords
 )
 
+// Put and Get carry bare values. PutRecord carries a Record encoded with
+// MarshalBinary and GetRecord answers with one. PutRecords carries records
+// encoded with MarshalRecords, written as one batch at consecutive offsets,
+// and answers with the offset of the first. Offsets, in requests and in
+// the responses to puts, are varint encoded. InitProducer answers with a
+// new producer ID once it is on disk. The transaction events carry the
+// varint ID of the producer whose transaction they begin or end, and
+// commit and abort answer with the offset of the marker they wrote. A
+// FlushMetaData with a response channel answers once every record appended
+// so far and the metadata are synced to disk.
 type Event struct {
 	Type         EventType
 	Data         []byte
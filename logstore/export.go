@@ -0,0 +1,354 @@
+package logstore
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+)
+
+type ExportFormat int
+
+const (
+	JSONLines ExportFormat = iota
+	TarArchive
+)
+
+const manifestName = "manifest.json"
+
+// ExportRecord is a single line of a JSON Lines export. Keys and values
+// are base64 encoded by encoding/json.
+type ExportRecord struct {
+	Offset    int64          `json:"offset"`
+	Timestamp int64          `json:"timestamp,omitempty"`
+	Key       []byte         `json:"key,omitempty"`
+	Headers   []ExportHeader `json:"headers,omitempty"`
+	Value     []byte         `json:"value"`
+	ExpiresAt int64          `json:"expires_at,omitempty"`
+}
+
+type ExportHeader struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+func NewExportRecord(record Record) ExportRecord {
+	e := ExportRecord{
+		Offset:    record.Offset,
+		Timestamp: record.Timestamp,
+		Key:       record.Key,
+		Value:     record.Value,
+		ExpiresAt: record.ExpiresAt,
+	}
+	for _, h := range record.Headers {
+		e.Headers = append(e.Headers, ExportHeader{h.Key, h.Value})
+	}
+	return e
+}
+
+func (e ExportRecord) Record() Record {
+	record := Record{
+		Offset:    e.Offset,
+		Timestamp: e.Timestamp,
+		Key:       e.Key,
+		Value:     e.Value,
+		ExpiresAt: e.ExpiresAt,
+	}
+	for _, h := range e.Headers {
+		record.Headers = append(record.Headers, Header{h.Key, h.Value})
+	}
+	return record
+}
+
+// Export writes the records in [from, to) to w. A negative to exports
+// through the end of the log. Tar archives hold whole segment files, so
+// they include every segment overlapping the range.
+func Export(w io.Writer, from, to int64, format ExportFormat, opts ...Option) error {
+	switch format {
+	case JSONLines:
+		c := newConfig(opts)
+		return c.exportJSONLines(w, from, to)
+	case TarArchive:
+		c := newConfig(opts)
+		return c.exportTar(w, from, to)
+	}
+
+	return fmt.Errorf("unknown export format %d", format)
+}
+
+func (c *Config) exportJSONLines(w io.Writer, from, to int64) error {
+	buff := bufio.NewWriter(w)
+	enc := json.NewEncoder(buff)
+
+	_, err := c.scan(from, to, func(record Record) error {
+		return enc.Encode(NewExportRecord(record))
+	})
+	if err != nil {
+		return err
+	}
+
+	return buff.Flush()
+}
+
+func (c *Config) exportTar(w io.Writer, from, to int64) error {
+	manifest, err := c.buildManifest()
+	if err != nil {
+		return err
+	}
+
+	var segments []SegmentManifest
+	for _, s := range manifest.Segments {
+		if s.NextOffset <= from || (to >= 0 && s.BaseOffset >= to) {
+			continue
+		}
+		segments = append(segments, s)
+	}
+	manifest.Segments = segments
+	if len(segments) > 0 {
+		manifest.NextOffset = segments[len(segments)-1].NextOffset
+	}
+
+	tw := tar.NewWriter(w)
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, manifestName, data); err != nil {
+		return err
+	}
+
+	for _, s := range segments {
+		for _, ext := range []string{"log", "index"} {
+			name := fmt.Sprintf("%s.%s", s.Name(), ext)
+			data, err := c.segmentFile(s.BaseOffset, ext)
+			if err != nil {
+				return err
+			}
+			if err := writeTarFile(tw, name, data); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tw.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	header := &tar.Header{
+		Name: name,
+		Mode: 0644,
+		Size: int64(len(data)),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// Import appends the records read from r to the log in the working
+// directory. With preserveOffsets the records keep their original offsets,
+// rolling to a new segment across any gap; importing an offset below the
+// end of the log is an error. Options apply both to reading tar archives and
+// to the appended batches.
+//
+// Tar archives are imported as plain records: transaction markers and the
+// records of transactions that did not commit are left out, and records
+// from idempotent producers lose their producer.
+func Import(r io.Reader, format ExportFormat, preserveOffsets bool, opts ...Option) error {
+	store, err := NewLogStore(nil, opts...)
+	if err != nil {
+		return err
+	}
+	imp := &importer{store, preserveOffsets}
+
+	switch format {
+	case JSONLines:
+		err = importJSONLines(r, imp)
+	case TarArchive:
+		err = importTar(r, imp)
+	default:
+		err = fmt.Errorf("unknown export format %d", format)
+	}
+
+	empty := store.CurrentSegment.NextOffset == store.CurrentSegment.StartOffset
+	store.CurrentSegment.Close()
+	if empty {
+		store.removeSegment(store.CurrentSegment.Name)
+	}
+	if err != nil {
+		return err
+	}
+
+	return store.writeMetaData(store.MetaData)
+}
+
+type importer struct {
+	store           *LogStore
+	preserveOffsets bool
+}
+
+func (imp *importer) add(record Record) error {
+	offset := record.Offset
+	if imp.preserveOffsets {
+		segment := imp.store.CurrentSegment
+		if offset < segment.NextOffset {
+			return fmt.Errorf(
+				"cannot import offset %d below end of log %d",
+				offset,
+				segment.NextOffset,
+			)
+		}
+
+		if offset > segment.NextOffset {
+			empty := segment.NextOffset == segment.StartOffset
+			if err := imp.store.roll(offset); err != nil {
+				return err
+			}
+			if empty {
+				imp.store.removeSegment(segment.Name)
+			}
+		}
+	}
+
+	_, err := imp.store.append(record)
+	return err
+}
+
+func importJSONLines(r io.Reader, imp *importer) error {
+	dec := json.NewDecoder(r)
+	for {
+		var record ExportRecord
+		err := dec.Decode(&record)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := imp.add(record.Record()); err != nil {
+			return err
+		}
+	}
+}
+
+func importTar(r io.Reader, imp *importer) error {
+	files := map[string][]byte{}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		files[header.Name] = data
+	}
+
+	manifest, err := DecodeManifest(files[manifestName])
+	if err != nil {
+		return err
+	}
+
+	var records []Record
+	for _, s := range manifest.Segments {
+		log := files[fmt.Sprintf("%s.log", s.Name())]
+		entries, err := decodeEntries(files[fmt.Sprintf("%s.index", s.Name())])
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range liveEntries(entries) {
+			if err := entry.check(int64(len(log))); err != nil {
+				return err
+			}
+			frame := log[entry.Position : entry.Position+entry.Length]
+			record, err := decodeRecord(frame, entry.Offset, imp.store.Keys)
+			if err != nil {
+				return err
+			}
+			records = append(records, record)
+		}
+	}
+
+	for _, record := range committedRecords(records) {
+		// the producers and transactions belong to the exporting store
+		record.ProducerID, record.Sequence, record.Transactional = 0, 0, false
+		if err := imp.add(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// committedRecords drops the transaction markers from records, along with
+// the records of transactions that were aborted or never ended.
+func committedRecords(records []Record) []Record {
+	keep := make([]bool, len(records))
+	open := map[int64][]int{}
+	for i, record := range records {
+		switch {
+		case record.Control == CommitMarker:
+			for _, j := range open[record.ProducerID] {
+				keep[j] = true
+			}
+			delete(open, record.ProducerID)
+		case record.Control == AbortMarker:
+			delete(open, record.ProducerID)
+		case record.Control != 0:
+		case record.Transactional:
+			open[record.ProducerID] = append(open[record.ProducerID], i)
+		default:
+			keep[i] = true
+		}
+	}
+
+	var committed []Record
+	for i, record := range records {
+		if keep[i] {
+			committed = append(committed, record)
+		}
+	}
+	return committed
+}
+
+// removeSegment deletes a segment, its caches and what is recorded about
+// it, along with any copy of it in remote storage.
+func (c *Config) removeSegment(name string) {
+	c.removeSegmentFiles(name, "log", "index", "merkle", "keys")
+	c.fs().Remove(fmt.Sprintf("%s.manifest", name))
+	c.fs().Remove(fmt.Sprintf("%s.aborted", name))
+	if base, err := strconv.ParseInt(name, 10, 64); err == nil {
+		if c.Tiered != nil {
+			c.Tiered.forget(base)
+		}
+		notify(c.Observers, LifecycleEvent{Type: SegmentDeleted, Segment: base})
+	}
+}
+
+// removeLocalSegment deletes the local copy of a segment held in remote
+// storage. Its key index and Merkle tree stay behind, so lookups and
+// comparisons need not fetch the segment.
+func (c *Config) removeLocalSegment(name string) {
+	c.removeSegmentFiles(name, "log", "index")
+	if base, err := strconv.ParseInt(name, 10, 64); err == nil {
+		notify(c.Observers, LifecycleEvent{Type: SegmentOffloaded, Segment: base})
+	}
+}
+
+func (c *Config) removeSegmentFiles(name string, exts ...string) {
+	for _, ext := range exts {
+		c.fs().Remove(fmt.Sprintf("%s.%s", name, ext))
+	}
+	c.Metrics.removed()
+}
@@ -0,0 +1,159 @@
+package logstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestExport_JSONLines(t *testing.T) {
+	writeTestSegment(t, 10)
+
+	var buff bytes.Buffer
+	if err := Export(&buff, 3, 6, JSONLines); err != nil {
+		t.Errorf("%v\n", err)
+	}
+
+	var records []ExportRecord
+	scanner := bufio.NewScanner(&buff)
+	for scanner.Scan() {
+		var record ExportRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Errorf("%v\n", err)
+		}
+		records = append(records, record)
+	}
+
+	if len(records) != 3 {
+		t.Fatalf("Expected %d records. Got %d\n", 3, len(records))
+	}
+	for i, record := range records {
+		var m TestMessage
+		json.Unmarshal(record.Value, &m)
+		if record.Offset != int64(i+3) || m.V2 != i+3 {
+			t.Errorf("Expected offset %d. Got %d with %v\n", i+3, record.Offset, m)
+		}
+	}
+
+	removeTestFiles()
+}
+
+func TestImport_PreserveOffsets(t *testing.T) {
+	writeTestSegment(t, 10)
+
+	var buff bytes.Buffer
+	Export(&buff, 5, -1, JSONLines)
+	removeTestFiles()
+
+	if err := Import(&buff, JSONLines, true); err != nil {
+		t.Errorf("%v\n", err)
+	}
+
+	segments, _ := Segments()
+	if len(segments) != 1 || segments[0] != 5 {
+		t.Errorf("Expected a single segment at %d. Got %v\n", 5, segments)
+	}
+
+	metadata, _ := ReadMetaData()
+	if metadata.NextOffset != 11 {
+		t.Errorf("Expected next offset to be %d. Got %d\n", 11, metadata.NextOffset)
+	}
+
+	var m TestMessage
+	_, err := Scan(7, 8, func(offset int64, data []byte) error {
+		return json.Unmarshal(data, &m)
+	})
+	if err != nil {
+		t.Errorf("%v\n", err)
+	}
+	if m.V2 != 7 {
+		t.Errorf("Expected offset %d to hold message %d. Got %v\n", 7, 7, m)
+	}
+
+	removeTestFiles()
+}
+
+func TestImport_Tar(t *testing.T) {
+	writeTestSegment(t, 10)
+
+	var buff bytes.Buffer
+	if err := Export(&buff, 1, -1, TarArchive); err != nil {
+		t.Errorf("%v\n", err)
+	}
+	removeTestFiles()
+
+	// without preserved offsets the records land at the end of the log
+	testConfig.writeMetaData(MetaData{NextOffset: 100})
+	if err := Import(&buff, TarArchive, false); err != nil {
+		t.Errorf("%v\n", err)
+	}
+
+	var offsets []int64
+	Scan(1, -1, func(offset int64, data []byte) error {
+		offsets = append(offsets, offset)
+		return nil
+	})
+	if len(offsets) != 10 || offsets[0] != 100 || offsets[9] != 109 {
+		t.Errorf("Expected offsets %d to %d. Got %v\n", 100, 109, offsets)
+	}
+
+	removeTestFiles()
+}
+
+func TestImport_Tar_Producers(t *testing.T) {
+	fsys := NewMemFS()
+	eventQueue := make(chan Event, 10)
+	store, _ := NewLogStore(eventQueue, WithFS(fsys))
+	store.Run()
+
+	// an aborted transaction at 2 to 5, a committed one at 7 to 9 and an
+	// idempotent record at 10
+	pchan := make(chan Event, 1)
+	writeAbortedTransaction(t, eventQueue, pchan)
+	producer := initProducer(t, eventQueue, pchan)
+	eventQueue <- Event{BeginTransaction, varint(producer), pchan, nil}
+	<-pchan
+	for sequence := int64(1); sequence <= 2; sequence++ {
+		if err := putTransactional(eventQueue, pchan, producer, sequence); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+	eventQueue <- Event{CommitTransaction, varint(producer), pchan, nil}
+	<-pchan
+	if _, err := putSequence(eventQueue, pchan, initProducer(t, eventQueue, pchan), 1); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	eventQueue <- Event{Terminate, nil, nil, nil}
+
+	var buff bytes.Buffer
+	if err := Export(&buff, 1, -1, TarArchive, WithFS(fsys)); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	for _, preserveOffsets := range []bool{false, true} {
+		imported := NewMemFS()
+		err := Import(bytes.NewReader(buff.Bytes()), TarArchive, preserveOffsets, WithFS(imported))
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+
+		var offsets []int64
+		ScanRecords(1, -1, func(record Record) error {
+			if record.ProducerID != 0 || record.Transactional || record.Control != 0 {
+				t.Errorf("Expected a plain record at %d. Got %v\n", record.Offset, record)
+			}
+			offsets = append(offsets, record.Offset)
+			return nil
+		}, WithFS(imported))
+
+		expected := []int64{1, 2, 3, 4, 5}
+		if preserveOffsets {
+			expected = []int64{1, 6, 7, 8, 10}
+		}
+		if fmt.Sprint(offsets) != fmt.Sprint(expected) {
+			t.Errorf("Expected offsets %v with preserved offsets %v. Got %v\n", expected, preserveOffsets, offsets)
+		}
+	}
+}
@@ -0,0 +1,407 @@
+package logstore
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// Fault is a failure FaultFS can inject into a file system operation.
+type Fault int
+
+const (
+	// WriteError fails any operation with EIO, leaving the file untouched.
+	WriteError Fault = iota + 1
+	// ShortWrite writes half of the data and then fails.
+	ShortWrite
+	// NoSpace fails a write, truncate or file creation with ENOSPC.
+	NoSpace
+	// SyncError fails a file or mapping sync, leaving the data unsynced.
+	SyncError
+	// PowerLoss cuts the power in place of the operation.
+	PowerLoss
+)
+
+// ErrCrashed is returned by files and mappings opened before a simulated
+// crash.
+var ErrCrashed = errors.New("file opened before crash")
+
+// FaultFS wraps a file system to test crash consistency. Every operation
+// that changes a file is numbered from 1, and faults injected at an
+// operation number fire on the first operation at or after it that they
+// apply to.
+//
+// FaultFS remembers what each file held when it was last synced. Syncing a
+// file or a mapping, or closing a mapping, makes its contents durable.
+// Creating, renaming, linking and removing files are durable at once, the
+// way a journaling file system orders them ahead of data. PowerLoss drops
+// everything written since the last sync.
+type FaultFS struct {
+	fs FS
+
+	mu     sync.Mutex
+	ops    int
+	gen    int
+	faults []injectedFault
+
+	// unsynced holds the durable contents of files written since they
+	// were last synced
+	unsynced map[string][]byte
+}
+
+type injectedFault struct {
+	op    int
+	fault Fault
+}
+
+type faultOp int
+
+const (
+	opWrite faultOp = iota
+	opCreate
+	opTruncate
+	opSync
+	opMeta
+)
+
+func NewFaultFS(fsys FS) *FaultFS {
+	return &FaultFS{fs: fsys, unsynced: map[string][]byte{}}
+}
+
+// Inject arms fault to fire at operation op.
+func (f *FaultFS) Inject(op int, fault Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.faults = append(f.faults, injectedFault{op, fault})
+}
+
+// Clear drops the faults that have not fired yet.
+func (f *FaultFS) Clear() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.faults = nil
+}
+
+// Ops returns the number of operations counted so far.
+func (f *FaultFS) Ops() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.ops
+}
+
+// Crash simulates the process dying. Files keep everything written to
+// them, but files and mappings opened before the crash stop working.
+func (f *FaultFS) Crash() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.gen++
+}
+
+// PowerLoss simulates the machine losing power. On top of a crash, every
+// file reverts to what it held when it was last synced.
+func (f *FaultFS) PowerLoss() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.powerLoss()
+}
+
+func (f *FaultFS) powerLoss() {
+	for name, data := range f.unsynced {
+		if _, err := f.fs.Stat(name); err != nil {
+			continue
+		}
+		writeFile(f.fs, name, data)
+	}
+	f.unsynced = map[string][]byte{}
+	f.gen++
+}
+
+// begin counts an operation on name and returns the fault it triggers.
+// The caller holds f.mu.
+func (f *FaultFS) begin(op faultOp, name string) (Fault, error) {
+	f.ops++
+	for i, injected := range f.faults {
+		if injected.op > f.ops || !injected.fault.appliesTo(op) {
+			continue
+		}
+		f.faults = append(f.faults[:i], f.faults[i+1:]...)
+
+		switch injected.fault {
+		case PowerLoss:
+			f.powerLoss()
+			return PowerLoss, &os.PathError{Op: "power loss", Path: name, Err: ErrCrashed}
+		case NoSpace:
+			return NoSpace, &os.PathError{Op: "write", Path: name, Err: syscall.ENOSPC}
+		case ShortWrite:
+			return ShortWrite, &os.PathError{Op: "write", Path: name, Err: io.ErrShortWrite}
+		default:
+			return injected.fault, &os.PathError{Op: "write", Path: name, Err: syscall.EIO}
+		}
+	}
+	return 0, nil
+}
+
+func (fault Fault) appliesTo(op faultOp) bool {
+	switch fault {
+	case ShortWrite:
+		return op == opWrite
+	case NoSpace:
+		return op == opWrite || op == opCreate || op == opTruncate
+	case SyncError:
+		return op == opSync
+	}
+	return true
+}
+
+// dirty records the durable contents of name before it is first changed
+// after a sync. The caller holds f.mu.
+func (f *FaultFS) dirty(name string) {
+	if _, ok := f.unsynced[name]; ok {
+		return
+	}
+	data, err := readFile(f.fs, name)
+	if err != nil {
+		data = nil
+	}
+	f.unsynced[name] = data
+}
+
+func (f *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if flag&(os.O_CREATE|os.O_TRUNC) != 0 {
+		if _, err := f.begin(opCreate, name); err != nil {
+			return nil, err
+		}
+		if _, err := f.fs.Stat(name); os.IsNotExist(err) {
+			f.unsynced[name] = nil
+		} else if flag&os.O_TRUNC != 0 {
+			f.dirty(name)
+		}
+	}
+
+	file, err := f.fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{file, f, name, f.gen}, nil
+}
+
+func (f *FaultFS) Stat(name string) (os.FileInfo, error) {
+	return f.fs.Stat(name)
+}
+
+func (f *FaultFS) Glob(pattern string) ([]string, error) {
+	return f.fs.Glob(pattern)
+}
+
+func (f *FaultFS) MkdirAll(path string, perm os.FileMode) error {
+	return f.fs.MkdirAll(path, perm)
+}
+
+func (f *FaultFS) Remove(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err := f.begin(opMeta, name); err != nil {
+		return err
+	}
+	if err := f.fs.Remove(name); err != nil {
+		return err
+	}
+	delete(f.unsynced, name)
+	return nil
+}
+
+func (f *FaultFS) Rename(oldname, newname string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err := f.begin(opMeta, oldname); err != nil {
+		return err
+	}
+	if err := f.fs.Rename(oldname, newname); err != nil {
+		return err
+	}
+
+	if data, ok := f.unsynced[oldname]; ok {
+		f.unsynced[newname] = data
+		delete(f.unsynced, oldname)
+	} else {
+		delete(f.unsynced, newname)
+	}
+	return nil
+}
+
+func (f *FaultFS) Link(oldname, newname string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err := f.begin(opMeta, newname); err != nil {
+		return err
+	}
+	if err := f.fs.Link(oldname, newname); err != nil {
+		return err
+	}
+
+	if data, ok := f.unsynced[oldname]; ok {
+		f.unsynced[newname] = data
+	}
+	return nil
+}
+
+func (f *FaultFS) Truncate(name string, size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err := f.begin(opTruncate, name); err != nil {
+		return err
+	}
+	f.dirty(name)
+	return f.fs.Truncate(name, size)
+}
+
+// Mmap counts writable mappings as writes, since the mapped file can
+// change at any time until the mapping is synced.
+func (f *FaultFS) Mmap(name string, writable bool) (Mapping, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if writable {
+		if _, err := f.begin(opWrite, name); err != nil {
+			return nil, err
+		}
+		f.dirty(name)
+	}
+
+	mapping, err := f.fs.Mmap(name, writable)
+	if err != nil {
+		return nil, err
+	}
+	return &faultMapping{mapping, f, name, f.gen, writable}, nil
+}
+
+// sync makes name durable when the sync at hand succeeds. A mapping that
+// stays open can change the file again straight away.
+func (f *FaultFS) sync(name string, gen int, fn func() error, mapped bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if gen != f.gen {
+		return ErrCrashed
+	}
+	if _, err := f.begin(opSync, name); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	delete(f.unsynced, name)
+	if mapped {
+		f.dirty(name)
+	}
+	return nil
+}
+
+type faultFile struct {
+	File
+	fs   *FaultFS
+	name string
+	gen  int
+}
+
+func (file *faultFile) stale() bool {
+	file.fs.mu.Lock()
+	defer file.fs.mu.Unlock()
+
+	return file.gen != file.fs.gen
+}
+
+func (file *faultFile) Read(p []byte) (int, error) {
+	if file.stale() {
+		return 0, ErrCrashed
+	}
+	return file.File.Read(p)
+}
+
+func (file *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if file.stale() {
+		return 0, ErrCrashed
+	}
+	return file.File.ReadAt(p, off)
+}
+
+func (file *faultFile) Write(p []byte) (int, error) {
+	return file.write(p, func(p []byte) (int, error) { return file.File.Write(p) })
+}
+
+func (file *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	return file.write(p, func(p []byte) (int, error) { return file.File.WriteAt(p, off) })
+}
+
+func (file *faultFile) write(p []byte, fn func([]byte) (int, error)) (int, error) {
+	f := file.fs
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if file.gen != f.gen {
+		return 0, ErrCrashed
+	}
+	fault, err := f.begin(opWrite, file.name)
+	if err != nil && fault != ShortWrite {
+		return 0, err
+	}
+
+	f.dirty(file.name)
+	if fault == ShortWrite {
+		n, _ := fn(p[:len(p)/2])
+		return n, err
+	}
+	return fn(p)
+}
+
+func (file *faultFile) Sync() error {
+	return file.fs.sync(file.name, file.gen, file.File.Sync, false)
+}
+
+func (file *faultFile) Close() error {
+	if file.stale() {
+		return ErrCrashed
+	}
+	return file.File.Close()
+}
+
+type faultMapping struct {
+	Mapping
+	fs       *FaultFS
+	name     string
+	gen      int
+	writable bool
+}
+
+func (m *faultMapping) Sync() error {
+	if !m.writable {
+		return m.Mapping.Sync()
+	}
+	return m.fs.sync(m.name, m.gen, m.Mapping.Sync, true)
+}
+
+// Close syncs a writable mapping the way unmapping a shared mapping does.
+func (m *faultMapping) Close() error {
+	var err error
+	if m.writable {
+		err = m.fs.sync(m.name, m.gen, m.Mapping.Sync, false)
+	}
+	if closeErr := m.Mapping.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
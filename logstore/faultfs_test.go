@@ -0,0 +1,194 @@
+package logstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+func TestFaultFS_PowerLoss(t *testing.T) {
+	fsys := NewFaultFS(NewMemFS())
+
+	f, _ := createFile(fsys, "a")
+	f.Write([]byte("synced"))
+	f.Sync()
+	f.Write([]byte(" lost"))
+
+	g, _ := createFile(fsys, "b")
+	g.Write([]byte("never synced"))
+
+	fsys.PowerLoss()
+
+	if _, err := f.Write([]byte("x")); err != ErrCrashed {
+		t.Errorf("Expected %v. Got %v\n", ErrCrashed, err)
+	}
+	if data, _ := readFile(fsys, "a"); string(data) != "synced" {
+		t.Errorf("Expected %q. Got %q\n", "synced", data)
+	}
+	if data, err := readFile(fsys, "b"); err != nil || len(data) != 0 {
+		t.Errorf("Expected b to survive empty. Got %q %v\n", data, err)
+	}
+}
+
+func TestFaultFS_Faults(t *testing.T) {
+	fsys := NewFaultFS(NewMemFS())
+	fsys.Inject(2, ShortWrite)
+	fsys.Inject(3, SyncError)
+
+	f, _ := createFile(fsys, "a")
+	n, err := f.Write([]byte("1234"))
+	if n != 2 || err == nil {
+		t.Errorf("Expected a short write of %d bytes. Got %d %v\n", 2, n, err)
+	}
+	if err := f.Sync(); err == nil {
+		t.Errorf("Expected sync to fail\n")
+	}
+	if err := f.Sync(); err != nil {
+		t.Errorf("%v\n", err)
+	}
+	if fsys.Ops() != 4 {
+		t.Errorf("Expected %d operations. Got %d\n", 4, fsys.Ops())
+	}
+}
+
+// crashRun is the outcome of running crashWorkload until it finishes or
+// the first error.
+type crashRun struct {
+	// acked holds the values the store acknowledged, in offset order.
+	acked [][]byte
+	// inflight is the value whose put failed, which may or may not have
+	// reached the log.
+	inflight []byte
+	// durable is the number of acked values covered by a successful sync.
+	durable int
+	failed  bool
+
+	// queue stops the store once the test has crashed it
+	queue chan Event
+}
+
+func (run crashRun) stop() {
+	if run.queue != nil {
+		run.queue <- Event{Terminate, nil, nil, nil}
+	}
+}
+
+func crashValue(i int) []byte {
+	return []byte(fmt.Sprintf("%03d-%s", i, bytes.Repeat([]byte("v"), 96)))
+}
+
+// crashWorkload appends enough records to roll a few segments, syncing
+// every ten, and stops at the first error. It leaves the store running.
+func crashWorkload(fsys FS) crashRun {
+	var run crashRun
+	eventQueue := make(chan Event, 10)
+	store, err := NewLogStore(eventQueue, WithFS(fsys))
+	if err != nil {
+		run.failed = true
+		return run
+	}
+	store.Run()
+	run.queue = eventQueue
+
+	pchan := make(chan Event, 1)
+	for i := 1; i <= 120; i++ {
+		eventQueue <- Event{Put, crashValue(i), pchan, nil}
+		if (<-pchan).Error != nil {
+			run.inflight = crashValue(i)
+			run.failed = true
+			return run
+		}
+		run.acked = append(run.acked, crashValue(i))
+
+		if i%10 == 0 {
+			eventQueue <- Event{FlushMetaData, nil, pchan, nil}
+			if (<-pchan).Error != nil {
+				run.failed = true
+				return run
+			}
+			run.durable = len(run.acked)
+		}
+	}
+	return run
+}
+
+// TestCrashRecovery injects every fault at every operation of the
+// workload, crashes the store at the first error and checks that repairing
+// the data directory recovers a prefix of what was acknowledged that
+// includes everything synced.
+func TestCrashRecovery(t *testing.T) {
+	counter := NewFaultFS(NewMemFS())
+	run := crashWorkload(counter)
+	ops := counter.Ops()
+	run.stop()
+	if run.failed {
+		t.Fatalf("Expected the workload to run without faults\n")
+	}
+
+	faults := []Fault{WriteError, ShortWrite, NoSpace, SyncError, PowerLoss}
+	for _, fault := range faults {
+		for op := 1; op <= ops; op++ {
+			fsys := NewFaultFS(NewMemFS())
+			fsys.Inject(op, fault)
+			run := crashWorkload(fsys)
+			fsys.Crash()
+			fsys.Clear()
+			run.stop()
+
+			if err := checkRecovery(fsys, run); err != nil {
+				t.Fatalf("fault %d at operation %d: %v\n", fault, op, err)
+			}
+		}
+	}
+}
+
+func checkRecovery(fsys FS, run crashRun) error {
+	if err := Repair(WithFS(fsys)); err != nil {
+		return fmt.Errorf("repair failed: %v", err)
+	}
+
+	attempted := run.acked
+	if run.inflight != nil {
+		attempted = append(attempted, run.inflight)
+	}
+
+	var recovered int
+	_, err := ScanRecords(1, -1, func(record Record) error {
+		if recovered >= len(attempted) || !bytes.Equal(record.Value, attempted[recovered]) {
+			return fmt.Errorf("offset %d holds %q, which was never acknowledged there", record.Offset, record.Value)
+		}
+		recovered++
+		return nil
+	}, WithFS(fsys))
+	if err != nil {
+		return err
+	}
+	if recovered < run.durable {
+		return fmt.Errorf("recovered %d records but %d were synced", recovered, run.durable)
+	}
+
+	if problems, err := Verify(WithFS(fsys)); err != nil || len(problems) != 0 {
+		return fmt.Errorf("verify after repair: %v %v", problems, err)
+	}
+
+	// the recovered store carries on from the end of what it recovered
+	eventQueue := make(chan Event, 10)
+	store, err := NewLogStore(eventQueue, WithFS(fsys))
+	if err != nil {
+		return fmt.Errorf("reopen failed: %v", err)
+	}
+	store.Run()
+	defer func() { eventQueue <- Event{Terminate, nil, nil, nil} }()
+
+	pchan := make(chan Event, 1)
+	eventQueue <- Event{Put, []byte("after"), pchan, nil}
+	response := <-pchan
+	if response.Error != nil {
+		return fmt.Errorf("put after recovery: %v", response.Error)
+	}
+	if offset, _ := binary.Varint(response.Data); offset != int64(recovered)+1 {
+		return fmt.Errorf("put after recovery landed at %d, expected %d", offset, recovered+1)
+	}
+	return nil
+}
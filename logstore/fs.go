@@ -0,0 +1,459 @@
+package logstore
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// FS is the file system the store keeps its files in. Paths are relative
+// to whatever the implementation treats as the data directory.
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	Remove(name string) error
+	Rename(oldname, newname string) error
+	Link(oldname, newname string) error
+	Truncate(name string, size int64) error
+	MkdirAll(path string, perm os.FileMode) error
+	Glob(pattern string) ([]string, error)
+
+	// Mmap maps the whole of name into memory. Writes to a writable
+	// mapping reach the file by the time the mapping is closed.
+	Mmap(name string, writable bool) (Mapping, error)
+}
+
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Sync() error
+}
+
+// Mapping is a file mapped into memory. Sync flushes writes to the
+// mapping through to the file.
+type Mapping interface {
+	Bytes() []byte
+	Sync() error
+	Close() error
+}
+
+// WithFS keeps the store's files in fsys rather than the working
+// directory.
+func WithFS(fsys FS) Option {
+	return func(c *Config) {
+		c.FS = fsys
+	}
+}
+
+func (c *Config) fs() FS {
+	if c.FS == nil {
+		return OSFS{}
+	}
+	return c.FS
+}
+
+func createFile(fsys FS, name string) (File, error) {
+	return fsys.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+func readFile(fsys FS, name string) ([]byte, error) {
+	f, err := fsys.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return io.ReadAll(f)
+}
+
+func writeFile(fsys FS, name string, data []byte) error {
+	f, err := createFile(fsys, name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// OSFS is the operating system's file system rooted at the working
+// directory.
+type OSFS struct{}
+
+func (OSFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (OSFS) Stat(name string) (os.FileInfo, error)        { return os.Stat(name) }
+func (OSFS) Remove(name string) error                     { return os.Remove(name) }
+func (OSFS) Rename(oldname, newname string) error         { return os.Rename(oldname, newname) }
+func (OSFS) Link(oldname, newname string) error           { return os.Link(oldname, newname) }
+func (OSFS) Truncate(name string, size int64) error       { return os.Truncate(name, size) }
+func (OSFS) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+func (OSFS) Glob(pattern string) ([]string, error)        { return filepath.Glob(pattern) }
+
+// Mmap maps the file shared with the kernel. Where mmap fails it falls
+// back to reading the file into memory and, for writable mappings, writing
+// it back on close.
+func (OSFS) Mmap(name string, writable bool) (Mapping, error) {
+	flag, prot := os.O_RDONLY, unix.PROT_READ
+	if writable {
+		flag, prot = os.O_RDWR, unix.PROT_READ|unix.PROT_WRITE
+	}
+
+	f, err := os.OpenFile(name, flag, Perms)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := unix.Mmap(int(f.Fd()), 0, int(fi.Size()), prot, unix.MAP_SHARED)
+	if err == nil {
+		return osMapping(data), nil
+	}
+
+	data, err = io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return &bufferMapping{name, data, writable}, nil
+}
+
+type osMapping []byte
+
+func (m osMapping) Bytes() []byte { return m }
+func (m osMapping) Sync() error   { return unix.Msync(m, unix.MS_SYNC) }
+
+func (m osMapping) Close() error {
+	unix.Msync(m, unix.MS_SYNC)
+	return unix.Munmap(m)
+}
+
+type bufferMapping struct {
+	name     string
+	data     []byte
+	writable bool
+}
+
+func (m *bufferMapping) Bytes() []byte { return m.data }
+
+func (m *bufferMapping) Sync() error {
+	if !m.writable {
+		return nil
+	}
+	f, err := os.OpenFile(m.name, os.O_WRONLY, Perms)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(m.data, 0); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (m *bufferMapping) Close() error { return m.Sync() }
+
+// MemFS keeps files in memory so a store can run without touching disk.
+// Directories are implied by file names. Hard links share contents, and
+// mappings share memory with the file until it is truncated.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memData
+}
+
+type memData struct {
+	mu      sync.Mutex
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{files: map[string]*memData{}}
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = filepath.Clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, ok := m.files[name]
+	switch {
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !ok:
+		d = &memData{modTime: time.Now()}
+		m.files[name] = d
+	}
+
+	if flag&os.O_TRUNC != 0 {
+		d.mu.Lock()
+		d.data = nil
+		d.modTime = time.Now()
+		d.mu.Unlock()
+	}
+
+	return &memFile{
+		name:     name,
+		d:        d,
+		writable: flag&(os.O_WRONLY|os.O_RDWR) != 0,
+		append:   flag&os.O_APPEND != 0,
+	}, nil
+}
+
+// add stores data as name without copying it, for files that are only
+// ever read.
+func (m *MemFS) add(name string, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[filepath.Clean(name)] = &memData{data: data, modTime: time.Now()}
+}
+
+func (m *MemFS) lookup(op, name string) (*memData, error) {
+	d, ok := m.files[filepath.Clean(name)]
+	if !ok {
+		return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return d, nil
+}
+
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, err := m.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return d.stat(name), nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.lookup("remove", name); err != nil {
+		return err
+	}
+	delete(m.files, filepath.Clean(name))
+	return nil
+}
+
+func (m *MemFS) Rename(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, err := m.lookup("rename", oldname)
+	if err != nil {
+		return err
+	}
+	delete(m.files, filepath.Clean(oldname))
+	m.files[filepath.Clean(newname)] = d
+	return nil
+}
+
+func (m *MemFS) Link(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, err := m.lookup("link", oldname)
+	if err != nil {
+		return err
+	}
+	if _, ok := m.files[filepath.Clean(newname)]; ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+	m.files[filepath.Clean(newname)] = d
+	return nil
+}
+
+func (m *MemFS) Truncate(name string, size int64) error {
+	m.mu.Lock()
+	d, err := m.lookup("truncate", name)
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.truncate(size)
+	return nil
+}
+
+func (m *MemFS) MkdirAll(path string, perm os.FileMode) error {
+	return nil
+}
+
+func (m *MemFS) Glob(pattern string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var matches []string
+	for name := range m.files {
+		ok, err := filepath.Match(pattern, name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matches = append(matches, name)
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+func (m *MemFS) Mmap(name string, writable bool) (Mapping, error) {
+	m.mu.Lock()
+	d, err := m.lookup("mmap", name)
+	m.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return memMapping(d.data), nil
+}
+
+type memMapping []byte
+
+func (m memMapping) Bytes() []byte { return m }
+func (m memMapping) Sync() error   { return nil }
+func (m memMapping) Close() error  { return nil }
+
+// truncate resizes the file, growing it in place when there is room so
+// mappings keep sharing its memory.
+func (d *memData) truncate(size int64) {
+	switch {
+	case size <= int64(len(d.data)):
+		d.data = d.data[:size]
+	case size <= int64(cap(d.data)):
+		n := len(d.data)
+		d.data = d.data[:size]
+		for i := n; i < len(d.data); i++ {
+			d.data[i] = 0
+		}
+	default:
+		grown := make([]byte, size, 2*size)
+		copy(grown, d.data)
+		d.data = grown
+	}
+	d.modTime = time.Now()
+}
+
+func (d *memData) stat(name string) os.FileInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return memFileInfo{filepath.Base(name), int64(len(d.data)), d.modTime}
+}
+
+type memFile struct {
+	name     string
+	d        *memData
+	pos      int64
+	writable bool
+	append   bool
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+
+	if off >= int64(len(f.d.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.d.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.append {
+		f.d.mu.Lock()
+		f.pos = int64(len(f.d.data))
+		f.d.mu.Unlock()
+	}
+	n, err := f.WriteAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if !f.writable {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+
+	if end := off + int64(len(p)); end > int64(len(f.d.data)) {
+		f.d.truncate(end)
+	}
+	copy(f.d.data[off:], p)
+	f.d.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		f.pos = offset
+	case io.SeekCurrent:
+		f.pos += offset
+	case io.SeekEnd:
+		f.d.mu.Lock()
+		f.pos = int64(len(f.d.data)) + offset
+		f.d.mu.Unlock()
+	}
+	return f.pos, nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) { return f.d.stat(f.name), nil }
+func (f *memFile) Sync() error                { return nil }
+func (f *memFile) Close() error               { return nil }
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,155 @@
+package logstore
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemFS_File(t *testing.T) {
+	fsys := NewMemFS()
+
+	_, err := fsys.OpenFile("missing", os.O_RDONLY, 0)
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected not exist error. Got %v\n", err)
+	}
+
+	f, _ := createFile(fsys, "a.log")
+	f.Write([]byte("hello"))
+	f.WriteAt([]byte("J"), 0)
+	f.Seek(0, io.SeekEnd)
+	f.Write([]byte(" world"))
+	f.Close()
+
+	data, err := readFile(fsys, "a.log")
+	if err != nil || string(data) != "Jello world" {
+		t.Errorf("Expected %q. Got %q %v\n", "Jello world", data, err)
+	}
+
+	fsys.Link("a.log", "b.log")
+	fsys.Truncate("a.log", 5)
+	if data, _ := readFile(fsys, "b.log"); string(data) != "Jello" {
+		t.Errorf("Expected the link to share contents. Got %q\n", data)
+	}
+
+	fsys.Rename("b.log", "dir/c.log")
+	names, _ := fsys.Glob("*.log")
+	if fmt.Sprint(names) != "[a.log]" {
+		t.Errorf("Expected [a.log]. Got %v\n", names)
+	}
+	names, _ = fsys.Glob("dir/*.log")
+	if fmt.Sprint(names) != "[dir/c.log]" {
+		t.Errorf("Expected [dir/c.log]. Got %v\n", names)
+	}
+
+	fi, _ := fsys.Stat("dir/c.log")
+	if fi.Size() != 5 {
+		t.Errorf("Expected size %d. Got %d\n", 5, fi.Size())
+	}
+}
+
+func TestMemFS_Index(t *testing.T) {
+	fsys := NewMemFS()
+	index, err := newIndex(fsys, "test.index", IndexItemWidth, false)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	// the second entry forces a resize and remap
+	for i := int64(1); i <= 2; i++ {
+		if err := index.AddEntry(IndexEntry{i, i * 10, 10}); err != nil {
+			t.Errorf("%v\n", err)
+		}
+	}
+	index.Close()
+
+	reader, _ := newIndex(fsys, "test.index", -1, true)
+	entries, _ := reader.Entries()
+	if len(entries) != 2 || entries[1] != (IndexEntry{2, 20, 10}) {
+		t.Errorf("Expected two entries. Got %v\n", entries)
+	}
+	reader.Close()
+}
+
+func TestLogStore_MemFS(t *testing.T) {
+	fsys := NewMemFS()
+	eventQueue := make(chan Event, 1000)
+	store, err := NewLogStore(eventQueue, WithFS(fsys))
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	store.Run()
+
+	pchan := make(chan Event, 10)
+	for i := 1; i <= 300; i++ {
+		eventQueue <- Event{Put, []byte(fmt.Sprintf("value-%d", i)), pchan, nil}
+		if err := (<-pchan).Error; err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+	eventQueue <- Event{FlushMetaData, nil, pchan, nil}
+	<-pchan
+
+	eventQueue <- Event{Get, varint(2), pchan, nil}
+	if response := <-pchan; string(response.Data) != "value-2" {
+		t.Errorf("Expected value-2. Got %s %v\n", response.Data, response.Error)
+	}
+	eventQueue <- Event{Terminate, nil, nil, nil}
+
+	bases, _ := Segments(WithFS(fsys))
+	if len(bases) < 2 {
+		t.Errorf("Expected the log to roll. Got segments %v\n", bases)
+	}
+	problems, err := Verify(WithFS(fsys))
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Expected no problems. Got %v %v\n", problems, err)
+	}
+
+	store, err = NewLogStore(eventQueue, WithFS(fsys))
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if store.MetaData.NextOffset != 301 {
+		t.Errorf("Expected next offset to be %d. Got %d\n", 301, store.MetaData.NextOffset)
+	}
+	store.Run()
+
+	eventQueue <- Event{Snapshot, []byte("snap"), pchan, nil}
+	if err := (<-pchan).Error; err != nil {
+		t.Errorf("%v\n", err)
+	}
+	eventQueue <- Event{Terminate, nil, nil, nil}
+
+	var count int
+	restored := NewMemFS()
+	for _, name := range mustGlob(fsys, "snap/*") {
+		data, _ := readFile(fsys, name)
+		writeFile(restored, filepath.Join("backup", filepath.Base(name)), data)
+	}
+	store, err = OpenSnapshot("backup", eventQueue, WithFS(restored))
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	store.CurrentSegment.Close()
+	ScanRecords(1, -1, func(Record) error {
+		count++
+		return nil
+	}, WithFS(restored))
+	if count != 300 {
+		t.Errorf("Expected %d records in the restored snapshot. Got %d\n", 300, count)
+	}
+
+	if files, _ := filepath.Glob("*.log"); len(files) != 0 {
+		t.Errorf("Expected nothing written to disk. Got %v\n", files)
+	}
+
+	close(pchan)
+	close(eventQueue)
+}
+
+func mustGlob(fsys FS, pattern string) []string {
+	names, _ := fsys.Glob(pattern)
+	return names
+}
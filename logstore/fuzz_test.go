@@ -0,0 +1,158 @@
+package logstore
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// fuzzSegment returns the log and index files of a small segment at
+// offset 1 to seed the fuzz targets.
+func fuzzSegment(f *testing.F, opts ...Option) ([]byte, []byte) {
+	c := newConfig(append(opts, WithFS(NewMemFS())))
+	segment, err := c.openSegment(1, 4096, false)
+	if err != nil {
+		f.Fatalf("%v\n", err)
+	}
+	segment.AppendRecords([]Record{
+		{Value: []byte("foo"), Key: []byte("k")},
+		{Value: []byte("bar"), Headers: []Header{{"h", []byte("v")}}},
+	})
+	segment.Append([]byte("baz"))
+	segment.Close()
+
+	log, _ := readFile(c.fs(), "00000000000000000001.log")
+	index, _ := readFile(c.fs(), "00000000000000000001.index")
+	return log, index
+}
+
+// checkCorruptErr fails unless err is nil or one of the store's own
+// errors.
+func checkCorruptErr(t *testing.T, err error) {
+	if _, ok := err.(LogStoreErr); err != nil && !ok {
+		t.Errorf("Expected a LogStoreErr. Got %T %v\n", err, err)
+	}
+}
+
+func FuzzIndex(f *testing.F) {
+	_, index := fuzzSegment(f)
+	f.Add(index, int64(2))
+	f.Add(index[:IndexItemWidth+3], int64(2))
+	f.Add([]byte{}, int64(1))
+
+	f.Fuzz(func(t *testing.T, data []byte, offset int64) {
+		fsys := NewMemFS()
+		writeFile(fsys, "test.index", data)
+		index, err := newIndex(fsys, "test.index", -1, true)
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		defer index.Close()
+
+		entry, err := index.GetEntry(offset)
+		checkCorruptErr(t, err)
+		if err == nil && entry.Offset != offset {
+			t.Errorf("Expected entry for offset %d. Got %v\n", offset, entry)
+		}
+
+		_, err = index.Entries()
+		checkCorruptErr(t, err)
+	})
+}
+
+func FuzzLogSegment(f *testing.F) {
+	log, index := fuzzSegment(f)
+	f.Add(log, index, int64(1))
+	f.Add(log, index, int64(3))
+	f.Add(log[:len(log)-1], index, int64(3))
+	compressed, compressedIndex := fuzzSegment(f, WithCodec(GzipCodec{}))
+	f.Add(compressed, compressedIndex, int64(2))
+
+	f.Fuzz(func(t *testing.T, log, index []byte, offset int64) {
+		fsys := NewMemFS()
+		writeFile(fsys, "00000000000000000001.log", log)
+		writeFile(fsys, "00000000000000000001.index", index)
+
+		segment, err := newLogSegment(fsys, 1, -1, true)
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		defer segment.Close()
+
+		record, err := segment.GetRecord(offset)
+		checkCorruptErr(t, err)
+		if err == nil && record.Offset != offset {
+			t.Errorf("Expected record at offset %d. Got %d\n", offset, record.Offset)
+		}
+
+		_, err = ScanRecords(1, -1, func(Record) error { return nil }, WithFS(fsys))
+		checkCorruptErr(t, err)
+	})
+}
+
+func FuzzRecord(f *testing.F) {
+	log, _ := fuzzSegment(f)
+	f.Add(log)
+	for _, r := range []Record{
+		{Value: []byte("foo")},
+		{Key: []byte("k"), Headers: []Header{{"h", []byte("v")}}, ProducerID: 1, Sequence: 2, ExpiresAt: 3},
+		{Transactional: true, Control: CommitMarker, ProducerID: 1},
+	} {
+		data, _ := r.MarshalBinary()
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var record Record
+		checkCorruptErr(t, record.UnmarshalBinary(data))
+
+		_, records, err := decodeBatch(data, nil)
+		checkCorruptErr(t, err)
+		for i, record := range records {
+			if i > 0 && record.Offset != records[i-1].Offset+1 {
+				t.Errorf("Expected consecutive offsets. Got %v\n", records)
+			}
+		}
+	})
+}
+
+func FuzzManifest(f *testing.F) {
+	manifest, _ := json.Marshal(Manifest{
+		NextOffset: 31,
+		Segments: []SegmentManifest{
+			{BaseOffset: 1, NextOffset: 11, LogSize: 100, MerkleRoot: hexHash([32]byte{1})},
+			{BaseOffset: 11, NextOffset: 31, LogSize: 200, LastHash: hexHash([32]byte{2})},
+		},
+	})
+	f.Add(manifest)
+	f.Add([]byte(`{"NextOffset":1}`))
+	f.Add([]byte(`{"NextOffset":5,"Segments":[{"BaseOffset":3,"NextOffset":1}]}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := DecodeManifest(data)
+		if err != nil {
+			if lsErr, ok := err.(LogStoreErr); !ok || lsErr.ErrType != CorruptManifest {
+				t.Errorf("Expected a CorruptManifest error. Got %v\n", err)
+			}
+			return
+		}
+
+		next := int64(1)
+		for _, s := range m.Segments {
+			if s.BaseOffset < next || s.NextOffset < s.BaseOffset || s.LogSize < 0 {
+				t.Errorf("Accepted a malformed segment %v\n", s)
+			}
+			next = s.NextOffset
+		}
+		if m.NextOffset < next {
+			t.Errorf("Accepted next offset %d behind segments ending at %d\n", m.NextOffset, next)
+		}
+
+		// whatever is accepted survives a round trip
+		encoded, _ := json.Marshal(m)
+		again, err := DecodeManifest(encoded)
+		if err != nil || !reflect.DeepEqual(again, m) {
+			t.Errorf("Expected %v to round trip. Got %v %v\n", m, again, err)
+		}
+	})
+}
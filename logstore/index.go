@@ -3,9 +3,7 @@ package logstore
 import (
 	"bytes"
 	"encoding/binary"
-	"os"
-
-	"golang.org/x/sys/unix"
+	"fmt"
 )
 
 const IndexItemWidth = 24
@@ -22,6 +20,10 @@ type Index struct {
 	Data       *[]byte
 	NextOffset int64
 	ReadOnly   bool
+
+	fs      FS
+	mapping Mapping
+	metrics *Metrics
 }
 
 func (entry *IndexEntry) ToBytes() ([]byte, error) {
@@ -33,6 +35,9 @@ func (entry *IndexEntry) ToBytes() ([]byte, error) {
 }
 
 func (entry *IndexEntry) FromBytes(data []byte) error {
+	if len(data) < IndexItemWidth {
+		return NewLogStoreErr(CorruptIndex, "index entry truncated", nil)
+	}
 	reader := bytes.NewReader(data)
 	if err := binary.Read(reader, binary.LittleEndian, entry); err != nil {
 		return err
@@ -42,24 +47,36 @@ func (entry *IndexEntry) FromBytes(data []byte) error {
 }
 
 func NewIndex(name string, size int64, readOnly bool) (*Index, error) {
-	var data []byte
-	var err error
+	return newIndex(OSFS{}, name, size, readOnly)
+}
 
-	if readOnly {
-		data, err = readOnlyMemMap(name)
-	} else {
-		err = createFile(name, size)
-		data, err = memMap(name, 0, size)
+// newIndex maps the index file name from fsys, creating it with size
+// bytes unless it is opened read only.
+func newIndex(fsys FS, name string, size int64, readOnly bool) (*Index, error) {
+	if !readOnly {
+		f, err := createFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+		if err := fsys.Truncate(name, size); err != nil {
+			return nil, err
+		}
 	}
+
+	mapping, err := fsys.Mmap(name, !readOnly)
 	if err != nil {
 		return nil, err
 	}
+	data := mapping.Bytes()
 
 	return &Index{
 		Name:     name,
 		Data:     &data,
 		ReadOnly: readOnly,
-	}, err
+		fs:       fsys,
+		mapping:  mapping,
+	}, nil
 }
 
 func (m *Index) AddEntry(entry IndexEntry) error {
@@ -88,28 +105,106 @@ func (m *Index) AddEntry(entry IndexEntry) error {
 	return err
 }
 
+// GetEntry returns the entry for offset. Offsets outside the entries
+// written so far are not found, and a slot holding some other offset means
+// the index is corrupt.
 func (m *Index) GetEntry(offset int64) (IndexEntry, error) {
+	data := *m.Data
 	first := IndexEntry{}
-	if err := first.FromBytes((*m.Data)[:IndexItemWidth]); err != nil {
-		return IndexEntry{}, err
+	if err := first.FromBytes(data); err != nil || first.Offset == 0 {
+		return IndexEntry{}, offsetErr(offset)
 	}
 
 	distance := offset - first.Offset
-	if distance == 0 {
-		return first, nil
+	if distance < 0 || distance >= int64(len(data))/IndexItemWidth {
+		return IndexEntry{}, offsetErr(offset)
 	}
 
-	start := IndexItemWidth * distance
-	end := start + IndexItemWidth
-
 	entry := IndexEntry{}
-	if err := entry.FromBytes((*m.Data)[start:end]); err != nil {
+	start := IndexItemWidth * distance
+	if err := entry.FromBytes(data[start : start+IndexItemWidth]); err != nil {
 		return IndexEntry{}, err
 	}
+	switch {
+	case entry.Offset == 0:
+		return IndexEntry{}, offsetErr(offset)
+	case entry.Offset != offset:
+		return IndexEntry{}, NewLogStoreErr(
+			CorruptIndex,
+			fmt.Sprintf("index slot for offset %d holds offset %d", offset, entry.Offset),
+			nil,
+		)
+	}
 
 	return entry, nil
 }
 
+func offsetErr(offset int64) error {
+	return NewLogStoreErr(
+		OffsetNotFound,
+		fmt.Sprintf("offset %d is not in the index", offset),
+		nil,
+	)
+}
+
+// check returns a corruption error unless the entry lies within a log of
+// size bytes.
+func (entry IndexEntry) check(size int64) error {
+	if entry.Position < 0 || entry.Length < 0 || entry.Position > size || entry.Length > size-entry.Position {
+		return NewLogStoreErr(
+			CorruptIndex,
+			fmt.Sprintf(
+				"offset %d points at [%d, +%d) past the end of a log of %d bytes",
+				entry.Offset,
+				entry.Position,
+				entry.Length,
+				size,
+			),
+			nil,
+		)
+	}
+	return nil
+}
+
+// Entries returns the entries written to the index in offset order. Index
+// files are preallocated, so the scan stops at the first zeroed slot.
+func (m *Index) Entries() ([]IndexEntry, error) {
+	return decodeEntries(*m.Data)
+}
+
+// entriesBefore returns the entries of an index starting at base for the
+// offsets below to, or all of them when to is negative. The slots past to
+// are never read, since a store may be writing them.
+func (m *Index) entriesBefore(base, to int64) ([]IndexEntry, error) {
+	data := *m.Data
+	if to >= 0 {
+		n := (to - base) * IndexItemWidth
+		if n < 0 {
+			n = 0
+		}
+		if n < int64(len(data)) {
+			data = data[:n]
+		}
+	}
+	return decodeEntries(data)
+}
+
+func decodeEntries(data []byte) ([]IndexEntry, error) {
+	var entries []IndexEntry
+	for start := int64(0); start+IndexItemWidth <= int64(len(data)); start += IndexItemWidth {
+		entry := IndexEntry{}
+		if err := entry.FromBytes(data[start : start+IndexItemWidth]); err != nil {
+			return nil, err
+		}
+		if entry.Offset == 0 {
+			break
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
 func (m *Index) Resize(size int64) error {
 	if m.ReadOnly {
 		return NewLogStoreErr(
@@ -118,75 +213,50 @@ func (m *Index) Resize(size int64) error {
 			nil,
 		)
 	}
-	m.Close()
+	if err := m.Close(); err != nil {
+		return err
+	}
 
-	err := os.Truncate(m.Name, size)
-	if err != nil {
+	if err := m.fs.Truncate(m.Name, size); err != nil {
+		// map the file as it was so the entries added so far stay readable
+		m.remap()
 		return err
 	}
-	data, err := memMap(m.Name, 0, size)
-	if err != nil {
+	if err := m.remap(); err != nil {
 		return err
 	}
-	m.Data = &data
+	m.metrics.resized()
 
 	return nil
 }
 
-func (m *Index) Close() error {
-	unix.Msync(*m.Data, unix.MS_SYNC)
-	return unix.Munmap(*m.Data)
-}
-
-func createFile(name string, size int64) error {
-	f, err := os.Create(name)
-	defer f.Close()
-
-	err = f.Truncate(size)
-	return err
-}
-
-func readOnlyMemMap(name string) ([]byte, error) {
-	f, err := os.OpenFile(name, os.O_RDONLY, Perms)
+func (m *Index) remap() error {
+	mapping, err := m.fs.Mmap(m.Name, true)
 	if err != nil {
-		return nil, err
+		empty := []byte{}
+		m.Data = &empty
+		return err
 	}
-
-	defer f.Close()
-
-	fd := int(f.Fd())
-
-	fi, err := f.Stat()
-	size := fi.Size()
-
-	data, err := unix.Mmap(
-		fd,
-		0,
-		int(size),
-		unix.PROT_READ,
-		unix.MAP_SHARED,
-	)
-
-	return data, err
+	data := mapping.Bytes()
+	m.Data = &data
+	m.mapping = mapping
+	return nil
 }
 
-func memMap(name string, offset int64, length int64) ([]byte, error) {
-	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, Perms)
-	defer f.Close()
-
-	if err != nil {
-		return nil, err
+// truncate drops the entries added from byte position next on.
+func (m *Index) truncate(next int64) {
+	data := *m.Data
+	for i := next; i < m.NextOffset && i < int64(len(data)); i++ {
+		data[i] = 0
 	}
+	m.NextOffset = next
+}
 
-	fd := int(f.Fd())
-
-	data, err := unix.Mmap(
-		fd,
-		offset,
-		int(length),
-		unix.PROT_WRITE|unix.PROT_READ,
-		unix.MAP_SHARED,
-	)
+// Sync flushes the entries added so far to the index file.
+func (m *Index) Sync() error {
+	return m.mapping.Sync()
+}
 
-	return data, err
+func (m *Index) Close() error {
+	return m.mapping.Close()
 }
@@ -250,6 +250,69 @@ func TestIndex_GetEntry_ReadOnly(t *testing.T) {
 	cleanup(fpath)
 }
 
+func TestIndex_Entries(t *testing.T) {
+	fpath := "/tmp/test_mapped"
+
+	idx, _ := NewIndex(fpath, 1024, false)
+
+	idx.AddEntry(IndexEntry{1, 0, 150})
+	idx.AddEntry(IndexEntry{2, 150, 150})
+	idx.AddEntry(IndexEntry{3, 300, 150})
+
+	idx.Close()
+
+	roidx, _ := NewIndex(fpath, -1, true)
+	defer roidx.Close()
+
+	got, err := roidx.Entries()
+	if err != nil {
+		t.Errorf("%v\n", err)
+	}
+
+	expected := []IndexEntry{
+		IndexEntry{1, 0, 150},
+		IndexEntry{2, 150, 150},
+		IndexEntry{3, 300, 150},
+	}
+
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %d entries. Got %d\n", len(expected), len(got))
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("Expected:%v Got:%v\n", expected[i], got[i])
+		}
+	}
+
+	cleanup(fpath)
+}
+
+func TestIndex_GetEntry_OutOfRange(t *testing.T) {
+	fsys := NewMemFS()
+	idx, _ := newIndex(fsys, "test.index", 1024, false)
+	defer idx.Close()
+
+	idx.AddEntry(IndexEntry{5, 0, 150})
+	idx.AddEntry(IndexEntry{6, 150, 150})
+	idx.AddEntry(IndexEntry{9, 300, 150})
+
+	cases := []struct {
+		offset  int64
+		errType LogStoreErrType
+	}{
+		{4, OffsetNotFound},
+		{8, OffsetNotFound},
+		{100, OffsetNotFound},
+		{7, CorruptIndex},
+	}
+	for _, c := range cases {
+		_, err := idx.GetEntry(c.offset)
+		if lsErr, ok := err.(LogStoreErr); !ok || lsErr.ErrType != c.errType {
+			t.Errorf("offset %d: Expected error type %d. Got %v\n", c.offset, c.errType, err)
+		}
+	}
+}
+
 func cleanup(fpath string) {
 	os.Remove(fpath)
 }
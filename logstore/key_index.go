@@ -0,0 +1,190 @@
+package logstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+const keyFilterFalsePositiveRate = 0.01
+
+// FindByKey returns the offsets of the records with key in ascending
+// order. Closed segments are looked up through their .keys file, skipping
+// those whose Bloom filter excludes the key, and the rest, including
+// segments only held remotely, are scanned.
+func FindByKey(key []byte, opts ...Option) ([]int64, error) {
+	c := newConfig(opts)
+
+	bases, err := c.allSegments()
+	if err != nil {
+		return nil, err
+	}
+
+	var offsets []int64
+	for i, base := range bases {
+		if i+1 < len(bases) {
+			found, err := c.lookupKeyIndex(base, key)
+			if err == nil {
+				offsets = append(offsets, found...)
+				continue
+			}
+		}
+
+		_, err := c.scanSegment(base, base, -1, func(record Record) error {
+			if record.Key != nil && bytes.Equal(record.Key, key) {
+				offsets = append(offsets, record.Offset)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.Isolation == ReadCommitted {
+		return c.committedOffsets(offsets)
+	}
+	return offsets, nil
+}
+
+func (c *Config) committedOffsets(offsets []int64) ([]int64, error) {
+	if len(offsets) == 0 {
+		return nil, nil
+	}
+	metadata, err := c.readMetaData()
+	if err != nil {
+		return nil, err
+	}
+	from := offsets[0]
+	for _, offset := range offsets {
+		if offset < from {
+			from = offset
+		}
+	}
+	v, err := c.visibility(metadata, from)
+	if err != nil {
+		return nil, err
+	}
+
+	var visible []int64
+	for _, offset := range offsets {
+		record, err := c.getFromClosedSegment(offset)
+		if err != nil {
+			return nil, err
+		}
+		if v.committed(record) {
+			visible = append(visible, offset)
+		}
+	}
+	return visible, nil
+}
+
+// writeKeyIndex saves the keys of a closed segment with the offsets of
+// their records, behind a Bloom filter over the keys. Like the .merkle
+// file it is only a cache. Stores that encrypt their records skip it so
+// keys are not written out in the clear.
+//
+// The layout is the filter's hash count and byte length as uint32s, the
+// filter, a uint32 key count, and then in key order a uvarint key length,
+// the key, a uvarint offset count and the uvarint distance of each offset
+// from the segment base.
+func (c *Config) writeKeyIndex(base int64) error {
+	if c.Keys != nil {
+		return nil
+	}
+
+	index := map[string][]int64{}
+	_, err := c.scanSegment(base, base, -1, func(record Record) error {
+		if record.Key != nil {
+			index[string(record.Key)] = append(index[string(record.Key)], record.Offset)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(index))
+	filter := NewBloomFilter(len(index), keyFilterFalsePositiveRate)
+	for key := range index {
+		keys = append(keys, key)
+		filter.Add([]byte(key))
+	}
+	sort.Strings(keys)
+
+	buff := new(bytes.Buffer)
+	scratch := make([]byte, binary.MaxVarintLen64)
+	putUvarint := func(v uint64) {
+		buff.Write(scratch[:binary.PutUvarint(scratch, v)])
+	}
+
+	binary.Write(buff, binary.LittleEndian, filter.Hashes)
+	binary.Write(buff, binary.LittleEndian, uint32(len(filter.Bits)))
+	buff.Write(filter.Bits)
+	binary.Write(buff, binary.LittleEndian, uint32(len(keys)))
+	for _, key := range keys {
+		putUvarint(uint64(len(key)))
+		buff.WriteString(key)
+		putUvarint(uint64(len(index[key])))
+		for _, offset := range index[key] {
+			putUvarint(uint64(offset - base))
+		}
+	}
+
+	return writeFile(c.fs(), keyIndexName(base), buff.Bytes())
+}
+
+// lookupKeyIndex returns the offsets of key in the closed segment at base,
+// reading no further than the filter when it excludes the key.
+func (c *Config) lookupKeyIndex(base int64, key []byte) ([]int64, error) {
+	data, err := readFile(c.fs(), keyIndexName(base))
+	if err != nil {
+		return nil, err
+	}
+
+	d := recordDecoder{data: data}
+	var filter BloomFilter
+	filter.Hashes = d.uint32()
+	filter.Bits = d.bytes(uint64(d.uint32()))
+	if d.err != nil || filter.Hashes == 0 || filter.Hashes > 64 {
+		return nil, corruptErr("key index filter is malformed")
+	}
+	if !filter.MayContain(key) {
+		return nil, nil
+	}
+
+	count := d.uint32()
+	for i := uint32(0); i < count && d.err == nil; i++ {
+		k := d.bytes(d.uvarint())
+		n := d.uvarint()
+		if n > uint64(len(d.data)) {
+			return nil, corruptErr("key index offset count out of range")
+		}
+
+		match := bytes.Equal(k, key)
+		var offsets []int64
+		for j := uint64(0); j < n && d.err == nil; j++ {
+			offset := base + int64(d.uvarint())
+			if match {
+				offsets = append(offsets, offset)
+			}
+		}
+		if match && d.err == nil {
+			return offsets, nil
+		}
+	}
+	if d.err != nil {
+		return nil, corruptErr("truncated key index")
+	}
+
+	return nil, nil
+}
+
+func (c *Config) removeKeyIndex(base int64) {
+	c.fs().Remove(keyIndexName(base))
+}
+
+func keyIndexName(base int64) string {
+	return fmt.Sprintf("%020d.keys", base)
+}
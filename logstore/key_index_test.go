@@ -0,0 +1,77 @@
+package logstore
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	filter := NewBloomFilter(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		filter.Add([]byte(fmt.Sprintf("key-%d", i)))
+	}
+
+	for i := 0; i < 1000; i++ {
+		if !filter.MayContain([]byte(fmt.Sprintf("key-%d", i))) {
+			t.Errorf("Expected filter to contain key-%d\n", i)
+		}
+	}
+
+	var falsePositives int
+	for i := 1000; i < 11000; i++ {
+		if filter.MayContain([]byte(fmt.Sprintf("key-%d", i))) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 300 {
+		t.Errorf("Expected about 100 false positives. Got %d\n", falsePositives)
+	}
+}
+
+func TestFindByKey(t *testing.T) {
+	eventQueue := make(chan Event, 1000)
+	store, _ := NewLogStore(eventQueue)
+	store.Run()
+
+	pchan := make(chan Event, 10)
+	expected := map[string][]int64{}
+	for i := int64(1); i <= 300; i++ {
+		key := fmt.Sprintf("key-%d", i%7)
+		record := Record{Key: []byte(key), Value: []byte("some payload")}
+		data, _ := record.MarshalBinary()
+		eventQueue <- Event{PutRecord, data, pchan, nil}
+		if err := (<-pchan).Error; err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		expected[key] = append(expected[key], i)
+	}
+	eventQueue <- Event{Terminate, nil, nil, nil}
+
+	if _, err := os.Stat(keyIndexName(1)); err != nil {
+		t.Errorf("Expected a key index for the first segment. %v\n", err)
+	}
+
+	// a missing index falls back to scanning the segment
+	bases, _ := Segments()
+	testConfig.removeKeyIndex(bases[1])
+
+	for key, offsets := range expected {
+		got, err := FindByKey([]byte(key))
+		if err != nil {
+			t.Errorf("%v\n", err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(offsets) {
+			t.Errorf("Expected offsets for %s:%v Got:%v\n", key, offsets, got)
+		}
+	}
+
+	got, err := FindByKey([]byte("missing"))
+	if err != nil || len(got) != 0 {
+		t.Errorf("Expected no offsets for a missing key. Got %v %v\n", got, err)
+	}
+
+	close(pchan)
+	close(eventQueue)
+	removeTestFiles()
+}
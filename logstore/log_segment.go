@@ -1,9 +1,11 @@
 package logstore
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"os"
+	"time"
 )
 
 type LogSegment struct {
@@ -11,30 +13,47 @@ type LogSegment struct {
 	NextOffset  int64
 	Name        string
 	MaxSize     int64
-	Log         *os.File
+	Log         File
 	Index       *Index
 	ReadOnly    bool
+	Codec       Codec
+	Keys        KeyProvider
+	HashChain   bool
+	LastHash    [sha256.Size]byte
+
+	LogAppendTime bool
+	Clock         Clock
+	Metrics       *Metrics
+	Observers     []Observer
+
+	fs FS
 }
 
 func NewLogSegment(offset int64, maxSize int64, readOnly bool) (*LogSegment, error) {
+	return newLogSegment(OSFS{}, offset, maxSize, readOnly)
+}
+
+func newLogSegment(fsys FS, offset int64, maxSize int64, readOnly bool) (*LogSegment, error) {
 	base := fmt.Sprintf("%020d", offset)
 	logName := fmt.Sprintf("%s.log", base)
 	indexName := fmt.Sprintf("%s.index", base)
 
-	var f *os.File
+	var f File
 	var err error
 	var index *Index
 
 	if readOnly {
-		f, err = os.OpenFile(logName, os.O_RDONLY, Perms)
-		index, err = NewIndex(indexName, int64(4096), true)
-
+		f, err = fsys.OpenFile(logName, os.O_RDONLY, Perms)
 	} else {
-		f, err = os.Create(logName)
-		index, err = NewIndex(indexName, int64(4096), false)
+		f, err = createFile(fsys, logName)
+	}
+	if err != nil {
+		return &LogSegment{}, err
 	}
 
+	index, err = newIndex(fsys, indexName, int64(4096), readOnly)
 	if err != nil {
+		f.Close()
 		return &LogSegment{}, err
 	}
 
@@ -46,10 +65,30 @@ func NewLogSegment(offset int64, maxSize int64, readOnly bool) (*LogSegment, err
 		Log:         f,
 		Index:       index,
 		ReadOnly:    readOnly,
+		fs:          fsys,
 	}, nil
 }
 
 func (seg *LogSegment) Append(data []byte) (int, error) {
+	return seg.AppendBatch([][]byte{data})
+}
+
+// AppendBatch writes values as a single batch of records without keys or
+// headers.
+func (seg *LogSegment) AppendBatch(values [][]byte) (int, error) {
+	records := make([]Record, len(values))
+	for i, value := range values {
+		records[i] = Record{Value: value}
+	}
+	return seg.AppendRecords(records)
+}
+
+// AppendRecords writes records as a single batch, compressed with the
+// segment's codec and encrypted with its keys if it has them. Each record
+// gets its own offset and index entry pointing at the batch. Records
+// without a timestamp, or every record in log append time mode, are
+// stamped with the current time. It returns the number of bytes written.
+func (seg *LogSegment) AppendRecords(records []Record) (int, error) {
 	if seg.ReadOnly {
 		return -1, NewLogStoreErr(
 			SegmentIsReadOnly,
@@ -57,6 +96,7 @@ func (seg *LogSegment) Append(data []byte) (int, error) {
 			nil,
 		)
 	}
+	start := time.Now()
 	size, err := seg.Size()
 	if err != nil {
 		return -1, NewLogStoreErr(
@@ -66,7 +106,19 @@ func (seg *LogSegment) Append(data []byte) (int, error) {
 		)
 	}
 
-	if int64(len(data))+size > seg.MaxSize {
+	now := millis(now(seg.Clock))
+	for i := range records {
+		if seg.LogAppendTime || records[i].Timestamp == 0 {
+			records[i].Timestamp = now
+		}
+	}
+
+	frame, err := encodeBatch(seg.NextOffset, records, seg.batchOptions())
+	if err != nil {
+		return -1, err
+	}
+
+	if int64(len(frame))+size > seg.MaxSize {
 		return -1, NewLogStoreErr(
 			SegmentLimitReached,
 			"max segment size limit reached",
@@ -74,9 +126,11 @@ func (seg *LogSegment) Append(data []byte) (int, error) {
 		)
 	}
 
+	indexSize := len(*seg.Index.Data)
 	position, _ := seg.Log.Seek(0, 1)
-	length, err := seg.Log.Write(data)
+	length, err := seg.Log.Write(frame)
 	if err != nil {
+		seg.rollback(position, seg.NextOffset, seg.Index.NextOffset, seg.LastHash)
 		return -1, NewLogStoreErr(
 			OSErr,
 			"write to disk failed",
@@ -84,39 +138,132 @@ func (seg *LogSegment) Append(data []byte) (int, error) {
 		)
 	}
 
-	entry := IndexEntry{
-		Offset:   seg.NextOffset,
-		Position: position,
-		Length:   int64(length),
+	nextOffset, indexNext, lastHash := seg.NextOffset, seg.Index.NextOffset, seg.LastHash
+	if seg.HashChain {
+		seg.LastHash = sha256.Sum256(frame)
 	}
 
-	// TODO: Handle index write failure
-	seg.Index.AddEntry(entry)
-	seg.NextOffset++
+	for range records {
+		entry := IndexEntry{
+			Offset:   seg.NextOffset,
+			Position: position,
+			Length:   int64(length),
+		}
 
+		if err := seg.Index.AddEntry(entry); err != nil {
+			seg.rollback(position, nextOffset, indexNext, lastHash)
+			return -1, NewLogStoreErr(
+				OSErr,
+				"write to index failed",
+				err,
+			)
+		}
+		seg.NextOffset++
+	}
+
+	if size := len(*seg.Index.Data); size != indexSize {
+		notify(seg.Observers, LifecycleEvent{Type: IndexResized, Segment: seg.StartOffset, Size: int64(size)})
+	}
+	seg.Metrics.appended(length, len(records), position+int64(length), time.Since(start))
 	return length, nil
 }
 
+// batchOptions returns how the segment encodes its batches.
+func (seg *LogSegment) batchOptions() batchOptions {
+	opts := batchOptions{
+		Codec:         seg.Codec,
+		Keys:          seg.Keys,
+		LogAppendTime: seg.LogAppendTime,
+	}
+	if seg.HashChain {
+		opts.PrevHash = &seg.LastHash
+	}
+	return opts
+}
+
+// frameSize returns the size records would take in the log written as
+// one batch.
+func (seg *LogSegment) frameSize(records []Record) (int64, error) {
+	frame, err := encodeBatch(seg.NextOffset, records, seg.batchOptions())
+	if err != nil {
+		return -1, err
+	}
+	return int64(len(frame)), nil
+}
+
+// rollback undoes a batch that was not written in full, cutting the log
+// back to position and forgetting the offsets and index entries it took.
+// A log that cannot be cut back is left for Repair to truncate.
+func (seg *LogSegment) rollback(position, nextOffset, indexNext int64, lastHash [sha256.Size]byte) {
+	seg.fs.Truncate(fmt.Sprintf("%s.log", seg.Name), position)
+	seg.Log.Seek(position, io.SeekStart)
+	seg.Index.truncate(indexNext)
+	seg.NextOffset = nextOffset
+	seg.LastHash = lastHash
+}
+
+// Get returns the value of the record at offset.
 func (seg *LogSegment) Get(offset int64) ([]byte, error) {
-	// TODO ensure offset is not greater that what this segment
-	// contains
-	index, err := seg.Index.GetEntry(offset)
+	record, err := seg.GetRecord(offset)
 	if err != nil {
 		return nil, err
 	}
+	return record.Value, nil
+}
+
+func (seg *LogSegment) GetRecord(offset int64) (Record, error) {
+	record, err := seg.getRecord(offset)
+	if isCorrupt(err) {
+		notify(seg.Observers, LifecycleEvent{
+			Type:    CorruptionDetected,
+			Segment: seg.StartOffset,
+			Offset:  offset,
+			Err:     err,
+		})
+	}
+	return record, err
+}
+
+func (seg *LogSegment) getRecord(offset int64) (Record, error) {
+	index, err := seg.Index.GetEntry(offset)
+	if err != nil {
+		return Record{}, err
+	}
+	if index.Length == 0 {
+		return Record{}, compactedErr(offset)
+	}
+
+	buff, err := seg.readFrame(index)
+	if err != nil {
+		return Record{}, err
+	}
+
+	return decodeRecord(buff, offset, seg.Keys)
+}
 
-	f, err := os.OpenFile(fmt.Sprintf("%s.log", seg.Name), os.O_RDONLY, 0655)
+// readFrame reads the framed batch an index entry points at, checking
+// the entry against the size of the log first.
+func (seg *LogSegment) readFrame(index IndexEntry) ([]byte, error) {
+	f, err := seg.fs.OpenFile(fmt.Sprintf("%s.log", seg.Name), os.O_RDONLY, 0655)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 
-	//TODO handle read errors
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := index.check(fi.Size()); err != nil {
+		return nil, err
+	}
+
 	buff := make([]byte, index.Length)
-	f.Seek(index.Position, io.SeekStart)
-	_, err = f.Read(buff)
+	if _, err := f.ReadAt(buff, index.Position); err != nil && err != io.EOF {
+		return nil, err
+	}
 
-	return buff, err
+	return buff, nil
 }
 
 func (seg *LogSegment) Size() (int64, error) {
@@ -128,6 +275,20 @@ func (seg *LogSegment) Size() (int64, error) {
 	return fi.Size(), nil
 }
 
+// Sync flushes the log and then the index, so a synced index entry never
+// points past the end of the synced log.
+func (seg *LogSegment) Sync() error {
+	start := time.Now()
+	if err := seg.Log.Sync(); err != nil {
+		return NewLogStoreErr(OSErr, "unable to sync log", err)
+	}
+	if err := seg.Index.Sync(); err != nil {
+		return NewLogStoreErr(OSErr, "unable to sync index", err)
+	}
+	seg.Metrics.synced(time.Since(start))
+	return nil
+}
+
 func (seg *LogSegment) Close() {
 	seg.Index.Close()
 	seg.Log.Close()
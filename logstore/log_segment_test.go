@@ -1,6 +1,7 @@
 package logstore
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -307,3 +308,112 @@ func TestLogSegment_Get_ReadOnly(t *testing.T) {
 
 	rosegment.Close()
 }
+
+func TestLogSegment_Append_Compressed(t *testing.T) {
+	message := TestMessage{
+		V1: "GOOG",
+		V2: 124,
+		V3: 59.0,
+		V4: "Note1 Note2 Note3 Note1 Note2 Note3 Note1 Note2 Note3",
+	}
+	data, _ := json.Marshal(message)
+
+	for _, codec := range []Codec{GzipCodec{}, DeflateCodec{}} {
+		batch := [][]byte{data, data, data, data, data, data, data, data}
+
+		segment, _ := NewLogSegment(1, 8*1024, false)
+		segment.Codec = codec
+		length, err := segment.AppendBatch(batch)
+		if err != nil {
+			t.Errorf("%v\n", err)
+		}
+
+		if length >= len(data)*len(batch) {
+			t.Errorf("Expected codec %d to compress %d bytes. Got %d\n", codec.ID(), len(data)*len(batch), length)
+		}
+
+		if segment.NextOffset != 9 {
+			t.Errorf("Expected next offset of:%d. Got:%d", 9, segment.NextOffset)
+		}
+
+		for offset := int64(1); offset <= 8; offset++ {
+			got, err := segment.Get(offset)
+			if err != nil {
+				t.Errorf("%v\n", err)
+			}
+
+			var m TestMessage
+			json.Unmarshal(got, &m)
+			if m != message {
+				t.Errorf("Expected offset %d to be %v. Got %v\n", offset, message, m)
+			}
+		}
+
+		segment.Close()
+		removeTestFiles()
+	}
+}
+
+func TestLogSegment_Append_CompressedSizeLimit(t *testing.T) {
+	data := bytes.Repeat([]byte("a"), 1024)
+
+	segment, _ := NewLogSegment(1, 512, false)
+	defer segment.Close()
+
+	if _, err := segment.Append(data); err == nil {
+		t.Errorf("Expected uncompressed record to exceed segment limit\n")
+	}
+
+	segment.Codec = GzipCodec{}
+	if _, err := segment.Append(data); err != nil {
+		t.Errorf("Expected compressed record to fit segment limit. Got %v\n", err)
+	}
+}
+
+func TestLogSegment_Get_Corrupt(t *testing.T) {
+	segment, _ := NewLogSegment(1, 8*1024, false)
+	defer segment.Close()
+
+	segment.Append([]byte("foo"))
+	segment.Log.WriteAt([]byte("x"), BatchHeaderWidth+1)
+
+	_, err := segment.Get(1)
+	if err == nil || err.(LogStoreErr).ErrType != CorruptRecord {
+		t.Errorf("Expected CorruptRecord error. Got %v\n", err)
+	}
+}
+
+func TestLogSegment_Append_IndexFailure(t *testing.T) {
+	fsys := NewFaultFS(NewMemFS())
+	segment, _ := newLogSegment(fsys, 1, 1024*1024, false)
+	defer segment.Close()
+	segment.HashChain = true
+
+	// fill the index so the next entry has to grow it
+	for i := 0; i < 4096/IndexItemWidth; i++ {
+		segment.Append([]byte("foo"))
+	}
+	size, _ := segment.Size()
+	next, lastHash := segment.NextOffset, segment.LastHash
+
+	fsys.Inject(fsys.Ops()+2, NoSpace)
+	if _, err := segment.Append([]byte("bar")); err == nil {
+		t.Fatalf("Expected the index write to fail\n")
+	}
+	if after, _ := segment.Size(); after != size {
+		t.Errorf("Expected the log cut back to %d bytes. Got %d\n", size, after)
+	}
+	if segment.NextOffset != next || segment.LastHash != lastHash {
+		t.Errorf("Expected offset %d and the last hash restored. Got %d\n", next, segment.NextOffset)
+	}
+
+	if _, err := segment.Append([]byte("baz")); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if value, err := segment.Get(next); err != nil || string(value) != "baz" {
+		t.Errorf("Expected baz at offset %d. Got %q %v\n", next, value, err)
+	}
+	if entries, _ := segment.Index.Entries(); len(entries) != int(next) {
+		t.Errorf("Expected %d index entries. Got %d\n", next, len(entries))
+	}
+}
@@ -3,43 +3,186 @@ package logstore
 import (
 	"encoding/binary"
 	"encoding/json"
-	"io/ioutil"
+	"fmt"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const metafile = "logstore.meta"
 const segmentSize = 4096
 
+// MetaData is the store state persisted to the metadata file. Producer
+// state and open transactions, which map to the offset the transaction
+// began at, are keyed by producer ID. Aborted holds the aborted
+// transactions whose markers are in the active segment; those in closed
+// segments are recorded alongside the segments.
 type MetaData struct {
-	NextOffset int64
+	NextOffset     int64
+	NextProducerID int64                   `json:",omitempty"`
+	Producers      map[int64]ProducerState `json:",omitempty"`
+	Transactions   map[int64]int64         `json:",omitempty"`
+	Aborted        []AbortedTransaction    `json:",omitempty"`
 }
 
 type LogStore struct {
+	Config
 	CurrentSegment *LogSegment
 	EventQueue     <-chan Event
 	MetaData       MetaData
+
+	// metadata writes are numbered on the event loop and a write that
+	// lands after a later one is dropped, so the file never goes back
+	metaMu      sync.Mutex
+	metaQueued  int64
+	metaWritten int64
 }
 
-func NewLogStore(queue <-chan Event) (*LogStore, error) {
-	metadata, err := readMetaDatafile()
+func NewLogStore(queue <-chan Event, opts ...Option) (*LogStore, error) {
+	store := &LogStore{
+		Config:     newConfig(opts),
+		EventQueue: queue,
+	}
+
+	metadata, err := store.readMetaData()
+	if err != nil {
+		return nil, err
+	}
+	store.MetaData = metadata
+
+	bases, err := store.segments()
 	if err != nil {
 		return nil, err
 	}
+	for _, base := range bases {
+		if err := store.finishCompaction(base); err != nil {
+			return nil, err
+		}
+	}
+	if err := store.replay(); err != nil {
+		return nil, err
+	}
+
+	// the last segment may have been left unsynced by a crash or shutdown,
+	// and must reach disk before anything appended after it
+	if len(bases) > 0 {
+		if err := store.syncSegment(bases[len(bases)-1]); err != nil {
+			return nil, err
+		}
+	}
 
-	segment, err := NewLogSegment(metadata.NextOffset, segmentSize, false)
+	segment, err := store.openSegment(metadata.NextOffset, segmentSize, false)
 	if err != nil {
 		return nil, err
 	}
+	store.CurrentSegment = segment
+
+	if store.Metrics != nil {
+		size, _ := segment.Size()
+		count := len(bases)
+		if count == 0 || bases[count-1] != segment.StartOffset {
+			count++
+		}
+		store.Metrics.opened(count, size)
+	}
+
+	if store.HashChain {
+		if segment.LastHash, err = store.hashBefore(metadata.NextOffset); err != nil {
+			segment.Close()
+			return nil, err
+		}
+	}
+	store.offload()
 
-	return &LogStore{
-		CurrentSegment: segment,
-		EventQueue:     queue,
-		MetaData:       metadata,
-	}, nil
+	return store, nil
+}
+
+// replay reads the log below the metadata's next offset back, batch by
+// batch, to rebuild the producer state and aborted transactions the
+// metadata may have lost. Every segment it reads is closed once the store
+// opens, so their aborted transactions are recorded with them. Batches that
+// cannot be read are skipped.
+func (store *LogStore) replay() error {
+	bases, err := store.allSegments()
+	if err != nil {
+		return err
+	}
+
+	m := &store.MetaData
+	aborts := newAbortReplay()
+	var replayed []int64
+	for _, base := range bases {
+		if base >= m.NextOffset {
+			break
+		}
+		segment, err := store.openClosedSegment(base)
+		if err != nil {
+			return err
+		}
+		entries, err := segment.Index.Entries()
+		if err != nil {
+			segment.Close()
+			return err
+		}
+
+		for i, entry := range entries {
+			if entry.Offset >= m.NextOffset {
+				break
+			}
+			if entry.Length == 0 || (i > 0 && sameBatch(entry, entries[i-1])) {
+				continue
+			}
+
+			frame, err := segment.readFrame(entry)
+			if err != nil {
+				segment.Close()
+				return err
+			}
+			_, records, err := decodeBatch(frame, store.Keys)
+			if _, ok := err.(LogStoreErr); ok {
+				continue
+			}
+			if err != nil {
+				segment.Close()
+				return err
+			}
+
+			m.replayProducer(records)
+			aborts.replay(base, records)
+		}
+		segment.Close()
+		replayed = append(replayed, base)
+	}
+
+	for _, base := range replayed {
+		if err := store.writeAborted(base, aborts.aborted[base]); err != nil {
+			return err
+		}
+	}
+	m.Aborted = nil
+	return nil
+}
+
+// syncSegment flushes the log and index files of the segment at base.
+func (c *Config) syncSegment(base int64) error {
+	start := time.Now()
+	for _, ext := range []string{"log", "index"} {
+		f, err := c.fs().OpenFile(fmt.Sprintf("%020d.%s", base, ext), os.O_RDWR, 0)
+		if err != nil {
+			return NewLogStoreErr(OSErr, "unable to open segment for sync", err)
+		}
+		err = f.Sync()
+		f.Close()
+		if err != nil {
+			return NewLogStoreErr(OSErr, "unable to sync segment", err)
+		}
+	}
+	c.Metrics.synced(time.Since(start))
+	return nil
 }
 
 func (store *LogStore) Run() {
@@ -49,19 +192,107 @@ func (store *LogStore) Run() {
 func (store *LogStore) runLoop() {
 	for {
 		event := <-store.EventQueue
+		start := time.Now()
+		respond := func(response Event) {
+			store.Metrics.handled(event.Type, len(store.EventQueue), time.Since(start), response.Error)
+			event.ResponseChan <- response
+		}
+
 		switch {
 
 		case event.Type == Put:
-			err := store.append(event.Data)
-			event.ResponseChan <- Event{Response, nil, nil, err}
+			offset, err := store.append(Record{Value: event.Data})
+			respond(Event{Response, varint(offset), nil, err})
+
+		case event.Type == PutRecord:
+			var record Record
+			offset := int64(-1)
+			err := record.UnmarshalBinary(event.Data)
+			if err == nil && record.Control != 0 {
+				err = transactionErr("control records are written by the store")
+			}
+			if err == nil {
+				offset, err = store.append(record)
+			}
+			respond(Event{Response, varint(offset), nil, err})
+
+		case event.Type == PutRecords:
+			offset := int64(-1)
+			records, err := UnmarshalRecords(event.Data)
+			for _, record := range records {
+				if err == nil && record.Control != 0 {
+					err = transactionErr("control records are written by the store")
+				}
+			}
+			if err == nil {
+				offset, err = store.appendBatch(records)
+			}
+			respond(Event{Response, varint(offset), nil, err})
+
+		case event.Type == InitProducer:
+			// the ID is on disk before anyone uses it, so it is never
+			// issued twice
+			store.MetaData.NextProducerID++
+			id := store.MetaData.NextProducerID
+			err := store.flush()
+			if err != nil {
+				store.MetaData.NextProducerID--
+				id = -1
+			}
+			respond(Event{Response, varint(id), nil, err})
+
+		case event.Type == BeginTransaction:
+			producer, _ := binary.Varint(event.Data)
+			err := store.beginTransaction(producer)
+			respond(Event{Response, nil, nil, err})
+
+		case event.Type == CommitTransaction || event.Type == AbortTransaction:
+			marker := CommitMarker
+			if event.Type == AbortTransaction {
+				marker = AbortMarker
+			}
+			producer, _ := binary.Varint(event.Data)
+			offset, err := store.endTransaction(producer, marker)
+			respond(Event{Response, varint(offset), nil, err})
 
 		case event.Type == Get:
 			offset, _ := binary.Varint(event.Data)
-			data, err := store.get(int64(offset))
-			event.ResponseChan <- Event{Response, data, nil, err}
+			record, err := store.get(int64(offset))
+			respond(Event{Response, record.Value, nil, err})
+
+		case event.Type == GetRecord:
+			offset, _ := binary.Varint(event.Data)
+			record, err := store.get(int64(offset))
+			var data []byte
+			if err == nil {
+				data, err = record.MarshalBinary()
+			}
+			respond(Event{Response, data, nil, err})
 
 		case event.Type == FlushMetaData:
-			go writeMetaData(store.MetaData)
+			// callers that need the metadata on disk before moving on
+			// pass a response channel and get a synchronous write that
+			// also makes every record appended so far durable
+			if event.ResponseChan != nil {
+				err := store.flush()
+				respond(Event{Response, nil, nil, err})
+			} else {
+				version, metadata := store.nextMetaVersion(), store.MetaData.copy()
+				store.goAsync(func() {
+					store.persistMetaData(version, func() error {
+						if err := store.writeMetaData(metadata); err != nil {
+							return err
+						}
+						notify(store.Observers, LifecycleEvent{Type: MetaDataFlushed, Offset: metadata.NextOffset})
+						return nil
+					})
+				})
+				store.Metrics.handled(event.Type, len(store.EventQueue), time.Since(start), nil)
+			}
+
+		case event.Type == Snapshot:
+			err := store.snapshot(string(event.Data))
+			respond(Event{Response, nil, nil, err})
 
 		case event.Type == Terminate:
 			store.CurrentSegment.Close()
@@ -72,86 +303,512 @@ func (store *LogStore) runLoop() {
 	}
 }
 
-func (store *LogStore) append(data []byte) error {
-	_, err := store.CurrentSegment.Append(data)
-	if err != nil {
-		if err.(LogStoreErr).ErrType == SegmentLimitReached {
-			store.CurrentSegment.Close()
+// append writes record and returns its offset. A retry of a record from
+// an idempotent producer returns the offset it was first written at.
+func (store *LogStore) append(record Record) (int64, error) {
+	return store.appendBatch([]Record{record})
+}
 
-			segment, err := NewLogSegment(store.CurrentSegment.NextOffset, segmentSize, false)
-			if err != nil {
-				return err
-			}
-			store.CurrentSegment = segment
+// appendBatch writes records at consecutive offsets and returns the first.
+// Records from an idempotent producer must all come from it with
+// consecutive sequence numbers, and a retry of the whole batch returns the
+// offset it was first written at.
+func (store *LogStore) appendBatch(records []Record) (int64, error) {
+	if len(records) == 0 {
+		return store.CurrentSegment.NextOffset, nil
+	}
 
-			_, err = store.CurrentSegment.Append(data)
-			if err != nil {
-				return err
-			} else {
-				store.MetaData.NextOffset = store.CurrentSegment.NextOffset
-				return nil
+	first := records[0]
+	for i, record := range records {
+		if record.Transactional && record.Control == 0 {
+			if _, ok := store.MetaData.Transactions[record.ProducerID]; !ok {
+				return -1, transactionErr(
+					fmt.Sprintf("producer %d has no open transaction", record.ProducerID),
+				)
 			}
-		} else {
-			return err
 		}
+		if record.ProducerID != first.ProducerID ||
+			(first.ProducerID != 0 && record.Sequence != first.Sequence+int64(i)) {
+			return -1, NewLogStoreErr(
+				OutOfOrderSequence,
+				"a batch must hold consecutive sequence numbers from one producer",
+				nil,
+			)
+		}
+	}
+
+	if first.ProducerID != 0 && first.Control == 0 {
+		offset, err := store.MetaData.checkSequence(records)
+		if err != nil || offset != -1 {
+			return offset, err
+		}
+	}
+
+	offset := store.CurrentSegment.NextOffset
+	if err := store.write(records); err != nil {
+		return -1, err
 	}
+
 	store.MetaData.NextOffset = store.CurrentSegment.NextOffset
+	if first.ProducerID != 0 && first.Control == 0 {
+		store.MetaData.recordSequence(records, offset)
+	}
+	return offset, nil
+}
+
+// write appends records to the current segment as one batch, rolling
+// first when it is full. A batch too big for an empty segment is split in
+// two, but only once every record is known to fit on its own, so a batch
+// that can never be written leaves nothing behind.
+func (store *LogStore) write(records []Record) error {
+	_, err := store.CurrentSegment.AppendRecords(records)
+	if lsErr, ok := err.(LogStoreErr); !ok || lsErr.ErrType != SegmentLimitReached {
+		return err
+	}
+
+	if store.CurrentSegment.NextOffset > store.CurrentSegment.StartOffset {
+		if err := store.roll(store.CurrentSegment.NextOffset); err != nil {
+			return err
+		}
+		_, err = store.CurrentSegment.AppendRecords(records)
+		if lsErr, ok := err.(LogStoreErr); !ok || lsErr.ErrType != SegmentLimitReached {
+			return err
+		}
+	}
+
+	if len(records) == 1 {
+		return err
+	}
+	for i := range records {
+		size, sizeErr := store.CurrentSegment.frameSize(records[i : i+1])
+		if sizeErr != nil {
+			return sizeErr
+		}
+		if size > store.CurrentSegment.MaxSize {
+			return err
+		}
+	}
+	half := len(records) / 2
+	if err := store.write(records[:half]); err != nil {
+		return err
+	}
+	return store.write(records[half:])
+}
+
+func varint(v int64) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+	return b[:binary.PutVarint(b, v)]
+}
+
+// roll closes the current segment and starts a new one at offset. The
+// closed segment is synced first so a crash can never leave a later
+// segment on disk without the records before it.
+func (store *LogStore) roll(offset int64) error {
+	start := time.Now()
+	if err := store.CurrentSegment.Sync(); err != nil {
+		return err
+	}
+	size, _ := store.CurrentSegment.Size()
+	store.CurrentSegment.Close()
+
+	// the tree and key index are caches that readers rebuild or scan
+	// around when missing, so a failed write must not hold up the roll
+	store.writeMerkleTree(store.CurrentSegment.StartOffset)
+	store.writeKeyIndex(store.CurrentSegment.StartOffset)
+	if err := store.writeSegmentManifest(store.CurrentSegment.StartOffset); err != nil {
+		return err
+	}
+
+	// the aborted transactions ending in the closed segment move out of
+	// the metadata, so it only grows with the active segment
+	var aborted, kept []AbortedTransaction
+	for _, a := range store.MetaData.Aborted {
+		if a.LastOffset < offset {
+			aborted = append(aborted, a)
+		} else {
+			kept = append(kept, a)
+		}
+	}
+	if err := store.writeAborted(store.CurrentSegment.StartOffset, aborted); err != nil {
+		return err
+	}
+	store.MetaData.Aborted = kept
+
+	segment, err := store.openSegment(offset, segmentSize, false)
+	if err != nil {
+		return err
+	}
+	closed := store.CurrentSegment.StartOffset
+	segment.LastHash = store.CurrentSegment.LastHash
+	store.CurrentSegment = segment
+	store.Metrics.rolled(time.Since(start))
+	notify(store.Observers, LifecycleEvent{Type: SegmentRolled, Segment: closed, Offset: offset, Size: size})
+	store.offload()
+
 	return nil
 }
 
-func (store *LogStore) get(offset int64) ([]byte, error) {
+func (store *LogStore) get(offset int64) (Record, error) {
+	start := time.Now()
+	defer func() { store.Metrics.read(time.Since(start)) }()
+
+	var record Record
+	var err error
 	if offset < store.CurrentSegment.StartOffset {
-		return getFromClosedSegment(offset)
+		record, err = store.getFromClosedSegment(offset)
+	} else {
+		record, err = store.CurrentSegment.GetRecord(offset)
+	}
+
+	if err == nil && store.Isolation == ReadCommitted {
+		var v visibility
+		if v, err = store.visibility(store.MetaData, offset); err != nil {
+			return Record{}, err
+		}
+		if !v.committed(record) {
+			return Record{}, NewLogStoreErr(
+				NotCommitted,
+				fmt.Sprintf("offset %d is not committed", offset),
+				nil,
+			)
+		}
+	}
+	if err == nil && record.Expired(now(store.Clock)) {
+		return Record{}, NewLogStoreErr(
+			RecordExpired,
+			fmt.Sprintf("offset %d has expired", offset),
+			nil,
+		)
+	}
+	return record, err
+}
+
+func (c *Config) getFromClosedSegment(offset int64) (Record, error) {
+	base, err := c.findSegment(offset)
+	if err != nil {
+		return Record{}, err
+	}
+
+	segment, err := c.openClosedSegment(base)
+	if err != nil {
+		return Record{}, err
 	}
-	return store.CurrentSegment.Get(offset)
+	result, err := segment.GetRecord(offset)
+	segment.Close()
+	return result, err
+}
+
+// Segments returns the base offsets of the segments in the working
+// directory, and any offloaded to remote storage, in ascending order.
+func Segments(opts ...Option) ([]int64, error) {
+	c := newConfig(opts)
+	return c.allSegments()
 }
 
-func getFromClosedSegment(offset int64) ([]byte, error) {
-	files, _ := filepath.Glob("*.index")
-	var values []int
+func (c *Config) segments() ([]int64, error) {
+	files, err := c.fs().Glob("*.index")
+	if err != nil {
+		return nil, err
+	}
+
+	var values []int64
 	for _, file := range files {
 		n := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
-		v, _ := strconv.ParseInt(n, 10, 32)
-		values = append(values, int(v))
+		v, err := strconv.ParseInt(n, 10, 64)
+		if err != nil {
+			continue
+		}
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	return values, nil
+}
+
+// FindSegment returns the base offset of the segment holding offset.
+func FindSegment(offset int64, opts ...Option) (int64, error) {
+	c := newConfig(opts)
+	return c.findSegment(offset)
+}
+
+// OpenSegment opens the segment at base read only, fetching it from remote
+// storage if it has been offloaded.
+func OpenSegment(base int64, opts ...Option) (*LogSegment, error) {
+	c := newConfig(opts)
+	return c.openClosedSegment(base)
+}
+
+func (c *Config) findSegment(offset int64) (int64, error) {
+	values, err := c.allSegments()
+	if err != nil {
+		return -1, err
+	}
+
+	for idx := len(values) - 1; idx >= 0; idx-- {
+		if values[idx] <= offset {
+			return values[idx], nil
+		}
+	}
+
+	return -1, NewLogStoreErr(
+		OffsetNotFound,
+		fmt.Sprintf("no segment holds offset %d", offset),
+		nil,
+	)
+}
+
+// Scan hands the value of every record in [from, to) to fn in offset
+// order, reading segments from the working directory. A negative to scans
+// through the end of the log. It returns the offset following the last
+// record scanned. Expired records are skipped. Read committed scans use
+// the flushed metadata, also skipping what it does not show as committed
+// and stopping at its last stable offset.
+//
+// A store may be halfway through appending to the active segment, so
+// readers running alongside it should stop at the NextOffset of the
+// flushed metadata, which is only written once the records below it are.
+func Scan(from, to int64, fn func(offset int64, data []byte) error, opts ...Option) (int64, error) {
+	c := newConfig(opts)
+	return c.scan(from, to, func(record Record) error {
+		return fn(record.Offset, record.Value)
+	})
+}
+
+// ScanRecords is Scan for whole records.
+func ScanRecords(from, to int64, fn func(Record) error, opts ...Option) (int64, error) {
+	c := newConfig(opts)
+	return c.scan(from, to, fn)
+}
+
+// OffsetForTime returns the first offset whose record has a timestamp at
+// or after ts, in milliseconds since the epoch, or the end of the log when
+// no record does. Segments whose last record is older are skipped.
+func OffsetForTime(ts int64, opts ...Option) (int64, error) {
+	c := newConfig(opts)
+
+	bases, err := c.allSegments()
+	if err != nil {
+		return -1, err
+	}
+
+	end := int64(1)
+	for _, base := range bases {
+		segment, err := c.openClosedSegment(base)
+		if err != nil {
+			return -1, err
+		}
+		entries, err := segment.Index.Entries()
+		if err != nil {
+			segment.Close()
+			return -1, err
+		}
+		entries = liveEntries(entries)
+		if len(entries) == 0 {
+			segment.Close()
+			continue
+		}
+
+		last, err := segment.GetRecord(entries[len(entries)-1].Offset)
+		if err != nil {
+			segment.Close()
+			return -1, err
+		}
+		end = last.Offset + 1
+		if last.Timestamp < ts {
+			segment.Close()
+			continue
+		}
+
+		for _, entry := range entries {
+			record, err := segment.GetRecord(entry.Offset)
+			if err != nil {
+				segment.Close()
+				return -1, err
+			}
+			if record.Timestamp >= ts {
+				segment.Close()
+				return record.Offset, nil
+			}
+		}
+		segment.Close()
 	}
-	sort.Ints(values)
 
-	var myoffset int
-	for idx, value := range values {
-		if int64(value) > offset {
-			myoffset = values[idx-1]
+	return end, nil
+}
+
+func (c *Config) scan(from, to int64, fn func(Record) error) (int64, error) {
+	bases, err := c.allSegments()
+	if err != nil {
+		return from, err
+	}
+
+	unexpired := fn
+	fn = func(record Record) error {
+		if record.Expired(now(c.Clock)) {
+			return nil
+		}
+		return unexpired(record)
+	}
+
+	if c.Isolation == ReadCommitted {
+		metadata, err := c.readMetaData()
+		if err != nil {
+			return from, err
+		}
+		v, err := c.visibility(metadata, from)
+		if err != nil {
+			return from, err
+		}
+		if to < 0 || v.lso < to {
+			to = v.lso
+		}
+
+		visible := fn
+		fn = func(record Record) error {
+			if !v.committed(record) {
+				return nil
+			}
+			return visible(record)
+		}
+	}
+
+	next := from
+	for i, base := range bases {
+		if i+1 < len(bases) && bases[i+1] <= next {
+			continue
+		}
+		if to >= 0 && base >= to {
 			break
 		}
+
+		next, err = c.scanSegment(base, next, to, fn)
+		if err != nil {
+			return next, err
+		}
 	}
 
-	segment, _ := NewLogSegment(int64(myoffset), -1, true)
-	result, err := segment.Get(offset)
-	segment.Close()
-	return result, err
+	return next, nil
+}
+
+// scanFlushed is scan stopping at the end of the log as the flushed
+// metadata records it, for readers of a directory a store is appending to.
+func (c *Config) scanFlushed(from, to int64, fn func(Record) error) (int64, error) {
+	metadata, err := c.readMetaData()
+	if err != nil {
+		return from, err
+	}
+	if to < 0 || metadata.NextOffset < to {
+		to = metadata.NextOffset
+	}
+	if to < from {
+		return from, nil
+	}
+	return c.scan(from, to, fn)
+}
+
+func (c *Config) scanSegment(base, next, to int64, fn func(Record) error) (int64, error) {
+	segment, err := c.openClosedSegment(base)
+	if err != nil {
+		return next, err
+	}
+	defer segment.Close()
+
+	entries, err := segment.Index.entriesBefore(base, to)
+	if err != nil {
+		return next, err
+	}
+
+	for _, entry := range entries {
+		if entry.Offset < next {
+			continue
+		}
+		if to >= 0 && entry.Offset >= to {
+			break
+		}
+		if entry.Length == 0 {
+			next = entry.Offset + 1
+			continue
+		}
+
+		record, err := segment.GetRecord(entry.Offset)
+		if err != nil {
+			return next, err
+		}
+		if err := fn(record); err != nil {
+			return next, err
+		}
+		next = entry.Offset + 1
+	}
 
+	return next, nil
 }
 
-func readMetaDatafile() (MetaData, error) {
-	_, err := os.Stat(metafile)
+// ReadMetaData loads the metadata file from the working directory.
+func ReadMetaData(opts ...Option) (MetaData, error) {
+	c := newConfig(opts)
+	return c.readMetaData()
+}
+
+func (c *Config) readMetaData() (MetaData, error) {
+	_, err := c.fs().Stat(metafile)
 	if os.IsNotExist(err) {
-		return MetaData{1}, nil
+		return MetaData{NextOffset: 1}, nil
 	}
 
 	if err != nil {
-		return MetaData{-1}, err
+		return MetaData{NextOffset: -1}, err
 	}
 
-	bytes, err := ioutil.ReadFile(metafile)
+	bytes, err := readFile(c.fs(), metafile)
 	if err != nil {
-		return MetaData{-1}, err
+		return MetaData{NextOffset: -1}, err
 	}
 
 	var m MetaData
-	json.Unmarshal(bytes, &m)
+	if err := json.Unmarshal(bytes, &m); err != nil {
+		return MetaData{NextOffset: -1}, NewLogStoreErr(
+			CorruptMetaData,
+			"metadata is not valid JSON",
+			err,
+		)
+	}
 	return m, nil
 }
 
-func writeMetaData(m MetaData) {
-	data, _ := json.Marshal(m)
-	ioutil.WriteFile(metafile, data, 0644)
+// writeMetaData replaces the metadata file atomically, so readers running
+// alongside the store never see half of it.
+func (c *Config) writeMetaData(m MetaData) error {
+	return writeJSONSync(c.fs(), metafile, m)
+}
+
+// flush syncs the active segment and then replaces the metadata file
+// atomically, so the metadata on disk never runs ahead of the log.
+func (store *LogStore) flush() error {
+	return store.persistMetaData(store.nextMetaVersion(), func() error {
+		if err := store.CurrentSegment.Sync(); err != nil {
+			return err
+		}
+		if err := store.writeMetaData(store.MetaData); err != nil {
+			return err
+		}
+		notify(store.Observers, LifecycleEvent{Type: MetaDataFlushed, Offset: store.MetaData.NextOffset})
+		return nil
+	})
+}
+
+func (store *LogStore) nextMetaVersion() int64 {
+	store.metaQueued++
+	return store.metaQueued
+}
+
+// persistMetaData runs write unless a later version has been written.
+func (store *LogStore) persistMetaData(version int64, write func() error) error {
+	store.metaMu.Lock()
+	defer store.metaMu.Unlock()
+
+	if version < store.metaWritten {
+		return nil
+	}
+	store.metaWritten = version
+	return write()
 }
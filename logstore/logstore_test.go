@@ -1,6 +1,7 @@
 package logstore
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
@@ -114,11 +115,12 @@ func TestLogStore_Put_Event_NextSegement(t *testing.T) {
 		)
 	}
 
-	if store.CurrentSegment.Name != fmt.Sprintf("%020d", 946) {
+	// 61 framed records of 67 bytes fit in each 4096 byte segment
+	if store.CurrentSegment.Name != fmt.Sprintf("%020d", 977) {
 		t.Errorf(
 			"Expected next segment to be %s. Got %s\n",
 			store.CurrentSegment.Name,
-			fmt.Sprintf("%020d", 946),
+			fmt.Sprintf("%020d", 977),
 		)
 	}
 
@@ -268,6 +270,16 @@ func TestLogStore_MetaDataUpdate(t *testing.T) {
 	removeTestFiles()
 }
 
+func TestReadMetaData_Corrupt(t *testing.T) {
+	fsys := NewMemFS()
+	writeFile(fsys, metafile, []byte(`{"NextOffset":`))
+
+	_, err := ReadMetaData(WithFS(fsys))
+	if err == nil || err.(LogStoreErr).ErrType != CorruptMetaData {
+		t.Errorf("Expected CorruptMetaData error. Got %v\n", err)
+	}
+}
+
 func TestLogStore_BootFromMetaData(t *testing.T) {
 	eventQueue := make(chan Event, 1000)
 	store, _ := NewLogStore(eventQueue)
@@ -305,3 +317,296 @@ func TestLogStore_BootFromMetaData(t *testing.T) {
 	close(eventQueue)
 	removeTestFiles()
 }
+
+func TestLogStore_FindSegment(t *testing.T) {
+	eventQueue := make(chan Event, 1000)
+	store, _ := NewLogStore(eventQueue)
+	store.Run()
+
+	pchan := make(chan Event, 500)
+
+	for i := 1; i <= 500; i++ {
+		message := TestMessage{
+			"foo",
+			i,
+			23.0,
+			"bar",
+		}
+		data, _ := json.Marshal(message)
+		eventQueue <- Event{Put, data, pchan, nil}
+	}
+
+	for i := 1; i <= 500; i++ {
+		<-pchan
+	}
+
+	eventQueue <- Event{Terminate, nil, nil, nil}
+
+	segments, err := Segments()
+	if err != nil {
+		t.Errorf("%v\n", err)
+	}
+	if len(segments) < 2 || segments[0] != 1 {
+		t.Errorf("Expected multiple segments starting at 1. Got %v\n", segments)
+	}
+
+	base, err := FindSegment(int64(356))
+	if err != nil {
+		t.Errorf("%v\n", err)
+	}
+	var expected int64
+	for _, s := range segments {
+		if s <= 356 {
+			expected = s
+		}
+	}
+	if base != expected {
+		t.Errorf("Expected segment %d to hold offset %d. Got %d\n", expected, 356, base)
+	}
+
+	_, err = FindSegment(int64(0))
+	if err == nil || err.(LogStoreErr).ErrType != OffsetNotFound {
+		t.Errorf("Expected OffsetNotFound error. Got %v\n", err)
+	}
+
+	close(pchan)
+	close(eventQueue)
+	removeTestFiles()
+}
+
+func TestLogStore_FlushMetaData_Sync(t *testing.T) {
+	eventQueue := make(chan Event, 1000)
+	store, _ := NewLogStore(eventQueue)
+	store.Run()
+
+	pchan := make(chan Event, 10)
+	for i := 1; i <= 10; i++ {
+		eventQueue <- Event{Put, []byte("foo"), pchan, nil}
+		<-pchan
+	}
+
+	eventQueue <- Event{FlushMetaData, nil, pchan, nil}
+	response := <-pchan
+	if response.Error != nil {
+		t.Errorf("%v\n", response.Error)
+	}
+
+	metadata, _ := ReadMetaData()
+	if metadata.NextOffset != 11 {
+		t.Errorf("Expected next offset to be %d. Got %d\n", 11, metadata.NextOffset)
+	}
+
+	eventQueue <- Event{Terminate, nil, nil, nil}
+	close(pchan)
+	close(eventQueue)
+	removeTestFiles()
+}
+
+func TestLogStore_Get_Compressed(t *testing.T) {
+	eventQueue := make(chan Event, 1000)
+	store, _ := NewLogStore(eventQueue, WithCodec(GzipCodec{}))
+	store.Run()
+
+	pchan := make(chan Event, 500)
+	for i := 1; i <= 500; i++ {
+		data, _ := json.Marshal(TestMessage{"foo", i, 23.0, "bar"})
+		eventQueue <- Event{Put, data, pchan, nil}
+	}
+	for i := 1; i <= 500; i++ {
+		<-pchan
+	}
+
+	gchan := make(chan Event)
+	b := make([]byte, 8)
+	binary.PutVarint(b, 42)
+	eventQueue <- Event{Get, b, gchan, nil}
+
+	response := <-gchan
+	if response.Error != nil {
+		t.Errorf("%v\n", response.Error)
+	} else {
+		var data TestMessage
+		json.Unmarshal(response.Data, &data)
+		expected := TestMessage{"foo", 42, 23.0, "bar"}
+		if data != expected {
+			t.Errorf("Expected response to be %v. Got %v\n", expected, data)
+		}
+	}
+
+	eventQueue <- Event{Terminate, nil, nil, nil}
+	close(pchan)
+	close(gchan)
+	close(eventQueue)
+	removeTestFiles()
+}
+
+func putRecords(eventQueue chan Event, pchan chan Event, records []Record) (int64, error) {
+	data, _ := MarshalRecords(records)
+	eventQueue <- Event{PutRecords, data, pchan, nil}
+	response := <-pchan
+	offset, _ := binary.Varint(response.Data)
+	return offset, response.Error
+}
+
+func logBytes(fsys FS) int64 {
+	bases, _ := Segments(WithFS(fsys))
+	var size int64
+	for _, base := range bases {
+		fi, _ := fsys.Stat(fmt.Sprintf("%020d.log", base))
+		size += fi.Size()
+	}
+	return size
+}
+
+func TestLogStore_PutRecords(t *testing.T) {
+	sizes := map[string]int64{}
+	for name, codec := range map[string]Codec{"none": nil, "gzip": GzipCodec{}} {
+		fsys := NewMemFS()
+		eventQueue := make(chan Event, 10)
+		store, _ := NewLogStore(eventQueue, WithFS(fsys), WithCodec(codec))
+		store.Run()
+
+		pchan := make(chan Event, 1)
+		for batch := int64(0); batch < 2; batch++ {
+			var records []Record
+			for i := 1; i <= 100; i++ {
+				data, _ := json.Marshal(TestMessage{"foo", int(batch)*100 + i, 23.0, "bar"})
+				records = append(records, Record{Value: data})
+			}
+			offset, err := putRecords(eventQueue, pchan, records)
+			if err != nil || offset != batch*100+1 {
+				t.Errorf("Expected batch at %d. Got %d %v\n", batch*100+1, offset, err)
+			}
+		}
+
+		eventQueue <- Event{Get, varint(142), pchan, nil}
+		response := <-pchan
+		var m TestMessage
+		json.Unmarshal(response.Data, &m)
+		if expected := (TestMessage{"foo", 142, 23.0, "bar"}); m != expected {
+			t.Errorf("Expected %v. Got %v %v\n", expected, m, response.Error)
+		}
+		eventQueue <- Event{Terminate, nil, nil, nil}
+		sizes[name] = logBytes(fsys)
+	}
+
+	if sizes["gzip"] >= sizes["none"]/2 {
+		t.Errorf("Expected gzip batches to be well under half the size. Got %v\n", sizes)
+	}
+}
+
+func TestLogStore_PutRecords_SplitAcrossSegments(t *testing.T) {
+	fsys := NewMemFS()
+	eventQueue := make(chan Event, 10)
+	store, _ := NewLogStore(eventQueue, WithFS(fsys))
+	store.Run()
+
+	pchan := make(chan Event, 1)
+	putValues(t, eventQueue, 1, 10)
+	var records []Record
+	for i := 11; i <= 500; i++ {
+		records = append(records, Record{Value: []byte(fmt.Sprintf("value-%d", i))})
+	}
+	offset, err := putRecords(eventQueue, pchan, records)
+	if err != nil || offset != 11 {
+		t.Errorf("Expected batch at 11. Got %d %v\n", offset, err)
+	}
+	eventQueue <- Event{Terminate, nil, nil, nil}
+
+	bases, _ := Segments(WithFS(fsys))
+	if len(bases) < 3 {
+		t.Errorf("Expected the batch to span several segments. Got %v\n", bases)
+	}
+	next, err := ScanRecords(1, -1, func(record Record) error {
+		if expected := fmt.Sprintf("value-%d", record.Offset); string(record.Value) != expected {
+			t.Errorf("Expected %s. Got %s\n", expected, record.Value)
+		}
+		return nil
+	}, WithFS(fsys))
+	if err != nil || next != 501 {
+		t.Errorf("Expected to scan through 501. Got %d %v\n", next, err)
+	}
+}
+
+func TestLogStore_PutRecords_TooBigForSegment(t *testing.T) {
+	fsys := NewMemFS()
+	eventQueue := make(chan Event, 10)
+	store, _ := NewLogStore(eventQueue, WithFS(fsys))
+	store.Run()
+
+	pchan := make(chan Event, 1)
+	putValues(t, eventQueue, 1, 10)
+	records := []Record{
+		{Value: []byte("value-11")},
+		{Value: []byte("value-12")},
+		{Value: bytes.Repeat([]byte("x"), 2*segmentSize)},
+	}
+	offset, err := putRecords(eventQueue, pchan, records)
+	if err == nil || err.(LogStoreErr).ErrType != SegmentLimitReached || offset != -1 {
+		t.Errorf("Expected SegmentLimitReached error. Got %d %v\n", offset, err)
+	}
+
+	// none of the batch was written, so the next put takes its place
+	offset, err = putRecords(eventQueue, pchan, records[:1])
+	if err != nil || offset != 11 {
+		t.Errorf("Expected the next put at 11. Got %d %v\n", offset, err)
+	}
+	eventQueue <- Event{Terminate, nil, nil, nil}
+
+	var values []string
+	next, err := ScanRecords(1, -1, func(record Record) error {
+		values = append(values, string(record.Value))
+		return nil
+	}, WithFS(fsys))
+	if err != nil || next != 12 || len(values) != 11 || values[10] != "value-11" {
+		t.Errorf("Expected 11 records ending in value-11. Got %d %v %v\n", next, err, values)
+	}
+}
+
+func TestLogStore_ScanWhileAppending(t *testing.T) {
+	fsys := NewMemFS()
+	eventQueue := make(chan Event, 100)
+	store, err := NewLogStore(eventQueue, WithFS(fsys))
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	store.Run()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pchan := make(chan Event, 1)
+		for i := 1; i <= 1000; i++ {
+			eventQueue <- Event{Put, []byte(fmt.Sprintf("value-%d", i)), pchan, nil}
+			<-pchan
+			eventQueue <- Event{FlushMetaData, nil, nil, nil}
+		}
+	}()
+
+	// readers bounded by the flushed metadata see every record below it
+	for reading := true; reading; {
+		select {
+		case <-done:
+			reading = false
+		default:
+		}
+
+		metadata, err := ReadMetaData(WithFS(fsys))
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		expected := int64(1)
+		next, err := ScanRecords(1, metadata.NextOffset, func(record Record) error {
+			if record.Offset != expected {
+				return fmt.Errorf("expected offset %d, got %d", expected, record.Offset)
+			}
+			expected++
+			return nil
+		}, WithFS(fsys))
+		if err != nil || next != expected || (metadata.NextOffset > 0 && next != metadata.NextOffset) {
+			t.Fatalf("Expected every record below %d. Got through %d %v\n", metadata.NextOffset, next, err)
+		}
+	}
+
+	eventQueue <- Event{Terminate, nil, nil, nil}
+}
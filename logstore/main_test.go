@@ -13,6 +13,10 @@ type TestMessage struct {
 	V4 string
 }
 
+// testConfig reaches the working directory for the helpers that are
+// Config methods.
+var testConfig Config
+
 func TestMain(m *testing.M) {
 	m.Run()
 	removeTestFiles()
@@ -22,8 +26,20 @@ func removeTestFiles() {
 	logs, _ := filepath.Glob("*.log")
 	index, _ := filepath.Glob("*.index")
 	meta, _ := filepath.Glob("*.meta")
+	merkle, _ := filepath.Glob("*.merkle")
+	keys, _ := filepath.Glob("*.keys")
+	manifests, _ := filepath.Glob("*.manifest")
+	aborted, _ := filepath.Glob("*.aborted")
+	queues, _ := filepath.Glob("*.queue")
+	schedules, _ := filepath.Glob("*.schedule")
 	files := append(logs, index...)
 	files = append(files, meta...)
+	files = append(files, merkle...)
+	files = append(files, keys...)
+	files = append(files, manifests...)
+	files = append(files, aborted...)
+	files = append(files, queues...)
+	files = append(files, schedules...)
 	for _, f := range files {
 		os.Remove(f)
 	}
@@ -0,0 +1,187 @@
+package logstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Manifest describes a set of segments and the offset following them. It
+// travels with exported archives and snapshots.
+type Manifest struct {
+	NextOffset int64
+	Segments   []SegmentManifest
+}
+
+// SegmentManifest describes one segment. LastHash is the hex encoded
+// hash of the segment's last batch and MerkleRoot the hex encoded root of
+// the tree over its records, which is only recorded for closed segments.
+type SegmentManifest struct {
+	BaseOffset int64
+	NextOffset int64
+	LogSize    int64
+	LastHash   string `json:",omitempty"`
+	MerkleRoot string `json:",omitempty"`
+}
+
+func (s SegmentManifest) Name() string {
+	return fmt.Sprintf("%020d", s.BaseOffset)
+}
+
+// DecodeManifest parses a manifest read from an archive, a snapshot or a
+// file and checks that its segments are ordered, do not overlap and fit
+// under its next offset, so nothing built from it trusts a malformed file.
+func DecodeManifest(data []byte) (Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return Manifest{}, NewLogStoreErr(CorruptManifest, "manifest is not valid JSON", err)
+	}
+
+	next := int64(1)
+	for _, s := range m.Segments {
+		var msg string
+		switch {
+		case s.BaseOffset < next:
+			msg = fmt.Sprintf("segment %d overlaps the segment before it", s.BaseOffset)
+		case s.NextOffset < s.BaseOffset:
+			msg = fmt.Sprintf("segment %d ends before it begins", s.BaseOffset)
+		case s.LogSize < 0:
+			msg = fmt.Sprintf("segment %d has a negative log size", s.BaseOffset)
+		case !validHash(s.LastHash) || !validHash(s.MerkleRoot):
+			msg = fmt.Sprintf("segment %d has a malformed hash", s.BaseOffset)
+		default:
+			next = s.NextOffset
+			continue
+		}
+		return Manifest{}, NewLogStoreErr(CorruptManifest, msg, nil)
+	}
+	if m.NextOffset < next {
+		return Manifest{}, NewLogStoreErr(
+			CorruptManifest,
+			fmt.Sprintf("next offset %d is behind the segments, which end at %d", m.NextOffset, next),
+			nil,
+		)
+	}
+
+	return m, nil
+}
+
+func validHash(s string) bool {
+	if s == "" {
+		return true
+	}
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == sha256.Size
+}
+
+// BuildManifest describes the segments in the working directory and any
+// offloaded to remote storage. The last segment is taken to be the one
+// still being appended to.
+func BuildManifest(opts ...Option) (Manifest, error) {
+	c := newConfig(opts)
+	return c.buildManifest()
+}
+
+func (c *Config) buildManifest() (Manifest, error) {
+	bases, err := c.allSegments()
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	m := Manifest{NextOffset: 1}
+	for i, base := range bases {
+		s, err := c.describeSegment(base, i < len(bases)-1)
+		if err != nil {
+			return Manifest{}, err
+		}
+		m.Segments = append(m.Segments, s)
+		m.NextOffset = s.NextOffset
+	}
+
+	return m, nil
+}
+
+func (c *Config) describeSegment(base int64, closed bool) (SegmentManifest, error) {
+	entries, size, err := c.readSegment(base)
+	if err != nil {
+		return SegmentManifest{}, err
+	}
+
+	s := SegmentManifest{
+		BaseOffset: base,
+		NextOffset: base + int64(len(entries)),
+		LogSize:    size,
+	}
+	if len(entries) > 0 {
+		hash, err := c.hashBefore(s.NextOffset)
+		if err != nil {
+			return SegmentManifest{}, err
+		}
+		s.LastHash = hexHash(hash)
+	}
+	if closed {
+		t, err := c.segmentMerkleTree(base)
+		if err != nil {
+			return SegmentManifest{}, err
+		}
+		s.MerkleRoot = hexHash(t.Root())
+	}
+	return s, nil
+}
+
+// writeSegmentManifest records the manifest entry of a closed segment as
+// the store wrote it, so VerifyChain can later tell a truncated or
+// rewritten segment from the original. Unlike the caches, the entry is
+// synced and kept when the segment is offloaded.
+func (c *Config) writeSegmentManifest(base int64) error {
+	s, err := c.describeSegment(base, true)
+	if err != nil {
+		return err
+	}
+	if err := writeJSONSync(c.fs(), segmentManifestName(base), s); err != nil {
+		return NewLogStoreErr(OSErr, "unable to record segment manifest", err)
+	}
+	return nil
+}
+
+// recordedManifest returns the recorded entries of the segments holding
+// offsets in [from, to), or through the end of the log when to is negative.
+func (c *Config) recordedManifest(from, to int64) (Manifest, error) {
+	files, err := c.fs().Glob("*.manifest")
+	if err != nil {
+		return Manifest{}, err
+	}
+	sort.Strings(files)
+
+	var m Manifest
+	for _, file := range files {
+		data, err := readFile(c.fs(), file)
+		if err != nil {
+			return Manifest{}, NewLogStoreErr(OSErr, "unable to read segment manifest", err)
+		}
+		var s SegmentManifest
+		if err := json.Unmarshal(data, &s); err != nil || !validHash(s.LastHash) || !validHash(s.MerkleRoot) {
+			return Manifest{}, NewLogStoreErr(
+				CorruptManifest,
+				fmt.Sprintf("segment manifest %s is malformed", file),
+				err,
+			)
+		}
+		if s.NextOffset > from && (to < 0 || s.BaseOffset < to) {
+			m.Segments = append(m.Segments, s)
+			m.NextOffset = s.NextOffset
+		}
+	}
+	return m, nil
+}
+
+func (c *Config) hasSegmentManifest(base int64) bool {
+	_, err := c.fs().Stat(segmentManifestName(base))
+	return err == nil
+}
+
+func segmentManifestName(base int64) string {
+	return fmt.Sprintf("%020d.manifest", base)
+}
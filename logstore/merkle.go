@@ -0,0 +1,261 @@
+package logstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// MerkleTree hashes the records of a segment. Leaves hash an offset and its
+// record, or the offset alone for a record removed by compaction, so leaf i
+// always covers BaseOffset+i. Each parent hashes its two children, and a
+// node without a sibling moves up unchanged. Levels[0] holds the leaves and
+// the last level the root.
+type MerkleTree struct {
+	BaseOffset int64
+	Levels     [][][sha256.Size]byte
+}
+
+// MerkleSource is a tree that can be compared against, typically one held
+// by another store and fetched a node at a time.
+type MerkleSource interface {
+	Leaves() (int, error)
+	Node(level, index int) ([sha256.Size]byte, error)
+}
+
+// OffsetRange is the half open range of offsets [From, To).
+type OffsetRange struct {
+	From int64
+	To   int64
+}
+
+// merkleLeaf hashes an offset with its encoded record, so keys, headers and
+// timestamps count towards the digest along with the value.
+func merkleLeaf(offset int64, data []byte) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	binary.Write(h, binary.LittleEndian, offset)
+	h.Write(data)
+
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+func merkleParent(left, right [sha256.Size]byte) [sha256.Size]byte {
+	buff := make([]byte, 0, 1+2*sha256.Size)
+	buff = append(buff, 1)
+	buff = append(buff, left[:]...)
+	buff = append(buff, right[:]...)
+	return sha256.Sum256(buff)
+}
+
+func buildMerkleTree(base int64, leaves [][sha256.Size]byte) *MerkleTree {
+	t := &MerkleTree{BaseOffset: base, Levels: [][][sha256.Size]byte{leaves}}
+	for level := leaves; len(level) > 1; {
+		var parents [][sha256.Size]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				parents = append(parents, level[i])
+			} else {
+				parents = append(parents, merkleParent(level[i], level[i+1]))
+			}
+		}
+		t.Levels = append(t.Levels, parents)
+		level = parents
+	}
+
+	return t
+}
+
+// Root returns the root hash, which is zeroed for an empty segment.
+func (t *MerkleTree) Root() [sha256.Size]byte {
+	top := t.Levels[len(t.Levels)-1]
+	if len(top) == 0 {
+		return [sha256.Size]byte{}
+	}
+	return top[0]
+}
+
+func (t *MerkleTree) Leaves() (int, error) {
+	return len(t.Levels[0]), nil
+}
+
+func (t *MerkleTree) Node(level, index int) ([sha256.Size]byte, error) {
+	if level < 0 || level >= len(t.Levels) || index < 0 || index >= len(t.Levels[level]) {
+		return [sha256.Size]byte{}, fmt.Errorf("no merkle node at level %d index %d", level, index)
+	}
+	return t.Levels[level][index], nil
+}
+
+// Span returns the offsets covered by a node.
+func (t *MerkleTree) Span(level, index int) OffsetRange {
+	from := index << uint(level)
+	to := (index + 1) << uint(level)
+	if to > len(t.Levels[0]) {
+		to = len(t.Levels[0])
+	}
+	return OffsetRange{t.BaseOffset + int64(from), t.BaseOffset + int64(to)}
+}
+
+// DivergentRanges compares a tree with one built over the same segment
+// elsewhere, descending only into subtrees whose hashes differ. Trees over
+// different record counts are reported as diverging across the segment.
+func DivergentRanges(local *MerkleTree, remote MerkleSource) ([]OffsetRange, error) {
+	leaves, _ := local.Leaves()
+	remoteLeaves, err := remote.Leaves()
+	if err != nil {
+		return nil, err
+	}
+	if leaves != remoteLeaves {
+		n := leaves
+		if remoteLeaves > n {
+			n = remoteLeaves
+		}
+		return []OffsetRange{{local.BaseOffset, local.BaseOffset + int64(n)}}, nil
+	}
+	if leaves == 0 {
+		return nil, nil
+	}
+
+	var ranges []OffsetRange
+	var walk func(level, index int) error
+	walk = func(level, index int) error {
+		theirs, err := remote.Node(level, index)
+		if err != nil {
+			return err
+		}
+		if theirs == local.Levels[level][index] {
+			return nil
+		}
+		if level == 0 {
+			span := local.Span(level, index)
+			if n := len(ranges); n > 0 && ranges[n-1].To == span.From {
+				ranges[n-1].To = span.To
+			} else {
+				ranges = append(ranges, span)
+			}
+			return nil
+		}
+
+		for child := 2 * index; child <= 2*index+1 && child < len(local.Levels[level-1]); child++ {
+			if err := walk(level-1, child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err = walk(len(local.Levels)-1, 0)
+	return ranges, err
+}
+
+// DivergentSegments returns the base offsets of segments whose Merkle roots
+// differ between two manifests or that only one of them holds.
+func DivergentSegments(local, remote Manifest) []int64 {
+	roots := map[int64]string{}
+	for _, s := range remote.Segments {
+		roots[s.BaseOffset] = s.MerkleRoot
+	}
+
+	var bases []int64
+	for _, s := range local.Segments {
+		root, ok := roots[s.BaseOffset]
+		if !ok || root != s.MerkleRoot {
+			bases = append(bases, s.BaseOffset)
+		}
+		delete(roots, s.BaseOffset)
+	}
+	for base := range roots {
+		bases = append(bases, base)
+	}
+
+	return bases
+}
+
+// SegmentMerkleTree returns the tree over the records of the segment at
+// base, read from its .merkle file when the store has written one.
+func SegmentMerkleTree(base int64, opts ...Option) (*MerkleTree, error) {
+	c := newConfig(opts)
+	return c.segmentMerkleTree(base)
+}
+
+func (c *Config) segmentMerkleTree(base int64) (*MerkleTree, error) {
+	if t, err := c.readMerkleTree(base); err == nil {
+		return t, nil
+	}
+	return c.computeMerkleTree(base)
+}
+
+func (c *Config) computeMerkleTree(base int64) (*MerkleTree, error) {
+	var leaves [][sha256.Size]byte
+	compacted := func(to int64) {
+		for offset := base + int64(len(leaves)); offset < to; offset++ {
+			leaves = append(leaves, merkleLeaf(offset, nil))
+		}
+	}
+	next, err := c.scanSegment(base, base, -1, func(record Record) error {
+		data, err := record.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		compacted(record.Offset)
+		leaves = append(leaves, merkleLeaf(record.Offset, data))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	compacted(next)
+
+	return buildMerkleTree(base, leaves), nil
+}
+
+// writeMerkleTree saves the leaves of a closed segment's tree. The file is
+// only a cache and is rebuilt from the records when missing.
+func (c *Config) writeMerkleTree(base int64) error {
+	t, err := c.segmentMerkleTree(base)
+	if err != nil {
+		return err
+	}
+
+	buff := new(bytes.Buffer)
+	binary.Write(buff, binary.LittleEndian, uint32(len(t.Levels[0])))
+	for _, leaf := range t.Levels[0] {
+		buff.Write(leaf[:])
+	}
+
+	return writeFile(c.fs(), merkleName(base), buff.Bytes())
+}
+
+func (c *Config) readMerkleTree(base int64) (*MerkleTree, error) {
+	data, err := readFile(c.fs(), merkleName(base))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < 4 {
+		return nil, corruptErr("merkle file shorter than its header")
+	}
+	n := int(binary.LittleEndian.Uint32(data))
+	data = data[4:]
+	if len(data) != n*sha256.Size {
+		return nil, corruptErr("merkle file length mismatch")
+	}
+
+	leaves := make([][sha256.Size]byte, n)
+	for i := range leaves {
+		copy(leaves[i][:], data[i*sha256.Size:])
+	}
+
+	return buildMerkleTree(base, leaves), nil
+}
+
+func (c *Config) removeMerkleTree(base int64) {
+	c.fs().Remove(merkleName(base))
+}
+
+func merkleName(base int64) string {
+	return fmt.Sprintf("%020d.merkle", base)
+}
@@ -0,0 +1,152 @@
+package logstore
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"testing"
+	"time"
+)
+
+func testLeaves(n int) [][sha256.Size]byte {
+	var leaves [][sha256.Size]byte
+	for i := 0; i < n; i++ {
+		leaves = append(leaves, merkleLeaf(int64(i+1), []byte(fmt.Sprintf("record %d", i+1))))
+	}
+	return leaves
+}
+
+func TestMerkleTree_DivergentRanges(t *testing.T) {
+	local := buildMerkleTree(1, testLeaves(13))
+
+	leaves := testLeaves(13)
+	leaves[4] = merkleLeaf(5, []byte("changed"))
+	leaves[5] = merkleLeaf(6, []byte("changed"))
+	leaves[12] = merkleLeaf(13, []byte("changed"))
+	remote := buildMerkleTree(1, leaves)
+
+	if local.Root() == remote.Root() {
+		t.Errorf("Expected roots to differ\n")
+	}
+
+	ranges, err := DivergentRanges(local, remote)
+	if err != nil {
+		t.Errorf("%v\n", err)
+	}
+
+	expected := []OffsetRange{{5, 7}, {13, 14}}
+	if len(ranges) != len(expected) {
+		t.Fatalf("Expected ranges %v. Got %v\n", expected, ranges)
+	}
+	for i := range expected {
+		if ranges[i] != expected[i] {
+			t.Errorf("Expected ranges %v. Got %v\n", expected, ranges)
+		}
+	}
+
+	ranges, _ = DivergentRanges(local, buildMerkleTree(1, testLeaves(13)))
+	if len(ranges) != 0 {
+		t.Errorf("Expected identical trees to match. Got %v\n", ranges)
+	}
+}
+
+func TestLogStore_Roll_WritesMerkleTree(t *testing.T) {
+	eventQueue := make(chan Event, 1000)
+	store, _ := NewLogStore(eventQueue)
+	store.Run()
+
+	pchan := make(chan Event, 200)
+	for i := 1; i <= 200; i++ {
+		data, _ := json.Marshal(TestMessage{"foo", i, 23.0, "bar"})
+		eventQueue <- Event{Put, data, pchan, nil}
+	}
+	for i := 1; i <= 200; i++ {
+		<-pchan
+	}
+	eventQueue <- Event{Terminate, nil, nil, nil}
+
+	if _, err := os.Stat(merkleName(1)); err != nil {
+		t.Errorf("Expected closed segment to have a merkle file: %v\n", err)
+	}
+
+	cached, _ := SegmentMerkleTree(1)
+	computed, _ := (&Config{}).computeMerkleTree(1)
+	if cached.Root() != computed.Root() {
+		t.Errorf("Expected cached root to match records\n")
+	}
+
+	manifest, _ := BuildManifest()
+	if manifest.Segments[0].MerkleRoot != hexHash(cached.Root()) {
+		t.Errorf("Expected manifest to hold merkle root of closed segment\n")
+	}
+	if manifest.Segments[len(manifest.Segments)-1].MerkleRoot != "" {
+		t.Errorf("Expected no merkle root for active segment\n")
+	}
+
+	// a modified record changes the root even with a stale cache
+	segment, _ := NewLogSegment(1, -1, true)
+	entry, _ := segment.Index.GetEntry(3)
+	data, _ := segment.readFrame(entry)
+	segment.Close()
+
+	body := data[BatchHeaderWidth:]
+	body[len(body)-2] = 'X'
+	binary.LittleEndian.PutUint32(data[14:18], crc32.ChecksumIEEE(body))
+	f, _ := os.OpenFile(segment.Name+".log", os.O_WRONLY, Perms)
+	f.WriteAt(data, entry.Position)
+	f.Close()
+
+	problems, _ := VerifyManifest(manifest)
+	if len(problems) != 1 || problems[0].Message != "merkle root mismatch" {
+		t.Errorf("Expected merkle root mismatch. Got %v\n", problems)
+	}
+
+	close(pchan)
+	close(eventQueue)
+	removeTestFiles()
+}
+
+func TestMerkleTree_DivergentRanges_Compacted(t *testing.T) {
+	fsys := NewMemFS()
+	clock := NewManualClock(time.Unix(1546300800, 0))
+	eventQueue := make(chan Event, 10)
+	store, _ := NewLogStore(eventQueue, WithFS(fsys), WithClock(clock))
+	store.Run()
+
+	pchan := make(chan Event, 1)
+	expires := millis(clock.Now().Add(time.Hour))
+	for i := 1; i <= 300; i++ {
+		record := Record{Value: []byte(fmt.Sprintf("value-%d", i))}
+		if i <= 10 {
+			record.ExpiresAt = expires
+		}
+		data, _ := record.MarshalBinary()
+		eventQueue <- Event{PutRecord, data, pchan, nil}
+		<-pchan
+	}
+	eventQueue <- Event{Terminate, nil, nil, nil}
+
+	clock.Advance(2 * time.Hour)
+	if dropped, err := Compact(WithFS(fsys), WithClock(clock)); err != nil || dropped != 10 {
+		t.Fatalf("Expected 10 records dropped. Got %d %v\n", dropped, err)
+	}
+
+	bases, _ := Segments(WithFS(fsys))
+	local, err := SegmentMerkleTree(bases[0], WithFS(fsys))
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if leaves, _ := local.Leaves(); int64(leaves) != bases[1]-bases[0] {
+		t.Errorf("Expected a leaf for every offset up to %d. Got %d\n", bases[1], leaves)
+	}
+
+	leaves := append([][sha256.Size]byte(nil), local.Levels[0]...)
+	leaves[19] = merkleLeaf(20, []byte("changed"))
+	ranges, err := DivergentRanges(local, buildMerkleTree(bases[0], leaves))
+	if err != nil || len(ranges) != 1 || ranges[0] != (OffsetRange{20, 21}) {
+		t.Errorf("Expected offset 20 to diverge. Got %v %v\n", ranges, err)
+	}
+}
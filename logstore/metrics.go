@@ -0,0 +1,306 @@
+package logstore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the latency
+// histograms.
+var latencyBuckets = [...]float64{
+	0.00001, 0.000025, 0.00005, 0.0001, 0.00025, 0.0005,
+	0.001, 0.0025, 0.005, 0.01, 0.025, 0.05,
+	0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+var eventNames = map[EventType]string{
+	Put:               "put",
+	Get:               "get",
+	FlushMetaData:     "flush_metadata",
+	Snapshot:          "snapshot",
+	PutRecord:         "put_record",
+	GetRecord:         "get_record",
+	InitProducer:      "init_producer",
+	BeginTransaction:  "begin_transaction",
+	CommitTransaction: "commit_transaction",
+	AbortTransaction:  "abort_transaction",
+	PutRecords:        "put_records",
+}
+
+// Metrics counts what a store does and times how long it takes. Pass it
+// to the store and to Compact with WithMetrics, and serve it over HTTP to
+// expose it in the Prometheus text format. A nil *Metrics records nothing.
+type Metrics struct {
+	bytesWritten     int64
+	recordsAppended  int64
+	rolls            int64
+	indexResizes     int64
+	compactedRecords int64
+
+	activeSegmentBytes int64
+	segments           int64
+	queueDepth         int64
+
+	appendLatency  histogram
+	getLatency     histogram
+	rollLatency    histogram
+	fsyncLatency   histogram
+	compactLatency histogram
+
+	mu     sync.Mutex
+	events map[EventType]*eventMetrics
+}
+
+type eventMetrics struct {
+	errors  int64
+	latency histogram
+}
+
+type histogram struct {
+	mu     sync.Mutex
+	counts [len(latencyBuckets) + 1]uint64
+	sum    float64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+// WithMetrics records the store's activity in m.
+func WithMetrics(m *Metrics) Option {
+	return func(c *Config) {
+		c.Metrics = m
+	}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(latencyBuckets[:], seconds)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.sum += seconds
+}
+
+func (m *Metrics) appended(bytes, records int, segmentSize int64, d time.Duration) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.bytesWritten, int64(bytes))
+	atomic.AddInt64(&m.recordsAppended, int64(records))
+	atomic.StoreInt64(&m.activeSegmentBytes, segmentSize)
+	m.appendLatency.observe(d)
+}
+
+func (m *Metrics) read(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.getLatency.observe(d)
+}
+
+func (m *Metrics) rolled(d time.Duration) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.rolls, 1)
+	atomic.AddInt64(&m.segments, 1)
+	atomic.StoreInt64(&m.activeSegmentBytes, 0)
+	m.rollLatency.observe(d)
+}
+
+// removed counts a segment deleted from local disk.
+func (m *Metrics) removed() {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.segments, -1)
+}
+
+func (m *Metrics) resized() {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.indexResizes, 1)
+}
+
+func (m *Metrics) synced(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.fsyncLatency.observe(d)
+}
+
+func (m *Metrics) compacted(records int, d time.Duration) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.compactedRecords, int64(records))
+	m.compactLatency.observe(d)
+}
+
+func (m *Metrics) opened(segments int, segmentSize int64) {
+	if m == nil {
+		return
+	}
+	atomic.StoreInt64(&m.segments, int64(segments))
+	atomic.StoreInt64(&m.activeSegmentBytes, segmentSize)
+}
+
+// handled records an event taken off the queue, leaving depth events
+// behind it.
+func (m *Metrics) handled(t EventType, depth int, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	atomic.StoreInt64(&m.queueDepth, int64(depth))
+
+	m.mu.Lock()
+	if m.events == nil {
+		m.events = make(map[EventType]*eventMetrics)
+	}
+	e, ok := m.events[t]
+	if !ok {
+		e = &eventMetrics{}
+		m.events[t] = e
+	}
+	m.mu.Unlock()
+
+	if err != nil {
+		atomic.AddInt64(&e.errors, 1)
+	}
+	e.latency.observe(d)
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteText(w)
+}
+
+// WriteText writes the metrics in the Prometheus text exposition format.
+// A nil Metrics writes nothing.
+func (m *Metrics) WriteText(w io.Writer) error {
+	if m == nil {
+		return nil
+	}
+	b := bufio.NewWriter(w)
+
+	for _, c := range []struct {
+		name, help string
+		v          *int64
+	}{
+		{"logstore_bytes_written_total", "Bytes appended to segment logs.", &m.bytesWritten},
+		{"logstore_records_appended_total", "Records appended to segment logs.", &m.recordsAppended},
+		{"logstore_segment_rolls_total", "Segments closed for a new active segment.", &m.rolls},
+		{"logstore_index_resizes_total", "Times an index file was grown.", &m.indexResizes},
+		{"logstore_compacted_records_total", "Expired records dropped by compaction.", &m.compactedRecords},
+	} {
+		writeHeader(b, c.name, c.help, "counter")
+		fmt.Fprintf(b, "%s %d\n", c.name, atomic.LoadInt64(c.v))
+	}
+
+	for _, g := range []struct {
+		name, help string
+		v          *int64
+	}{
+		{"logstore_active_segment_bytes", "Size of the active segment log.", &m.activeSegmentBytes},
+		{"logstore_segments", "Number of segments on local disk.", &m.segments},
+		{"logstore_event_queue_depth", "Events waiting on the queue after the last one was handled.", &m.queueDepth},
+	} {
+		writeHeader(b, g.name, g.help, "gauge")
+		fmt.Fprintf(b, "%s %d\n", g.name, atomic.LoadInt64(g.v))
+	}
+
+	for _, h := range []struct {
+		name, help string
+		h          *histogram
+	}{
+		{"logstore_append_duration_seconds", "Time to append a batch to a segment.", &m.appendLatency},
+		{"logstore_get_duration_seconds", "Time to read a record.", &m.getLatency},
+		{"logstore_roll_duration_seconds", "Time to close a segment and open the next.", &m.rollLatency},
+		{"logstore_fsync_duration_seconds", "Time to sync a segment to disk.", &m.fsyncLatency},
+		{"logstore_compaction_duration_seconds", "Time to compact a segment.", &m.compactLatency},
+	} {
+		writeHeader(b, h.name, h.help, "histogram")
+		h.h.write(b, h.name, "")
+	}
+
+	m.mu.Lock()
+	types := make([]EventType, 0, len(m.events))
+	for t := range m.events {
+		types = append(types, t)
+	}
+	m.mu.Unlock()
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	writeHeader(b, "logstore_event_errors_total", "Events answered with an error.", "counter")
+	for _, t := range types {
+		fmt.Fprintf(b, "logstore_event_errors_total{%s} %d\n", eventLabel(t), atomic.LoadInt64(&m.event(t).errors))
+	}
+	writeHeader(b, "logstore_event_duration_seconds", "Time the event loop spent on an event.", "histogram")
+	for _, t := range types {
+		m.event(t).latency.write(b, "logstore_event_duration_seconds", eventLabel(t))
+	}
+
+	return b.Flush()
+}
+
+func (m *Metrics) event(t EventType) *eventMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.events[t]
+}
+
+func eventLabel(t EventType) string {
+	name, ok := eventNames[t]
+	if !ok {
+		name = strconv.Itoa(int(t))
+	}
+	return fmt.Sprintf("event=%q", name)
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// write prints the cumulative buckets, sum and count of h, each carrying
+// labels.
+func (h *histogram) write(w io.Writer, name, labels string) {
+	h.mu.Lock()
+	counts, sum := h.counts, h.sum
+	h.mu.Unlock()
+
+	bucketLabels, sampleLabels := "", ""
+	if labels != "" {
+		bucketLabels, sampleLabels = labels+",", "{"+labels+"}"
+	}
+
+	var total uint64
+	for i, n := range counts {
+		total += n
+		le := math.Inf(1)
+		if i < len(latencyBuckets) {
+			le = latencyBuckets[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=%q} %d\n", name, bucketLabels, formatFloat(le), total)
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, sampleLabels, formatFloat(sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, sampleLabels, total)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,126 @@
+package logstore
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrape serves m and returns each sample by its name and labels.
+func scrape(t *testing.T, m *Metrics) map[string]float64 {
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Expected a text content type. Got %s\n", ct)
+	}
+
+	samples := make(map[string]float64)
+	for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("Malformed sample %q\n", line)
+		}
+		samples[line[:i]] = v
+	}
+	return samples
+}
+
+func TestMetrics(t *testing.T) {
+	fsys := NewMemFS()
+	m := NewMetrics()
+	eventQueue := make(chan Event, 100)
+	store, err := NewLogStore(eventQueue, WithFS(fsys), WithMetrics(m))
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	store.Run()
+
+	pchan := make(chan Event, 1)
+	for i := 1; i <= 300; i++ {
+		eventQueue <- Event{Put, []byte(fmt.Sprintf("value-%d", i)), pchan, nil}
+		if err := (<-pchan).Error; err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+	eventQueue <- Event{Get, varint(2), pchan, nil}
+	<-pchan
+	eventQueue <- Event{Get, varint(1000), pchan, nil}
+	<-pchan
+	eventQueue <- Event{FlushMetaData, nil, pchan, nil}
+	<-pchan
+	eventQueue <- Event{Terminate, nil, nil, nil}
+
+	bases, _ := Segments(WithFS(fsys))
+	if len(bases) < 2 {
+		t.Fatalf("Expected the log to roll. Got segments %v\n", bases)
+	}
+	if _, err := Compact(WithFS(fsys), WithMetrics(m)); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	samples := scrape(t, m)
+	for name, expected := range map[string]float64{
+		"logstore_records_appended_total":                               300,
+		"logstore_segment_rolls_total":                                  float64(len(bases) - 1),
+		"logstore_segments":                                             float64(len(bases)),
+		"logstore_append_duration_seconds_count":                        300,
+		"logstore_get_duration_seconds_count":                           2,
+		"logstore_compaction_duration_seconds_count":                    float64(len(bases) - 1),
+		"logstore_compacted_records_total":                              0,
+		`logstore_event_duration_seconds_count{event="put"}`:            300,
+		`logstore_event_duration_seconds_bucket{event="put",le="+Inf"}`: 300,
+		`logstore_event_errors_total{event="put"}`:                      0,
+		`logstore_event_errors_total{event="get"}`:                      1,
+		`logstore_event_duration_seconds_count{event="flush_metadata"}`: 1,
+	} {
+		if v, ok := samples[name]; !ok || v != expected {
+			t.Errorf("Expected %s to be %v. Got %v\n", name, expected, v)
+		}
+	}
+
+	if samples["logstore_bytes_written_total"] == 0 {
+		t.Errorf("Expected bytes written to be counted\n")
+	}
+	active, _ := readFile(fsys, fmt.Sprintf("%020d.log", bases[len(bases)-1]))
+	if samples["logstore_active_segment_bytes"] != float64(len(active)) {
+		t.Errorf("Expected active segment size %d. Got %v\n", len(active), samples["logstore_active_segment_bytes"])
+	}
+	// every roll syncs the closed segment and the flush syncs the active one
+	if samples["logstore_fsync_duration_seconds_count"] != float64(len(bases)) {
+		t.Errorf("Expected %d syncs. Got %v\n", len(bases), samples["logstore_fsync_duration_seconds_count"])
+	}
+}
+
+func TestMetrics_IndexResize(t *testing.T) {
+	m := NewMetrics()
+	index, err := newIndex(NewMemFS(), "test.index", IndexItemWidth, false)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer index.Close()
+	index.metrics = m
+
+	for i := int64(1); i <= 2; i++ {
+		if err := index.AddEntry(IndexEntry{i, 0, 1}); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+	if v := scrape(t, m)["logstore_index_resizes_total"]; v != 1 {
+		t.Errorf("Expected 1 resize. Got %v\n", v)
+	}
+}
+
+func TestMetrics_WriteText_Nil(t *testing.T) {
+	var m *Metrics
+	var buff bytes.Buffer
+	if err := m.WriteText(&buff); err != nil || buff.Len() != 0 {
+		t.Errorf("Expected nothing written. Got %q %v\n", buff.String(), err)
+	}
+}
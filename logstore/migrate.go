@@ -0,0 +1,122 @@
+package logstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// MigrateSegments rewrites the values in segments written before records
+// were framed in batches, which hold each value just as it was appended,
+// as single record batches and returns the number of records rewritten.
+// Offsets do not move. Run it once, while no store has the directory open,
+// before using a directory written by an older version.
+//
+// An entry is taken to be in the old format when it does not start with a
+// batch header covering its offset. A damaged batch fails the migration
+// with a CorruptRecord error rather than being taken for a value; run
+// Verify first. Segments are replaced as Compact replaces them.
+func MigrateSegments(opts ...Option) (int, error) {
+	c := newConfig(opts)
+
+	bases, err := c.segments()
+	if err != nil {
+		return 0, err
+	}
+
+	var migrated int
+	for _, base := range bases {
+		if err := c.finishCompaction(base); err != nil {
+			return migrated, err
+		}
+		n, err := c.migrateSegment(base)
+		if err != nil {
+			return migrated, err
+		}
+		migrated += n
+	}
+
+	return migrated, nil
+}
+
+func (c *Config) migrateSegment(base int64) (int, error) {
+	segment, err := c.openSegment(base, -1, true)
+	if err != nil {
+		return 0, err
+	}
+	defer segment.Close()
+
+	entries, err := segment.Index.Entries()
+	if err != nil {
+		return 0, err
+	}
+
+	fsys := c.fs()
+	names := compactionNames(base)
+	log, err := createFile(fsys, names.log)
+	if err != nil {
+		return 0, err
+	}
+	defer log.Close()
+
+	kept := make([]IndexEntry, 0, len(entries))
+	var position int64
+	var migrated int
+	for i, entry := range entries {
+		switch {
+		case entry.Length == 0:
+			kept = append(kept, IndexEntry{entry.Offset, position, 0})
+			continue
+		case i > 0 && sameBatch(entry, entries[i-1]):
+			prev := kept[i-1]
+			kept = append(kept, IndexEntry{entry.Offset, prev.Position, prev.Length})
+			continue
+		}
+
+		frame, err := segment.readFrame(entry)
+		if err != nil {
+			return 0, err
+		}
+		if framed(frame, entry.Offset) {
+			if _, err := parseFrame(frame); err != nil {
+				return 0, NewLogStoreErr(
+					CorruptRecord,
+					fmt.Sprintf("batch at offset %d is damaged", entry.Offset),
+					err,
+				)
+			}
+		} else {
+			frame, err = encodeBatch(entry.Offset, []Record{{Value: frame}}, batchOptions{})
+			if err != nil {
+				return 0, err
+			}
+			migrated++
+		}
+
+		if _, err := log.Write(frame); err != nil {
+			return 0, err
+		}
+		kept = append(kept, IndexEntry{entry.Offset, position, int64(len(frame))})
+		position += int64(len(frame))
+	}
+
+	if migrated == 0 {
+		log.Close()
+		fsys.Remove(names.log)
+		return 0, nil
+	}
+	return migrated, c.replaceSegment(base, log, kept)
+}
+
+// framed reports whether data starts with a batch header covering offset,
+// whether or not the batch behind it is intact.
+func framed(data []byte, offset int64) bool {
+	var h BatchHeader
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &h); err != nil {
+		return false
+	}
+	if h.Magic != batchMagic && h.Magic != legacyBatchMagic {
+		return false
+	}
+	return offset >= h.BaseOffset && offset < h.BaseOffset+int64(h.Count)
+}
@@ -0,0 +1,98 @@
+package logstore
+
+import (
+	"fmt"
+	"testing"
+)
+
+// writeUnframedSegment writes values as segments were written before
+// batches, one bare value per index entry.
+func writeUnframedSegment(t *testing.T, fsys FS, base int64, values []string) {
+	log, err := createFile(fsys, fmt.Sprintf("%020d.log", base))
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer log.Close()
+	index, err := newIndex(fsys, fmt.Sprintf("%020d.index", base), int64(4096), false)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer index.Close()
+
+	var position int64
+	for i, value := range values {
+		log.Write([]byte(value))
+		index.AddEntry(IndexEntry{base + int64(i), position, int64(len(value))})
+		position += int64(len(value))
+	}
+}
+
+func TestMigrateSegments(t *testing.T) {
+	fsys := NewMemFS()
+	writeUnframedSegment(t, fsys, 1, []string{"value-1", "value-2", "value-3"})
+	writeUnframedSegment(t, fsys, 4, []string{"value-4", "value-5"})
+	c := newConfig([]Option{WithFS(fsys)})
+	c.writeMetaData(MetaData{NextOffset: 6})
+
+	if _, err := ScanRecords(1, -1, func(Record) error { return nil }, WithFS(fsys)); err == nil {
+		t.Errorf("Expected unframed segments to be unreadable before migrating\n")
+	}
+
+	migrated, err := MigrateSegments(WithFS(fsys))
+	if err != nil || migrated != 5 {
+		t.Errorf("Expected 5 records migrated. Got %d %v\n", migrated, err)
+	}
+
+	// the migrated directory opens and takes new batches after the old values
+	eventQueue := make(chan Event, 10)
+	store, err := NewLogStore(eventQueue, WithFS(fsys))
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	store.Run()
+	putValues(t, eventQueue, 6, 7)
+	eventQueue <- Event{Terminate, nil, nil, nil}
+
+	next, err := ScanRecords(1, -1, func(record Record) error {
+		if expected := fmt.Sprintf("value-%d", record.Offset); string(record.Value) != expected {
+			t.Errorf("Expected %s. Got %s\n", expected, record.Value)
+		}
+		return nil
+	}, WithFS(fsys))
+	if err != nil || next != 8 {
+		t.Errorf("Expected to scan through 8. Got %d %v\n", next, err)
+	}
+
+	if migrated, err := MigrateSegments(WithFS(fsys)); err != nil || migrated != 0 {
+		t.Errorf("Expected nothing left to migrate. Got %d %v\n", migrated, err)
+	}
+}
+
+func TestMigrateSegments_DamagedBatch(t *testing.T) {
+	fsys := NewMemFS()
+	c := newConfig([]Option{WithFS(fsys)})
+	segment, err := c.openSegment(1, 4096, false)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	segment.Append([]byte("foo"))
+	segment.Append([]byte("bar"))
+	segment.Close()
+
+	// flip the last byte of the second batch so its checksum fails
+	name := "00000000000000000001.log"
+	log, _ := readFile(fsys, name)
+	log[len(log)-1] ^= 0xff
+	writeFile(fsys, name, log)
+
+	migrated, err := MigrateSegments(WithFS(fsys))
+	if err == nil || err.(LogStoreErr).ErrType != CorruptRecord || migrated != 0 {
+		t.Errorf("Expected CorruptRecord error. Got %d %v\n", migrated, err)
+	}
+
+	// the damaged batch was not wrapped as a value
+	after, _ := readFile(fsys, name)
+	if string(after) != string(log) {
+		t.Errorf("Expected the segment to be left as it was\n")
+	}
+}
@@ -0,0 +1,117 @@
+package logstore
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+type LifecycleType int
+
+const (
+	SegmentRolled LifecycleType = iota
+	SegmentDeleted
+	IndexResized
+	CorruptionDetected
+	MetaDataFlushed
+	SegmentUploaded
+	SegmentOffloaded
+)
+
+var lifecycleNames = []string{
+	"segment rolled",
+	"segment deleted",
+	"index resized",
+	"corruption detected",
+	"metadata flushed",
+	"segment uploaded",
+	"segment offloaded",
+}
+
+func (t LifecycleType) String() string {
+	if t < 0 || int(t) >= len(lifecycleNames) {
+		return fmt.Sprintf("LifecycleType(%d)", int(t))
+	}
+	return lifecycleNames[t]
+}
+
+// LifecycleEvent tells an Observer about something the store did.
+// Segment is the base offset of the segment concerned. A rolled segment
+// carries the offset the next segment starts at and the size of its log,
+// a resized index its new size in bytes, detected corruption the offset
+// being read and the error, a metadata flush the next offset written, and
+// an upload to remote storage the error it failed with, if any. A segment
+// is offloaded when its local copy is deleted after upload, and deleted
+// when it is gone everywhere.
+type LifecycleEvent struct {
+	Type    LifecycleType
+	Segment int64
+	Offset  int64
+	Size    int64
+	Err     error
+}
+
+// Observer receives lifecycle events. Observe is called on the goroutine
+// that caused the event, which is usually the event loop, so it must
+// return quickly. It can also be called from background metadata writes
+// and must be safe for concurrent use.
+type Observer interface {
+	Observe(LifecycleEvent)
+}
+
+// ObserverFunc lets an ordinary function be used as an Observer.
+type ObserverFunc func(LifecycleEvent)
+
+func (f ObserverFunc) Observe(e LifecycleEvent) {
+	f(e)
+}
+
+// ChannelObserver delivers lifecycle events on a buffered channel, so a
+// slow consumer never holds up the store. Events that arrive while the
+// buffer is full are dropped and counted.
+type ChannelObserver struct {
+	events  chan LifecycleEvent
+	dropped int64
+}
+
+func NewChannelObserver(size int) *ChannelObserver {
+	return &ChannelObserver{events: make(chan LifecycleEvent, size)}
+}
+
+func (o *ChannelObserver) Observe(e LifecycleEvent) {
+	select {
+	case o.events <- e:
+	default:
+		atomic.AddInt64(&o.dropped, 1)
+	}
+}
+
+// Events returns the channel lifecycle events are delivered on.
+func (o *ChannelObserver) Events() <-chan LifecycleEvent {
+	return o.events
+}
+
+// Dropped returns the number of events dropped because the buffer was
+// full.
+func (o *ChannelObserver) Dropped() int64 {
+	return atomic.LoadInt64(&o.dropped)
+}
+
+// WithObserver sends lifecycle events to o, after any observers added
+// before it.
+func WithObserver(o Observer) Option {
+	return func(c *Config) {
+		c.Observers = append(c.Observers, o)
+	}
+}
+
+func notify(observers []Observer, e LifecycleEvent) {
+	for _, o := range observers {
+		o.Observe(e)
+	}
+}
+
+// isCorrupt reports whether err says a segment's data is damaged.
+func isCorrupt(err error) bool {
+	lsErr, ok := err.(LogStoreErr)
+	return ok && (lsErr.ErrType == CorruptRecord || lsErr.ErrType == CorruptIndex)
+}
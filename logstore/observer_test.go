@@ -0,0 +1,160 @@
+package logstore
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// recorder collects lifecycle events for the tests to check.
+type recorder struct {
+	mu     sync.Mutex
+	events []LifecycleEvent
+}
+
+func (r *recorder) Observe(e LifecycleEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+func (r *recorder) ofType(t LifecycleType) []LifecycleEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var events []LifecycleEvent
+	for _, e := range r.events {
+		if e.Type == t {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+func TestObserver(t *testing.T) {
+	fsys := NewMemFS()
+	r := &recorder{}
+	ch := NewChannelObserver(1)
+	eventQueue := make(chan Event, 100)
+	store, err := NewLogStore(eventQueue, WithFS(fsys), WithObserver(r), WithObserver(ch))
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	store.Run()
+
+	pchan := make(chan Event, 1)
+	for i := 1; i <= 300; i++ {
+		eventQueue <- Event{Put, []byte(fmt.Sprintf("value-%d", i)), pchan, nil}
+		if err := (<-pchan).Error; err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+	eventQueue <- Event{FlushMetaData, nil, pchan, nil}
+	<-pchan
+	eventQueue <- Event{Terminate, nil, nil, nil}
+
+	bases, _ := Segments(WithFS(fsys))
+	rolled := r.ofType(SegmentRolled)
+	if len(rolled) != len(bases)-1 {
+		t.Fatalf("Expected %d rolls. Got %v\n", len(bases)-1, rolled)
+	}
+	for i, e := range rolled {
+		if e.Segment != bases[i] || e.Offset != bases[i+1] || e.Size == 0 {
+			t.Errorf("Expected segment %d to roll into %d. Got %v\n", bases[i], bases[i+1], e)
+		}
+	}
+
+	flushed := r.ofType(MetaDataFlushed)
+	if len(flushed) != 1 || flushed[0].Offset != 301 {
+		t.Errorf("Expected a flush at offset 301. Got %v\n", flushed)
+	}
+
+	if e := <-ch.Events(); e.Type != SegmentRolled || e.Segment != bases[0] {
+		t.Errorf("Expected the first roll on the channel. Got %v\n", e)
+	}
+	if int(ch.Dropped()) != len(rolled) {
+		t.Errorf("Expected %d dropped events. Got %d\n", len(rolled), ch.Dropped())
+	}
+}
+
+func TestObserver_IndexResized(t *testing.T) {
+	r := &recorder{}
+	c := newConfig([]Option{WithFS(NewMemFS()), WithObserver(r)})
+	segment, err := c.openSegment(1, 1<<20, false)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer segment.Close()
+
+	// the index starts with room for 4096 bytes of entries
+	for i := 0; i <= 4096/IndexItemWidth; i++ {
+		if _, err := segment.Append([]byte("foo")); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+
+	resized := r.ofType(IndexResized)
+	if len(resized) != 1 || resized[0].Segment != 1 || resized[0].Size != 4096*IndexItemWidth {
+		t.Errorf("Expected one resize of segment 1. Got %v\n", resized)
+	}
+}
+
+func TestObserver_CorruptionDetected(t *testing.T) {
+	fsys := NewMemFS()
+	r := &recorder{}
+	c := newConfig([]Option{WithFS(fsys), WithObserver(r)})
+	segment, err := c.openSegment(1, 4096, false)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	segment.Append([]byte("foo"))
+	segment.Append([]byte("bar"))
+	segment.Close()
+
+	// flip the last byte of the second record so reading it fails
+	name := "00000000000000000001.log"
+	log, _ := readFile(fsys, name)
+	log[len(log)-1] ^= 0xff
+	writeFile(fsys, name, log)
+
+	segment, err = c.openSegment(1, -1, true)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	_, err = segment.GetRecord(2)
+	segment.Close()
+
+	corrupt := r.ofType(CorruptionDetected)
+	if len(corrupt) != 1 || corrupt[0].Segment != 1 || corrupt[0].Offset != 2 || corrupt[0].Err != err {
+		t.Errorf("Expected corruption at offset 2. Got %v for %v\n", corrupt, err)
+	}
+
+	writeFile(fsys, name, log[:len(log)-1])
+	if err := Repair(WithFS(fsys), WithObserver(r)); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	corrupt = r.ofType(CorruptionDetected)
+	if len(corrupt) != 2 || corrupt[1].Offset != 2 {
+		t.Errorf("Expected repair to report offset 2. Got %v\n", corrupt)
+	}
+}
+
+func TestObserver_SegmentDeleted(t *testing.T) {
+	fsys := NewMemFS()
+	r := &recorder{}
+	c := newConfig([]Option{WithFS(fsys), WithObserver(ObserverFunc(r.Observe))})
+	segment, err := c.openSegment(1, 4096, false)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	segment.Close()
+
+	c.removeSegment(segment.Name)
+	if bases, _ := c.segments(); len(bases) != 0 {
+		t.Errorf("Expected no segments. Got %v\n", bases)
+	}
+	deleted := r.ofType(SegmentDeleted)
+	if len(deleted) != 1 || deleted[0].Segment != 1 {
+		t.Errorf("Expected segment 1 to be deleted. Got %v\n", deleted)
+	}
+}
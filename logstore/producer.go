@@ -0,0 +1,132 @@
+package logstore
+
+import "fmt"
+
+// producerWindow is how many recent batches are remembered per producer.
+// Retries of anything older are rejected rather than answered with their
+// original offset.
+const producerWindow = 5
+
+// ProducerState tracks the sequence numbers a producer has written so
+// retried appends can be recognised.
+type ProducerState struct {
+	LastSequence int64
+	Recent       []SequenceOffset
+}
+
+// SequenceOffset is a batch a producer wrote: the sequence number and
+// offset of its first record and how many records it held. Metadata
+// written before batches leaves Count zero, meaning one.
+type SequenceOffset struct {
+	Sequence int64
+	Offset   int64
+	Count    int64 `json:",omitempty"`
+}
+
+func (s SequenceOffset) count() int64 {
+	if s.Count == 0 {
+		return 1
+	}
+	return s.Count
+}
+
+// checkSequence returns the offset a retried batch was originally written
+// at, or -1 when the batch is new and should be appended. The records are
+// from one producer with consecutive sequence numbers. A producer's first
+// record has sequence number 1.
+func (m *MetaData) checkSequence(records []Record) (int64, error) {
+	record := records[0]
+	if record.ProducerID <= 0 || record.ProducerID > m.NextProducerID {
+		return -1, NewLogStoreErr(
+			UnknownProducer,
+			fmt.Sprintf("producer %d was never issued", record.ProducerID),
+			nil,
+		)
+	}
+	state := m.Producers[record.ProducerID]
+
+	switch {
+	case record.Sequence == state.LastSequence+1:
+		return -1, nil
+	case record.Sequence > state.LastSequence:
+		return -1, NewLogStoreErr(
+			OutOfOrderSequence,
+			fmt.Sprintf(
+				"producer %d sent sequence %d, expected %d",
+				record.ProducerID,
+				record.Sequence,
+				state.LastSequence+1,
+			),
+			nil,
+		)
+	}
+
+	for _, recent := range state.Recent {
+		if recent.Sequence == record.Sequence && recent.count() == int64(len(records)) {
+			return recent.Offset, nil
+		}
+	}
+	return -1, NewLogStoreErr(
+		DuplicateSequence,
+		fmt.Sprintf(
+			"producer %d sequence %d does not start one of the last %d batches",
+			record.ProducerID,
+			record.Sequence,
+			producerWindow,
+		),
+		nil,
+	)
+}
+
+// recordSequence remembers a batch written at offset.
+func (m *MetaData) recordSequence(records []Record, offset int64) {
+	if m.Producers == nil {
+		m.Producers = map[int64]ProducerState{}
+	}
+
+	record, count := records[0], int64(len(records))
+	state := m.Producers[record.ProducerID]
+	state.LastSequence = record.Sequence + count - 1
+	state.Recent = append(state.Recent, SequenceOffset{record.Sequence, offset, count})
+	if len(state.Recent) > producerWindow {
+		state.Recent = state.Recent[len(state.Recent)-producerWindow:]
+	}
+	m.Producers[record.ProducerID] = state
+}
+
+// replayProducer brings the producer state up to date with a batch read
+// back from the log, so producer IDs and sequence numbers the metadata
+// lost track of are never handed out or accepted again. Batches the
+// metadata already accounts for are left alone.
+func (m *MetaData) replayProducer(records []Record) {
+	first := records[0]
+	if first.ProducerID == 0 || first.Control != 0 {
+		return
+	}
+	if first.ProducerID > m.NextProducerID {
+		m.NextProducerID = first.ProducerID
+	}
+	if first.Sequence > m.Producers[first.ProducerID].LastSequence {
+		m.recordSequence(records, first.Offset)
+	}
+}
+
+// copy returns metadata that can be handed to another goroutine.
+func (m MetaData) copy() MetaData {
+	producers := make(map[int64]ProducerState, len(m.Producers))
+	for id, state := range m.Producers {
+		state.Recent = append([]SequenceOffset(nil), state.Recent...)
+		producers[id] = state
+	}
+	m.Producers = producers
+
+	if m.Transactions != nil {
+		transactions := make(map[int64]int64, len(m.Transactions))
+		for id, first := range m.Transactions {
+			transactions[id] = first
+		}
+		m.Transactions = transactions
+	}
+	m.Aborted = append([]AbortedTransaction(nil), m.Aborted...)
+	return m
+}
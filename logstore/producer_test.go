@@ -0,0 +1,296 @@
+package logstore
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func initProducer(t *testing.T, eventQueue chan Event, pchan chan Event) int64 {
+	eventQueue <- Event{InitProducer, nil, pchan, nil}
+	response := <-pchan
+	if response.Error != nil {
+		t.Fatalf("%v\n", response.Error)
+	}
+	id, _ := binary.Varint(response.Data)
+	return id
+}
+
+func putSequence(eventQueue chan Event, pchan chan Event, producer, sequence int64) (int64, error) {
+	record := Record{
+		Value:      []byte("foo"),
+		ProducerID: producer,
+		Sequence:   sequence,
+	}
+	data, _ := record.MarshalBinary()
+	eventQueue <- Event{PutRecord, data, pchan, nil}
+	response := <-pchan
+	offset, _ := binary.Varint(response.Data)
+	return offset, response.Error
+}
+
+func TestLogStore_InitProducer(t *testing.T) {
+	eventQueue := make(chan Event, 1000)
+	store, _ := NewLogStore(eventQueue)
+	store.Run()
+
+	pchan := make(chan Event, 10)
+	first := initProducer(t, eventQueue, pchan)
+	second := initProducer(t, eventQueue, pchan)
+	if first == 0 || first == second {
+		t.Errorf("Expected distinct non-zero producer IDs. Got %d and %d\n", first, second)
+	}
+
+	eventQueue <- Event{Terminate, nil, nil, nil}
+	close(pchan)
+	close(eventQueue)
+	removeTestFiles()
+}
+
+func TestLogStore_Producer_Duplicate(t *testing.T) {
+	eventQueue := make(chan Event, 1000)
+	store, _ := NewLogStore(eventQueue)
+	store.Run()
+
+	pchan := make(chan Event, 10)
+	producer := initProducer(t, eventQueue, pchan)
+	for sequence := int64(1); sequence <= 10; sequence++ {
+		offset, err := putSequence(eventQueue, pchan, producer, sequence)
+		if err != nil {
+			t.Errorf("%v\n", err)
+		}
+		if offset != sequence {
+			t.Errorf("Expected offset %d. Got %d\n", sequence, offset)
+		}
+	}
+
+	// a retry within the window is acknowledged with its original offset
+	offset, err := putSequence(eventQueue, pchan, producer, 8)
+	if err != nil {
+		t.Errorf("%v\n", err)
+	}
+	if offset != 8 {
+		t.Errorf("Expected offset %d. Got %d\n", 8, offset)
+	}
+
+	_, err = putSequence(eventQueue, pchan, producer, 2)
+	if err == nil || err.(LogStoreErr).ErrType != DuplicateSequence {
+		t.Errorf("Expected DuplicateSequence error. Got %v\n", err)
+	}
+
+	_, err = putSequence(eventQueue, pchan, producer, 12)
+	if err == nil || err.(LogStoreErr).ErrType != OutOfOrderSequence {
+		t.Errorf("Expected OutOfOrderSequence error. Got %v\n", err)
+	}
+
+	if store.MetaData.NextOffset != 11 {
+		t.Errorf("Expected next offset to be %d. Got %d\n", 11, store.MetaData.NextOffset)
+	}
+
+	eventQueue <- Event{Terminate, nil, nil, nil}
+	close(pchan)
+	close(eventQueue)
+	removeTestFiles()
+}
+
+func TestLogStore_Producer_BootFromMetaData(t *testing.T) {
+	eventQueue := make(chan Event, 1000)
+	store, _ := NewLogStore(eventQueue)
+	store.Run()
+
+	pchan := make(chan Event, 10)
+	producer := initProducer(t, eventQueue, pchan)
+	for sequence := int64(1); sequence <= 3; sequence++ {
+		putSequence(eventQueue, pchan, producer, sequence)
+	}
+	eventQueue <- Event{FlushMetaData, nil, pchan, nil}
+	<-pchan
+	eventQueue <- Event{Terminate, nil, nil, nil}
+	close(eventQueue)
+
+	eventQueue = make(chan Event, 1000)
+	store, _ = NewLogStore(eventQueue)
+	store.Run()
+
+	offset, err := putSequence(eventQueue, pchan, producer, 3)
+	if err != nil || offset != 3 {
+		t.Errorf("Expected retry to return offset %d. Got %d %v\n", 3, offset, err)
+	}
+	if next := initProducer(t, eventQueue, pchan); next == producer {
+		t.Errorf("Expected a new producer ID. Got %d again\n", next)
+	}
+
+	eventQueue <- Event{Terminate, nil, nil, nil}
+	close(pchan)
+	close(eventQueue)
+	removeTestFiles()
+}
+
+func TestRecord_MarshalBinary_Producer(t *testing.T) {
+	expected := Record{Value: []byte("foo"), ProducerID: 7, Sequence: 42}
+	data, _ := expected.MarshalBinary()
+
+	var got Record
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Errorf("%v\n", err)
+	}
+	if got.ProducerID != expected.ProducerID || got.Sequence != expected.Sequence {
+		t.Errorf("Expected:%v Got:%v\n", expected, got)
+	}
+}
+
+func TestLogStore_Producer_Batch(t *testing.T) {
+	fsys := NewMemFS()
+	eventQueue := make(chan Event, 10)
+	store, _ := NewLogStore(eventQueue, WithFS(fsys))
+	store.Run()
+
+	pchan := make(chan Event, 1)
+	producer := initProducer(t, eventQueue, pchan)
+	batch := func(first, count int64) []Record {
+		var records []Record
+		for i := int64(0); i < count; i++ {
+			records = append(records, Record{Value: []byte("foo"), ProducerID: producer, Sequence: first + i})
+		}
+		return records
+	}
+
+	if offset, err := putRecords(eventQueue, pchan, batch(1, 3)); err != nil || offset != 1 {
+		t.Errorf("Expected batch at 1. Got %d %v\n", offset, err)
+	}
+	if offset, err := putRecords(eventQueue, pchan, batch(4, 3)); err != nil || offset != 4 {
+		t.Errorf("Expected batch at 4. Got %d %v\n", offset, err)
+	}
+
+	// a retried batch is acknowledged with its original offset
+	if offset, err := putRecords(eventQueue, pchan, batch(1, 3)); err != nil || offset != 1 {
+		t.Errorf("Expected retry acknowledged at 1. Got %d %v\n", offset, err)
+	}
+
+	_, err := putRecords(eventQueue, pchan, batch(2, 3))
+	if err == nil || err.(LogStoreErr).ErrType != DuplicateSequence {
+		t.Errorf("Expected DuplicateSequence error. Got %v\n", err)
+	}
+
+	gap := append(batch(7, 2), batch(10, 1)...)
+	_, err = putRecords(eventQueue, pchan, gap)
+	if err == nil || err.(LogStoreErr).ErrType != OutOfOrderSequence {
+		t.Errorf("Expected OutOfOrderSequence error. Got %v\n", err)
+	}
+
+	// a single record retry still finds its batch of one
+	if offset, err := putSequence(eventQueue, pchan, producer, 7); err != nil || offset != 7 {
+		t.Errorf("Expected record at 7. Got %d %v\n", offset, err)
+	}
+	if offset, err := putSequence(eventQueue, pchan, producer, 7); err != nil || offset != 7 {
+		t.Errorf("Expected retry acknowledged at 7. Got %d %v\n", offset, err)
+	}
+
+	eventQueue <- Event{FlushMetaData, nil, pchan, nil}
+	<-pchan
+	eventQueue <- Event{Terminate, nil, nil, nil}
+	if metadata, _ := ReadMetaData(WithFS(fsys)); metadata.NextOffset != 8 {
+		t.Errorf("Expected next offset 8. Got %d\n", metadata.NextOffset)
+	}
+}
+
+func TestLogStore_Producer_Unknown(t *testing.T) {
+	eventQueue := make(chan Event, 10)
+	store, _ := NewLogStore(eventQueue, WithFS(NewMemFS()))
+	store.Run()
+
+	pchan := make(chan Event, 1)
+	_, err := putSequence(eventQueue, pchan, 42, 1)
+	if err == nil || err.(LogStoreErr).ErrType != UnknownProducer {
+		t.Errorf("Expected UnknownProducer error. Got %v\n", err)
+	}
+
+	// a new producer starts at sequence 1
+	producer := initProducer(t, eventQueue, pchan)
+	_, err = putSequence(eventQueue, pchan, producer, 3)
+	if err == nil || err.(LogStoreErr).ErrType != OutOfOrderSequence {
+		t.Errorf("Expected OutOfOrderSequence error. Got %v\n", err)
+	}
+	if _, err := putSequence(eventQueue, pchan, producer, 1); err != nil {
+		t.Errorf("%v\n", err)
+	}
+
+	eventQueue <- Event{Terminate, nil, nil, nil}
+}
+
+func TestLogStore_InitProducer_Durable(t *testing.T) {
+	fsys := NewMemFS()
+	eventQueue := make(chan Event, 10)
+	store, _ := NewLogStore(eventQueue, WithFS(fsys))
+	store.Run()
+
+	pchan := make(chan Event, 1)
+	first := initProducer(t, eventQueue, pchan)
+	eventQueue <- Event{Terminate, nil, nil, nil}
+
+	// nothing else was flushed before the store went away
+	eventQueue = make(chan Event, 10)
+	store, _ = NewLogStore(eventQueue, WithFS(fsys))
+	store.Run()
+	if second := initProducer(t, eventQueue, pchan); second == first {
+		t.Errorf("Expected a new producer ID after restart. Got %d twice\n", first)
+	}
+	eventQueue <- Event{Terminate, nil, nil, nil}
+}
+
+func TestLogStore_InitProducer_PowerLoss(t *testing.T) {
+	fsys := NewFaultFS(NewMemFS())
+	eventQueue := make(chan Event, 10)
+	store, _ := NewLogStore(eventQueue, WithFS(fsys))
+	store.Run()
+
+	pchan := make(chan Event, 1)
+	first := initProducer(t, eventQueue, pchan)
+	eventQueue <- Event{Terminate, nil, nil, nil}
+	fsys.PowerLoss()
+
+	eventQueue = make(chan Event, 10)
+	store, _ = NewLogStore(eventQueue, WithFS(fsys))
+	store.Run()
+	if second := initProducer(t, eventQueue, pchan); second == first {
+		t.Errorf("Expected a new producer ID after power loss. Got %d twice\n", first)
+	}
+	eventQueue <- Event{Terminate, nil, nil, nil}
+}
+
+func TestLogStore_Producer_RebuiltFromLog(t *testing.T) {
+	fsys := NewMemFS()
+	eventQueue := make(chan Event, 10)
+	store, _ := NewLogStore(eventQueue, WithFS(fsys))
+	store.Run()
+
+	pchan := make(chan Event, 1)
+	producer := initProducer(t, eventQueue, pchan)
+	for sequence := int64(1); sequence <= 3; sequence++ {
+		if _, err := putSequence(eventQueue, pchan, producer, sequence); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+	eventQueue <- Event{FlushMetaData, nil, pchan, nil}
+	<-pchan
+	eventQueue <- Event{Terminate, nil, nil, nil}
+
+	// metadata that lost track of the producer
+	c := newConfig([]Option{WithFS(fsys)})
+	metadata, _ := c.readMetaData()
+	c.writeMetaData(MetaData{NextOffset: metadata.NextOffset})
+
+	eventQueue = make(chan Event, 10)
+	store, _ = NewLogStore(eventQueue, WithFS(fsys))
+	store.Run()
+
+	if offset, err := putSequence(eventQueue, pchan, producer, 3); err != nil || offset != 3 {
+		t.Errorf("Expected retry acknowledged at 3. Got %d %v\n", offset, err)
+	}
+	if offset, err := putSequence(eventQueue, pchan, producer, 4); err != nil || offset != 4 {
+		t.Errorf("Expected record at 4. Got %d %v\n", offset, err)
+	}
+	if next := initProducer(t, eventQueue, pchan); next <= producer {
+		t.Errorf("Expected a producer ID after %d. Got %d\n", producer, next)
+	}
+	eventQueue <- Event{Terminate, nil, nil, nil}
+}
@@ -0,0 +1,284 @@
+package logstore
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// errStopScan ends a scan early without reporting an error.
+var errStopScan = errors.New("stop scan")
+
+// Queue consumes the log as a job queue. Each record is leased to one
+// worker at a time and is redelivered when the worker nacks it or its
+// lease expires before an ack. A record that fails MaxDeliveries times is
+// appended to the dead letter store through its event queue, DeadLetters,
+// with a header naming the offset it came from.
+//
+// The lease state is synced to <name>.queue on every change, so a
+// restarted queue redelivers whatever was leased but never acked. Dead
+// letters are written by an idempotent producer whose sequence only
+// advances once the lease is dropped, so a dead letter repeated after a
+// crash is acknowledged by the store instead of appended twice.
+type Queue struct {
+	Config
+	Name              string
+	VisibilityTimeout time.Duration
+	MaxDeliveries     int
+	DeadLetters       chan<- Event
+
+	mu        sync.Mutex
+	state     queueState
+	responses chan Event
+}
+
+// DeadLetterOffsetHeader holds the offset a dead letter was read from.
+const DeadLetterOffsetHeader = "dead-letter-offset"
+
+// Delivery is a leased record, the ID of the lease to ack or nack it with
+// and the number of times it has been leased, counting this one.
+type Delivery struct {
+	Record   Record
+	LeaseID  int64
+	Attempts int
+}
+
+type queueState struct {
+	// Next is the first offset never leased.
+	Next        int64
+	NextLeaseID int64
+	Leases      map[int64]*Lease
+
+	DeadLetterProducer int64
+	DeadLetterSequence int64
+}
+
+// Lease tracks a record handed to a worker. Every delivery gets a new ID,
+// so a worker whose lease lapsed cannot ack or nack the record after it
+// has been handed to another. Nacked leases expire at once.
+type Lease struct {
+	ID       int64
+	Attempts int
+	Expires  time.Time
+}
+
+// OpenQueue loads the queue state saved under name, or starts leasing from
+// the beginning of the log, registering a producer with the dead letter
+// store the first time it is opened. Options apply to reading the log.
+func OpenQueue(name string, visibilityTimeout time.Duration, maxDeliveries int, deadLetters chan<- Event, opts ...Option) (*Queue, error) {
+	q := &Queue{
+		Config:            newConfig(opts),
+		Name:              name,
+		VisibilityTimeout: visibilityTimeout,
+		MaxDeliveries:     maxDeliveries,
+		DeadLetters:       deadLetters,
+		state: queueState{
+			Next:               1,
+			NextLeaseID:        1,
+			Leases:             map[int64]*Lease{},
+			DeadLetterSequence: 1,
+		},
+		responses: make(chan Event, 1),
+	}
+
+	data, err := readFile(q.fs(), q.stateName())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &q.state); err != nil {
+			return nil, fmt.Errorf("invalid queue state: %v", err)
+		}
+	}
+	if q.state.Leases == nil {
+		q.state.Leases = map[int64]*Lease{}
+	}
+
+	if q.state.DeadLetterProducer == 0 {
+		q.DeadLetters <- Event{InitProducer, nil, q.responses, nil}
+		response := <-q.responses
+		if response.Error != nil {
+			return nil, response.Error
+		}
+		q.state.DeadLetterProducer, _ = binary.Varint(response.Data)
+		if err := q.save(); err != nil {
+			return nil, err
+		}
+	}
+
+	return q, nil
+}
+
+// Lease hands out the oldest record whose lease has expired, or else the
+// next record the store has flushed. It reports false when there is
+// nothing to hand out.
+func (q *Queue) Lease() (Delivery, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := now(q.Clock)
+	for _, offset := range q.expired(now) {
+		lease := q.state.Leases[offset]
+		record, err := q.getFromClosedSegment(offset)
+		if gone(err) || err == nil && record.Expired(now) {
+			// nothing is left to redeliver
+			delete(q.state.Leases, offset)
+			if err := q.save(); err != nil {
+				return Delivery{}, false, err
+			}
+			continue
+		}
+		if err != nil {
+			return Delivery{}, false, err
+		}
+
+		if lease.Attempts >= q.MaxDeliveries {
+			if err := q.deadLetter(record); err != nil {
+				return Delivery{}, false, err
+			}
+			continue
+		}
+
+		lease.ID = q.newLeaseID()
+		lease.Attempts++
+		lease.Expires = now.Add(q.VisibilityTimeout)
+		return Delivery{record, lease.ID, lease.Attempts}, true, q.save()
+	}
+
+	var delivery Delivery
+	var found bool
+	next, err := q.scanFlushed(q.state.Next, -1, func(record Record) error {
+		if record.Control != 0 {
+			return nil
+		}
+		delivery, found = Delivery{record, 0, 1}, true
+		return errStopScan
+	})
+	if err != nil && err != errStopScan {
+		return Delivery{}, false, err
+	}
+
+	q.state.Next = next
+	if found {
+		q.state.Next = delivery.Record.Offset + 1
+		delivery.LeaseID = q.newLeaseID()
+		q.state.Leases[delivery.Record.Offset] = &Lease{delivery.LeaseID, 1, now.Add(q.VisibilityTimeout)}
+	}
+	return delivery, found, q.save()
+}
+
+// Ack marks the record at offset done, provided leaseID still holds it.
+func (q *Queue) Ack(offset, leaseID int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, err := q.lease(offset, leaseID); err != nil {
+		return err
+	}
+	delete(q.state.Leases, offset)
+	return q.save()
+}
+
+// Nack gives the record at offset up for redelivery straight away,
+// provided leaseID still holds it.
+func (q *Queue) Nack(offset, leaseID int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	lease, err := q.lease(offset, leaseID)
+	if err != nil {
+		return err
+	}
+	lease.Expires = time.Time{}
+	return q.save()
+}
+
+// lease returns the lease on offset if it is the one with leaseID.
+func (q *Queue) lease(offset, leaseID int64) (*Lease, error) {
+	lease, ok := q.state.Leases[offset]
+	if !ok || lease.ID != leaseID {
+		return nil, leaseErr(offset, leaseID)
+	}
+	return lease, nil
+}
+
+func (q *Queue) newLeaseID() int64 {
+	id := q.state.NextLeaseID
+	q.state.NextLeaseID++
+	return id
+}
+
+// Leased returns the number of records leased and not yet acked.
+func (q *Queue) Leased() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.state.Leases)
+}
+
+// expired returns the offsets of expired leases in ascending order.
+func (q *Queue) expired(now time.Time) []int64 {
+	var offsets []int64
+	for offset, lease := range q.state.Leases {
+		if !lease.Expires.After(now) {
+			offsets = append(offsets, offset)
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	return offsets
+}
+
+// deadLetter appends record to the dead letter store before dropping its
+// lease.
+func (q *Queue) deadLetter(record Record) error {
+	letter := NewExportRecord(record).Record()
+	letter.Offset = 0
+	letter.Headers = append(letter.Headers, Header{
+		DeadLetterOffsetHeader,
+		[]byte(strconv.FormatInt(record.Offset, 10)),
+	})
+	letter.ProducerID = q.state.DeadLetterProducer
+	letter.Sequence = q.state.DeadLetterSequence
+
+	data, err := letter.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	q.DeadLetters <- Event{PutRecord, data, q.responses, nil}
+	if err := (<-q.responses).Error; err != nil {
+		return err
+	}
+
+	q.state.DeadLetterSequence++
+	delete(q.state.Leases, record.Offset)
+	return q.save()
+}
+
+func (q *Queue) save() error {
+	return writeJSONSync(q.fs(), q.stateName(), q.state)
+}
+
+// gone reports whether err means a leased record was compacted away or
+// removed with its segment.
+func gone(err error) bool {
+	lsErr, ok := err.(LogStoreErr)
+	return ok && (lsErr.ErrType == RecordExpired || lsErr.ErrType == OffsetNotFound)
+}
+
+func leaseErr(offset, leaseID int64) error {
+	return NewLogStoreErr(
+		LeaseNotFound,
+		fmt.Sprintf("offset %d is not held by lease %d", offset, leaseID),
+		nil,
+	)
+}
+
+func (q *Queue) stateName() string {
+	return fmt.Sprintf("%s.queue", q.Name)
+}
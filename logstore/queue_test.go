@@ -0,0 +1,177 @@
+package logstore
+
+import (
+	"testing"
+	"time"
+)
+
+// startDeadLetterStore runs an in-memory store for a queue's dead letters.
+func startDeadLetterStore(t *testing.T) (chan Event, *MemFS) {
+	fsys := NewMemFS()
+	eventQueue := make(chan Event, 100)
+	store, err := NewLogStore(eventQueue, WithFS(fsys))
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	store.Run()
+	return eventQueue, fsys
+}
+
+func TestQueue_LeaseAck(t *testing.T) {
+	eventQueue := make(chan Event, 1000)
+	store, _ := NewLogStore(eventQueue)
+	store.Run()
+
+	pchan := make(chan Event, 10)
+	for _, value := range []string{"job-1", "job-2"} {
+		eventQueue <- Event{Put, []byte(value), pchan, nil}
+		<-pchan
+	}
+
+	eventQueue <- Event{FlushMetaData, nil, pchan, nil}
+	<-pchan
+
+	deadLetters, _ := startDeadLetterStore(t)
+	queue, _ := OpenQueue("jobs", time.Minute, 3, deadLetters)
+	first, ok, err := queue.Lease()
+	if err != nil || !ok || string(first.Record.Value) != "job-1" || first.Attempts != 1 {
+		t.Errorf("Expected first delivery of job-1. Got %v %v %v\n", first, ok, err)
+	}
+	second, _, _ := queue.Lease()
+	if string(second.Record.Value) != "job-2" {
+		t.Errorf("Expected job-2. Got %s\n", second.Record.Value)
+	}
+	if _, ok, _ := queue.Lease(); ok {
+		t.Errorf("Expected nothing left to lease\n")
+	}
+
+	err = queue.Ack(first.Record.Offset, second.LeaseID)
+	if err == nil || err.(LogStoreErr).ErrType != LeaseNotFound {
+		t.Errorf("Expected LeaseNotFound error for another lease. Got %v\n", err)
+	}
+	if err := queue.Ack(first.Record.Offset, first.LeaseID); err != nil {
+		t.Errorf("%v\n", err)
+	}
+	err = queue.Ack(first.Record.Offset, first.LeaseID)
+	if err == nil || err.(LogStoreErr).ErrType != LeaseNotFound {
+		t.Errorf("Expected LeaseNotFound error. Got %v\n", err)
+	}
+	if queue.Leased() != 1 {
+		t.Errorf("Expected %d leased record. Got %d\n", 1, queue.Leased())
+	}
+
+	// the unacked lease survives a restart
+	queue, _ = OpenQueue("jobs", time.Minute, 3, deadLetters)
+	if queue.Leased() != 1 {
+		t.Errorf("Expected %d leased record after reopening. Got %d\n", 1, queue.Leased())
+	}
+
+	deadLetters <- Event{Terminate, nil, nil, nil}
+	eventQueue <- Event{Terminate, nil, nil, nil}
+	close(pchan)
+	close(eventQueue)
+	removeTestFiles()
+}
+
+func TestQueue_Redelivery(t *testing.T) {
+	eventQueue := make(chan Event, 1000)
+	store, _ := NewLogStore(eventQueue)
+	store.Run()
+
+	pchan := make(chan Event, 10)
+	eventQueue <- Event{Put, []byte("job-1"), pchan, nil}
+	<-pchan
+	eventQueue <- Event{FlushMetaData, nil, pchan, nil}
+	<-pchan
+
+	deadLetters, fsys := startDeadLetterStore(t)
+	queue, _ := OpenQueue("jobs", time.Minute, 3, deadLetters)
+	delivery, _, _ := queue.Lease()
+	queue.Nack(delivery.Record.Offset, delivery.LeaseID)
+
+	delivery, ok, _ := queue.Lease()
+	if !ok || delivery.Attempts != 2 {
+		t.Errorf("Expected second delivery after nack. Got %v %v\n", delivery, ok)
+	}
+
+	// let the visibility timeout lapse
+	lapsed := delivery
+	queue.state.Leases[delivery.Record.Offset].Expires = time.Now().Add(-time.Second)
+	delivery, ok, _ = queue.Lease()
+	if !ok || delivery.Attempts != 3 {
+		t.Errorf("Expected third delivery after timeout. Got %v %v\n", delivery, ok)
+	}
+
+	// the worker whose lease lapsed can no longer settle the record
+	err := queue.Nack(lapsed.Record.Offset, lapsed.LeaseID)
+	if err == nil || err.(LogStoreErr).ErrType != LeaseNotFound {
+		t.Errorf("Expected LeaseNotFound error for the lapsed lease. Got %v\n", err)
+	}
+
+	queue.Nack(delivery.Record.Offset, delivery.LeaseID)
+	if _, ok, _ := queue.Lease(); ok {
+		t.Errorf("Expected the exhausted record to be dead lettered\n")
+	}
+	if queue.Leased() != 0 {
+		t.Errorf("Expected no leased records. Got %d\n", queue.Leased())
+	}
+
+	deadLetters <- Event{FlushMetaData, nil, pchan, nil}
+	<-pchan
+	var letters []Record
+	ScanRecords(1, -1, func(record Record) error {
+		letters = append(letters, record)
+		return nil
+	}, WithFS(fsys))
+	if len(letters) != 1 || string(letters[0].Value) != "job-1" {
+		t.Fatalf("Expected job-1 in the dead letter store. Got %v\n", letters)
+	}
+	if h := letters[0].Headers; len(h) != 1 || h[0].Key != DeadLetterOffsetHeader || string(h[0].Value) != "1" {
+		t.Errorf("Expected the dead letter to name offset 1. Got %v\n", h)
+	}
+
+	deadLetters <- Event{Terminate, nil, nil, nil}
+	eventQueue <- Event{Terminate, nil, nil, nil}
+	close(pchan)
+	close(eventQueue)
+	removeTestFiles()
+}
+
+func TestQueue_LeaseExpiredRecord(t *testing.T) {
+	clock := NewManualClock(time.Unix(1546300800, 0))
+	eventQueue := make(chan Event, 1000)
+	store, _ := NewLogStore(eventQueue, WithClock(clock))
+	store.Run()
+
+	pchan := make(chan Event, 10)
+	record := Record{Value: []byte("job-1"), ExpiresAt: millis(clock.Now().Add(time.Minute))}
+	data, _ := record.MarshalBinary()
+	eventQueue <- Event{PutRecord, data, pchan, nil}
+	<-pchan
+	eventQueue <- Event{Put, []byte("job-2"), pchan, nil}
+	<-pchan
+	eventQueue <- Event{FlushMetaData, nil, pchan, nil}
+	<-pchan
+
+	deadLetters, _ := startDeadLetterStore(t)
+	queue, _ := OpenQueue("jobs", 30*time.Second, 3, deadLetters, WithClock(clock))
+	if delivery, _, _ := queue.Lease(); string(delivery.Record.Value) != "job-1" {
+		t.Fatalf("Expected job-1. Got %s\n", delivery.Record.Value)
+	}
+
+	// the lease lapses after its record has expired
+	clock.Advance(2 * time.Minute)
+	delivery, ok, err := queue.Lease()
+	if err != nil || !ok || string(delivery.Record.Value) != "job-2" {
+		t.Errorf("Expected the expired lease to be dropped and job-2 leased. Got %v %v %v\n", delivery, ok, err)
+	}
+	if queue.Leased() != 1 {
+		t.Errorf("Expected %d leased record. Got %d\n", 1, queue.Leased())
+	}
+
+	deadLetters <- Event{Terminate, nil, nil, nil}
+	eventQueue <- Event{Terminate, nil, nil, nil}
+	close(pchan)
+	close(eventQueue)
+	removeTestFiles()
+}
@@ -0,0 +1,487 @@
+package logstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// batchMagic 2 batches hold bare values and are still read. Magic 3
+// batches hold records with keys, headers and timestamps.
+const (
+	legacyBatchMagic = 2
+	batchMagic       = 3
+)
+
+const logAppendTimeAttr = 0x20
+
+// BatchHeaderWidth is the size of the fixed header written in front of
+// every record batch in a log file.
+const BatchHeaderWidth = 18
+
+// BatchHeader precedes the records appended by a single call to
+// LogSegment.AppendBatch. Every index entry for the batch points at the
+// header. The CRC covers the body as stored, after compression and
+// encryption. Optional headers follow it in attribute bit order.
+type BatchHeader struct {
+	Magic      uint8
+	Attributes uint8
+	BaseOffset int64
+	Count      uint32
+	CRC        uint32
+}
+
+func (h *BatchHeader) Codec() uint8 {
+	return h.Attributes & codecMask
+}
+
+// Record is a single entry in the log. Timestamps are milliseconds since
+// the epoch, either set by the producer or, in log append time mode, by
+// the segment as the record is written. Records from idempotent producers
+// carry a non-zero ProducerID and a Sequence that increases by one with
+// every record the producer sends. Records written inside a transaction
+// are Transactional, and the marker ending the transaction is a record
+// with a Control type and no payload. A record with ExpiresAt set, in
+// milliseconds since the epoch, is hidden from reads from then on and
+// dropped by Compact.
+type Record struct {
+	Offset        int64
+	Timestamp     int64
+	Key           []byte
+	Headers       []Header
+	Value         []byte
+	ProducerID    int64
+	Sequence      int64
+	Transactional bool
+	Control       ControlType
+	ExpiresAt     int64
+}
+
+const (
+	producerRecordAttr      = 0x01
+	transactionalRecordAttr = 0x02
+	controlRecordAttr       = 0x04
+	expiringRecordAttr      = 0x08
+	recordAttrMask          = producerRecordAttr | transactionalRecordAttr |
+		controlRecordAttr | expiringRecordAttr
+)
+
+// Expired reports whether the record has expired at now.
+func (r *Record) Expired(now time.Time) bool {
+	return r.ExpiresAt != 0 && r.ExpiresAt <= millis(now)
+}
+
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// MarshalBinary encodes everything but the offset, which is implied by the
+// record's position in the log. The layout is an attributes byte, a varint
+// timestamp, the varint producer ID and sequence when the producer
+// attribute is set, the control type byte when the control attribute is
+// set, the varint expiry time when the expiring attribute is set, a
+// uvarint key length plus one with zero meaning no key,
+// a uvarint header count followed by length prefixed header keys and
+// values, and finally the value.
+func (r *Record) MarshalBinary() ([]byte, error) {
+	buff := new(bytes.Buffer)
+	scratch := make([]byte, binary.MaxVarintLen64)
+	putUvarint := func(v uint64) {
+		buff.Write(scratch[:binary.PutUvarint(scratch, v)])
+	}
+
+	var attributes byte
+	if r.ProducerID != 0 {
+		attributes |= producerRecordAttr
+	}
+	if r.Transactional {
+		attributes |= transactionalRecordAttr
+	}
+	if r.Control != 0 {
+		attributes |= controlRecordAttr
+	}
+	if r.ExpiresAt != 0 {
+		attributes |= expiringRecordAttr
+	}
+	buff.WriteByte(attributes)
+	buff.Write(scratch[:binary.PutVarint(scratch, r.Timestamp)])
+	if r.ProducerID != 0 {
+		buff.Write(scratch[:binary.PutVarint(scratch, r.ProducerID)])
+		buff.Write(scratch[:binary.PutVarint(scratch, r.Sequence)])
+	}
+	if r.Control != 0 {
+		buff.WriteByte(byte(r.Control))
+	}
+	if r.ExpiresAt != 0 {
+		buff.Write(scratch[:binary.PutVarint(scratch, r.ExpiresAt)])
+	}
+
+	if r.Key == nil {
+		putUvarint(0)
+	} else {
+		putUvarint(uint64(len(r.Key)) + 1)
+		buff.Write(r.Key)
+	}
+
+	putUvarint(uint64(len(r.Headers)))
+	for _, h := range r.Headers {
+		putUvarint(uint64(len(h.Key)))
+		buff.WriteString(h.Key)
+		putUvarint(uint64(len(h.Value)))
+		buff.Write(h.Value)
+	}
+
+	buff.Write(r.Value)
+	return buff.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a record encoded by MarshalBinary. The decoded
+// fields alias data.
+func (r *Record) UnmarshalBinary(data []byte) error {
+	d := recordDecoder{data: data}
+
+	attributes := d.byte()
+	if attributes&^recordAttrMask != 0 {
+		return corruptErr(fmt.Sprintf("unknown record attributes %d", attributes))
+	}
+	r.Timestamp = d.varint()
+
+	r.ProducerID, r.Sequence = 0, 0
+	if attributes&producerRecordAttr != 0 {
+		r.ProducerID = d.varint()
+		r.Sequence = d.varint()
+	}
+	r.Transactional = attributes&transactionalRecordAttr != 0
+
+	r.Control = 0
+	if attributes&controlRecordAttr != 0 {
+		r.Control = ControlType(d.byte())
+	}
+
+	r.ExpiresAt = 0
+	if attributes&expiringRecordAttr != 0 {
+		r.ExpiresAt = d.varint()
+	}
+
+	r.Key = nil
+	if n := d.uvarint(); n > 0 {
+		r.Key = d.bytes(n - 1)
+	}
+
+	r.Headers = nil
+	count := d.uvarint()
+	if count > uint64(len(d.data)) {
+		return corruptErr("record header count out of range")
+	}
+	for i := uint64(0); i < count && d.err == nil; i++ {
+		key := d.bytes(d.uvarint())
+		value := d.bytes(d.uvarint())
+		r.Headers = append(r.Headers, Header{string(key), value})
+	}
+
+	if d.err != nil {
+		return d.err
+	}
+	r.Value = d.data
+	return nil
+}
+
+// recordDecoder reads the fields of an encoded record, remembering the
+// first error so the caller only checks once.
+type recordDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *recordDecoder) fail() {
+	if d.err == nil {
+		d.err = corruptErr("record truncated")
+	}
+	d.data = nil
+}
+
+func (d *recordDecoder) byte() byte {
+	if len(d.data) < 1 {
+		d.fail()
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *recordDecoder) uint32() uint32 {
+	if len(d.data) < 4 {
+		d.fail()
+		return 0
+	}
+	v := binary.LittleEndian.Uint32(d.data)
+	d.data = d.data[4:]
+	return v
+}
+
+func (d *recordDecoder) varint() int64 {
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *recordDecoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *recordDecoder) bytes(n uint64) []byte {
+	if n > uint64(len(d.data)) {
+		d.fail()
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+// batchOptions carries the per-segment settings used to frame a batch.
+type batchOptions struct {
+	Codec         Codec
+	Keys          KeyProvider
+	PrevHash      *[sha256.Size]byte
+	LogAppendTime bool
+}
+
+// frame is a parsed batch with its body still compressed and encrypted.
+type frame struct {
+	Header     BatchHeader
+	Encryption EncryptionHeader
+	PrevHash   [sha256.Size]byte
+	Stored     []byte
+}
+
+// MarshalRecords encodes records one after another, each prefixed with
+// its length as a uvarint, as they are in the body of a batch.
+func MarshalRecords(records []Record) ([]byte, error) {
+	body := new(bytes.Buffer)
+	prefix := make([]byte, binary.MaxVarintLen64)
+	for _, record := range records {
+		data, err := record.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		n := binary.PutUvarint(prefix, uint64(len(data)))
+		body.Write(prefix[:n])
+		body.Write(data)
+	}
+	return body.Bytes(), nil
+}
+
+// UnmarshalRecords decodes records encoded by MarshalRecords. The decoded
+// fields alias data.
+func UnmarshalRecords(data []byte) ([]Record, error) {
+	var records []Record
+	for len(data) > 0 {
+		length, n := binary.Uvarint(data)
+		if n <= 0 || length > uint64(len(data)-n) {
+			return nil, corruptErr("record length out of range")
+		}
+
+		var record Record
+		if err := record.UnmarshalBinary(data[n : n+int(length)]); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+		data = data[n+int(length):]
+	}
+	return records, nil
+}
+
+// encodeBatch frames records as a batch starting at baseOffset. The body
+// holds the records as MarshalRecords encodes them, compressed and then
+// encrypted according to opts.
+func encodeBatch(baseOffset int64, records []Record, opts batchOptions) ([]byte, error) {
+	stored, err := MarshalRecords(records)
+	if err != nil {
+		return nil, err
+	}
+
+	header := BatchHeader{
+		Magic:      batchMagic,
+		BaseOffset: baseOffset,
+		Count:      uint32(len(records)),
+	}
+
+	if opts.Codec != nil {
+		// readers find the codec by its ID, so it must be registered
+		id := opts.Codec.ID()
+		if _, ok := codecs[id]; !ok {
+			return nil, NewLogStoreErr(
+				UnknownCodec,
+				fmt.Sprintf("no codec registered for id %d", id),
+				nil,
+			)
+		}
+		if stored, err = opts.Codec.Encode(stored); err != nil {
+			return nil, err
+		}
+		header.Attributes |= id
+	}
+
+	var enc EncryptionHeader
+	if opts.Keys != nil {
+		if enc, stored, err = encryptBody(&header, stored, opts.Keys); err != nil {
+			return nil, err
+		}
+		header.Attributes |= encryptedAttr
+	}
+	if opts.PrevHash != nil {
+		header.Attributes |= chainedAttr
+	}
+	if opts.LogAppendTime {
+		header.Attributes |= logAppendTimeAttr
+	}
+	header.CRC = crc32.ChecksumIEEE(stored)
+
+	buff := new(bytes.Buffer)
+	if err := binary.Write(buff, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	if opts.Keys != nil {
+		if err := binary.Write(buff, binary.LittleEndian, &enc); err != nil {
+			return nil, err
+		}
+	}
+	if opts.PrevHash != nil {
+		buff.Write(opts.PrevHash[:])
+	}
+	buff.Write(stored)
+
+	return buff.Bytes(), nil
+}
+
+// parseFrame reads the headers of a framed batch and checks the stored
+// body against its CRC without decrypting or decompressing it.
+func parseFrame(data []byte) (frame, error) {
+	f := frame{}
+	if len(data) < BatchHeaderWidth {
+		return f, corruptErr("batch shorter than its header")
+	}
+	reader := bytes.NewReader(data)
+	if err := binary.Read(reader, binary.LittleEndian, &f.Header); err != nil {
+		return f, err
+	}
+	if f.Header.Magic != batchMagic && f.Header.Magic != legacyBatchMagic {
+		return f, corruptErr(fmt.Sprintf("unknown batch magic %d", f.Header.Magic))
+	}
+
+	if f.Header.Attributes&encryptedAttr != 0 {
+		if err := binary.Read(reader, binary.LittleEndian, &f.Encryption); err != nil {
+			return f, corruptErr("batch shorter than its encryption header")
+		}
+	}
+	if f.Header.Attributes&chainedAttr != 0 {
+		if _, err := io.ReadFull(reader, f.PrevHash[:]); err != nil {
+			return f, corruptErr("batch shorter than its chain header")
+		}
+	}
+
+	f.Stored = data[len(data)-reader.Len():]
+	if crc32.ChecksumIEEE(f.Stored) != f.Header.CRC {
+		return f, corruptErr("batch checksum mismatch")
+	}
+
+	return f, nil
+}
+
+// decodeBatch checks a framed batch and returns its header and records.
+func decodeBatch(data []byte, keys KeyProvider) (BatchHeader, []Record, error) {
+	f, err := parseFrame(data)
+	if err != nil {
+		return f.Header, nil, err
+	}
+	header := f.Header
+
+	body := f.Stored
+	if header.Attributes&encryptedAttr != 0 {
+		if body, err = decryptBody(&header, f.Encryption, body, keys); err != nil {
+			return header, nil, err
+		}
+	}
+
+	if id := header.Codec(); id != NoCompression {
+		codec, ok := codecs[id]
+		if !ok {
+			return header, nil, NewLogStoreErr(
+				UnknownCodec,
+				fmt.Sprintf("no codec registered for id %d", id),
+				nil,
+			)
+		}
+		if body, err = codec.Decode(body); err != nil {
+			return header, nil, NewLogStoreErr(CorruptRecord, "unable to decompress batch", err)
+		}
+	}
+
+	// every record takes at least its length byte
+	if uint64(header.Count) > uint64(len(body)) {
+		return header, nil, corruptErr("batch record count out of range")
+	}
+	records := make([]Record, 0, header.Count)
+	for len(body) > 0 {
+		length, n := binary.Uvarint(body)
+		if n <= 0 || length > uint64(len(body)-n) {
+			return header, nil, corruptErr("record length out of range")
+		}
+		data := body[n : n+int(length)]
+		body = body[n+int(length):]
+
+		record := Record{Value: data}
+		if header.Magic != legacyBatchMagic {
+			if err := record.UnmarshalBinary(data); err != nil {
+				return header, nil, err
+			}
+		}
+		record.Offset = header.BaseOffset + int64(len(records))
+		records = append(records, record)
+	}
+	if uint32(len(records)) != header.Count {
+		return header, nil, corruptErr("batch record count mismatch")
+	}
+
+	return header, records, nil
+}
+
+// decodeRecord returns the record at offset from a framed batch.
+func decodeRecord(data []byte, offset int64, keys KeyProvider) (Record, error) {
+	header, records, err := decodeBatch(data, keys)
+	if err != nil {
+		return Record{}, err
+	}
+
+	idx := offset - header.BaseOffset
+	if idx < 0 || idx >= int64(len(records)) {
+		return Record{}, NewLogStoreErr(
+			OffsetNotFound,
+			fmt.Sprintf("offset %d not in batch at %d", offset, header.BaseOffset),
+			nil,
+		)
+	}
+
+	return records[idx], nil
+}
+
+func corruptErr(msg string) LogStoreErr {
+	return NewLogStoreErr(CorruptRecord, msg, nil)
+}
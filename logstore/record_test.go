@@ -0,0 +1,164 @@
+package logstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestRecord_MarshalBinary(t *testing.T) {
+	records := []Record{
+		Record{Value: []byte("bare value")},
+		Record{
+			Timestamp: 1546300800000,
+			Key:       []byte("GOOG"),
+			Headers: []Header{
+				Header{"trace-id", []byte("abc123")},
+				Header{"content-type", []byte("application/json")},
+			},
+			Value: []byte(`{"V1":"GOOG"}`),
+		},
+		Record{Key: []byte{}, Value: nil},
+	}
+
+	for _, expected := range records {
+		data, err := expected.MarshalBinary()
+		if err != nil {
+			t.Errorf("%v\n", err)
+		}
+
+		var got Record
+		if err := got.UnmarshalBinary(data); err != nil {
+			t.Errorf("%v\n", err)
+		}
+
+		if got.Timestamp != expected.Timestamp ||
+			!bytes.Equal(got.Key, expected.Key) ||
+			(got.Key == nil) != (expected.Key == nil) ||
+			!bytes.Equal(got.Value, expected.Value) ||
+			len(got.Headers) != len(expected.Headers) {
+			t.Errorf("Expected:%v Got:%v\n", expected, got)
+		}
+		for i := range expected.Headers {
+			if got.Headers[i].Key != expected.Headers[i].Key ||
+				!bytes.Equal(got.Headers[i].Value, expected.Headers[i].Value) {
+				t.Errorf("Expected header:%v Got:%v\n", expected.Headers[i], got.Headers[i])
+			}
+		}
+	}
+}
+
+func TestRecord_UnmarshalBinary_Truncated(t *testing.T) {
+	record := Record{Key: []byte("GOOG"), Headers: []Header{Header{"k", []byte("v")}}}
+	data, _ := record.MarshalBinary()
+
+	for n := 0; n < len(data)-1; n++ {
+		var got Record
+		err := got.UnmarshalBinary(data[:n])
+		if err == nil {
+			t.Errorf("Expected error decoding %d of %d bytes\n", n, len(data))
+			continue
+		}
+		if err.(LogStoreErr).ErrType != CorruptRecord {
+			t.Errorf("Expected CorruptRecord error. Got %v\n", err)
+		}
+	}
+}
+
+func TestLogStore_PutRecord_GetRecord(t *testing.T) {
+	eventQueue := make(chan Event, 1000)
+	store, _ := NewLogStore(eventQueue)
+	store.Run()
+
+	expected := Record{
+		Timestamp: 1546300800000,
+		Key:       []byte("GOOG"),
+		Headers:   []Header{Header{"trace-id", []byte("abc123")}},
+		Value:     []byte("59.0"),
+	}
+	data, _ := expected.MarshalBinary()
+
+	pchan := make(chan Event, 2)
+	eventQueue <- Event{Put, []byte("plain"), pchan, nil}
+	eventQueue <- Event{PutRecord, data, pchan, nil}
+	for i := 0; i < 2; i++ {
+		if resp := <-pchan; resp.Error != nil {
+			t.Errorf("%v\n", resp.Error)
+		}
+	}
+
+	gchan := make(chan Event)
+	b := make([]byte, 8)
+	binary.PutVarint(b, 2)
+	eventQueue <- Event{GetRecord, b, gchan, nil}
+
+	response := <-gchan
+	var got Record
+	if response.Error != nil {
+		t.Errorf("%v\n", response.Error)
+	} else if err := got.UnmarshalBinary(response.Data); err != nil {
+		t.Errorf("%v\n", err)
+	}
+
+	if got.Timestamp != expected.Timestamp ||
+		string(got.Key) != "GOOG" ||
+		len(got.Headers) != 1 ||
+		string(got.Headers[0].Value) != "abc123" ||
+		string(got.Value) != "59.0" {
+		t.Errorf("Expected:%v Got:%v\n", expected, got)
+	}
+
+	binary.PutVarint(b, 1)
+	eventQueue <- Event{GetRecord, b, gchan, nil}
+	response = <-gchan
+	got.UnmarshalBinary(response.Data)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	if got.Key != nil || got.Timestamp <= 0 || got.Timestamp > now {
+		t.Errorf("Expected unkeyed record stamped with append time. Got %v\n", got)
+	}
+
+	eventQueue <- Event{Terminate, nil, nil, nil}
+	close(pchan)
+	close(gchan)
+	close(eventQueue)
+	removeTestFiles()
+}
+
+func TestLogSegment_LogAppendTime(t *testing.T) {
+	segment, _ := NewLogSegment(1, 8*1024, false)
+	defer segment.Close()
+	segment.LogAppendTime = true
+
+	segment.AppendRecords([]Record{Record{Timestamp: 1, Value: []byte("foo")}})
+
+	got, err := segment.GetRecord(1)
+	if err != nil {
+		t.Errorf("%v\n", err)
+	}
+	if got.Timestamp == 1 {
+		t.Errorf("Expected producer timestamp to be replaced with append time\n")
+	}
+
+	removeTestFiles()
+}
+
+func TestOffsetForTime(t *testing.T) {
+	segment, _ := NewLogSegment(1, 8*1024, false)
+	for i := int64(1); i <= 10; i++ {
+		segment.AppendRecords([]Record{Record{Timestamp: i * 1000, Value: []byte("foo")}})
+	}
+	segment.Close()
+
+	for ts, expected := range map[int64]int64{0: 1, 4500: 5, 10000: 10, 20000: 11} {
+		offset, err := OffsetForTime(ts)
+		if err != nil {
+			t.Errorf("%v\n", err)
+		}
+		if offset != expected {
+			t.Errorf("Expected offset %d for time %d. Got %d\n", expected, ts, offset)
+		}
+	}
+
+	removeTestFiles()
+}
@@ -0,0 +1,195 @@
+package logstore
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Scheduler holds records back until their due time and then appends them
+// to the log through a running store's event queue. Pending records are
+// synced to <name>.schedule, ordered by due time, on every change.
+//
+// Released records are written by an idempotent producer whose sequence
+// only advances once the release is saved, so a release repeated after a
+// crash is acknowledged by the store instead of appended twice.
+type Scheduler struct {
+	Config
+	Name  string
+	Queue chan<- Event
+
+	mu        sync.Mutex
+	state     schedulerState
+	responses chan Event
+}
+
+// ScheduledRecord is a record waiting for its due time.
+type ScheduledRecord struct {
+	ID     int64
+	Due    time.Time
+	Record ExportRecord
+}
+
+type schedulerState struct {
+	ProducerID   int64
+	NextSequence int64
+	NextID       int64
+	Pending      []ScheduledRecord
+}
+
+// OpenScheduler loads the records scheduled under name, registering a
+// producer with the store the first time it is opened. Options choose the
+// file system the schedule is kept in.
+func OpenScheduler(name string, queue chan<- Event, opts ...Option) (*Scheduler, error) {
+	s := &Scheduler{
+		Config:    newConfig(opts),
+		Name:      name,
+		Queue:     queue,
+		state:     schedulerState{NextSequence: 1, NextID: 1},
+		responses: make(chan Event, 1),
+	}
+
+	data, err := readFile(s.fs(), s.stateName())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &s.state); err != nil {
+			return nil, fmt.Errorf("invalid schedule: %v", err)
+		}
+	}
+
+	if s.state.ProducerID == 0 {
+		s.Queue <- Event{InitProducer, nil, s.responses, nil}
+		response := <-s.responses
+		if response.Error != nil {
+			return nil, response.Error
+		}
+		s.state.ProducerID, _ = binary.Varint(response.Data)
+		if err := s.save(); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Schedule stores record for release at or after due and returns an ID
+// that can cancel it.
+func (s *Scheduler) Schedule(record Record, due time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := s.state.NextID
+	pending := s.state.Pending
+	s.state.NextID++
+	s.state.Pending = append(pending[:len(pending):len(pending)], ScheduledRecord{id, due, NewExportRecord(record)})
+	sort.SliceStable(s.state.Pending, func(i, j int) bool {
+		return s.state.Pending[i].Due.Before(s.state.Pending[j].Due)
+	})
+
+	// a record that is not on disk was never scheduled
+	if err := s.save(); err != nil {
+		s.state.NextID--
+		s.state.Pending = pending
+		return -1, err
+	}
+	return id, nil
+}
+
+// Cancel drops a record that has not been released yet.
+func (s *Scheduler) Cancel(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending := s.state.Pending
+	for i := range pending {
+		if pending[i].ID == id {
+			s.state.Pending = append(pending[:i:i], pending[i+1:]...)
+			if err := s.save(); err != nil {
+				s.state.Pending = pending
+				return err
+			}
+			return nil
+		}
+	}
+	return NewLogStoreErr(
+		OffsetNotFound,
+		fmt.Sprintf("no scheduled record with id %d", id),
+		nil,
+	)
+}
+
+// Release appends every record due at or before now in due order and
+// returns how many it appended.
+func (s *Scheduler) Release(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var released int
+	for len(s.state.Pending) > 0 && !s.state.Pending[0].Due.After(now) {
+		record := s.state.Pending[0].Record.Record()
+		record.ProducerID = s.state.ProducerID
+		record.Sequence = s.state.NextSequence
+
+		data, err := record.MarshalBinary()
+		if err != nil {
+			return released, err
+		}
+		s.Queue <- Event{PutRecord, data, s.responses, nil}
+		if err := (<-s.responses).Error; err != nil {
+			return released, err
+		}
+
+		s.state.Pending = s.state.Pending[1:]
+		s.state.NextSequence++
+		if err := s.save(); err != nil {
+			return released, err
+		}
+		released++
+	}
+
+	return released, nil
+}
+
+// NextDue returns the due time of the earliest pending record.
+func (s *Scheduler) NextDue() (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.state.Pending) == 0 {
+		return time.Time{}, false
+	}
+	return s.state.Pending[0].Due, true
+}
+
+// Run releases records due by the scheduler's clock every interval until
+// stop is closed.
+func (s *Scheduler) Run(interval time.Duration, stop <-chan struct{}) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.Release(now(s.Clock)); err != nil {
+			return err
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Scheduler) save() error {
+	return writeJSONSync(s.fs(), s.stateName(), s.state)
+}
+
+func (s *Scheduler) stateName() string {
+	return fmt.Sprintf("%s.schedule", s.Name)
+}
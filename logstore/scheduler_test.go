@@ -0,0 +1,146 @@
+package logstore
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestScheduler_Release(t *testing.T) {
+	eventQueue := make(chan Event, 1000)
+	store, _ := NewLogStore(eventQueue)
+	store.Run()
+
+	scheduler, err := OpenScheduler("reminders", eventQueue)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	now := time.Now()
+	scheduler.Schedule(Record{Value: []byte("later")}, now.Add(time.Hour))
+	scheduler.Schedule(Record{Value: []byte("due")}, now.Add(-time.Minute))
+	cancelled, _ := scheduler.Schedule(Record{Value: []byte("cancelled")}, now.Add(-time.Hour))
+	if err := scheduler.Cancel(cancelled); err != nil {
+		t.Errorf("%v\n", err)
+	}
+
+	released, err := scheduler.Release(now)
+	if err != nil || released != 1 {
+		t.Errorf("Expected %d record released. Got %d %v\n", 1, released, err)
+	}
+	if due, ok := scheduler.NextDue(); !ok || !due.Equal(now.Add(time.Hour)) {
+		t.Errorf("Expected the next record due in an hour. Got %v %v\n", due, ok)
+	}
+
+	// pending records survive reopening the scheduler
+	scheduler, _ = OpenScheduler("reminders", eventQueue)
+	released, _ = scheduler.Release(now.Add(2 * time.Hour))
+	if released != 1 {
+		t.Errorf("Expected %d record released. Got %d\n", 1, released)
+	}
+
+	var values []string
+	ScanRecords(1, -1, func(record Record) error {
+		values = append(values, string(record.Value))
+		return nil
+	})
+	if len(values) != 2 || values[0] != "due" || values[1] != "later" {
+		t.Errorf("Expected due then later. Got %v\n", values)
+	}
+
+	eventQueue <- Event{Terminate, nil, nil, nil}
+	close(eventQueue)
+	removeTestFiles()
+}
+
+func TestScheduler_SaveFails(t *testing.T) {
+	fsys := NewFaultFS(NewMemFS())
+	eventQueue := make(chan Event, 10)
+	store, _ := NewLogStore(eventQueue, WithFS(fsys))
+	store.Run()
+	defer func() { eventQueue <- Event{Terminate, nil, nil, nil} }()
+
+	scheduler, err := OpenScheduler("reminders", eventQueue, WithFS(fsys))
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	due := time.Now().Add(time.Hour)
+	first, err := scheduler.Schedule(Record{Value: []byte("first")}, due)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	fsys.Inject(fsys.Ops()+1, SyncError)
+	if _, err := scheduler.Schedule(Record{Value: []byte("lost")}, due.Add(-time.Minute)); err == nil {
+		t.Errorf("Expected scheduling to fail\n")
+	}
+	if next, ok := scheduler.NextDue(); !ok || !next.Equal(due) {
+		t.Errorf("Expected the failed record to be dropped. Got %v %v\n", next, ok)
+	}
+	if second, err := scheduler.Schedule(Record{Value: []byte("second")}, due); err != nil || second != first+1 {
+		t.Errorf("Expected id %d to be reused. Got %d %v\n", first+1, second, err)
+	}
+
+	fsys.Inject(fsys.Ops()+1, SyncError)
+	if err := scheduler.Cancel(first); err == nil {
+		t.Errorf("Expected cancelling to fail\n")
+	}
+	if err := scheduler.Cancel(first); err != nil {
+		t.Errorf("Expected the record to still be pending. Got %v\n", err)
+	}
+}
+
+func TestScheduler_ReleaseReplay(t *testing.T) {
+	eventQueue := make(chan Event, 1000)
+	store, _ := NewLogStore(eventQueue)
+	store.Run()
+
+	scheduler, _ := OpenScheduler("reminders", eventQueue)
+	scheduler.Schedule(Record{Value: []byte("due")}, time.Now())
+	saved, _ := ioutil.ReadFile("reminders.schedule")
+
+	scheduler.Release(time.Now())
+
+	// a crash before the release was saved leaves the record pending
+	ioutil.WriteFile("reminders.schedule", saved, 0644)
+	scheduler, _ = OpenScheduler("reminders", eventQueue)
+	released, err := scheduler.Release(time.Now())
+	if err != nil || released != 1 {
+		t.Errorf("Expected the replayed release to succeed. Got %d %v\n", released, err)
+	}
+
+	if store.MetaData.NextOffset != 2 {
+		t.Errorf("Expected next offset to be %d. Got %d\n", 2, store.MetaData.NextOffset)
+	}
+
+	eventQueue <- Event{Terminate, nil, nil, nil}
+	close(eventQueue)
+	removeTestFiles()
+}
+
+func TestScheduler_RunUsesClock(t *testing.T) {
+	eventQueue := make(chan Event, 1000)
+	store, _ := NewLogStore(eventQueue)
+	store.Run()
+
+	clock := NewManualClock(time.Now().Add(2 * time.Hour))
+	scheduler, err := OpenScheduler("reminders", eventQueue, WithClock(clock))
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	scheduler.Schedule(Record{Value: []byte("due")}, time.Now().Add(time.Hour))
+
+	stop := make(chan struct{})
+	close(stop)
+	if err := scheduler.Run(time.Hour, stop); err != nil {
+		t.Errorf("%v\n", err)
+	}
+	if _, ok := scheduler.NextDue(); ok {
+		t.Errorf("Expected the record due by the scheduler's clock to be released\n")
+	}
+
+	eventQueue <- Event{Terminate, nil, nil, nil}
+	close(eventQueue)
+	removeTestFiles()
+}
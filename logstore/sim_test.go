@@ -0,0 +1,459 @@
+package logstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	simSeed  = flag.Int64("sim.seed", 0, "run TestSimulation with this seed only")
+	simRuns  = flag.Int("sim.runs", 25, "number of seeds TestSimulation runs")
+	simSteps = flag.Int("sim.steps", 400, "operations in each simulation run")
+)
+
+// TestSimulation runs seeded random workloads against a store on a
+// simulated file system and clock, with the store's background work run by
+// a seeded scheduler. A failing run names its seed; rerun it with
+// -sim.seed to reproduce it step for step.
+func TestSimulation(t *testing.T) {
+	seeds := []int64{*simSeed}
+	if *simSeed == 0 {
+		seeds = nil
+		for i := 1; i <= *simRuns; i++ {
+			seeds = append(seeds, int64(i))
+		}
+	}
+
+	for _, seed := range seeds {
+		sim := newSimulation(seed)
+		err := sim.run(*simSteps)
+		sim.stop()
+		if err != nil {
+			t.Fatalf(
+				"seed %d: %v\nlast steps:\n%s\nreproduce with -run TestSimulation -sim.seed=%d\n",
+				seed, err, sim.lastSteps(20), seed,
+			)
+		}
+	}
+}
+
+// simulation drives one store through a random workload while keeping a
+// model of what the log must hold.
+type simulation struct {
+	rand      *rand.Rand
+	clock     *ManualClock
+	fs        *FaultFS
+	queue     chan Event
+	responses chan Event
+	spawned   chan func()
+
+	// pending holds background work the store has started and the
+	// scheduler has not run yet
+	pending []func()
+
+	// records models the log, indexed by offset - 1
+	records []simRecord
+	// synced is the number of records a successful sync covers
+	synced    int
+	producers []*simProducer
+	steps     []string
+}
+
+type simRecord struct {
+	value     []byte
+	expiresAt int64
+}
+
+type simProducer struct {
+	id       int64
+	sequence int64
+	offsets  map[int64]int64
+}
+
+func newSimulation(seed int64) *simulation {
+	return &simulation{
+		rand:      rand.New(rand.NewSource(seed)),
+		clock:     NewManualClock(time.Unix(1600000000, 0)),
+		fs:        NewFaultFS(NewMemFS()),
+		responses: make(chan Event, 1),
+		spawned:   make(chan func(), 1),
+	}
+}
+
+func (sim *simulation) options() []Option {
+	return []Option{
+		WithFS(sim.fs),
+		WithClock(sim.clock),
+		func(c *Config) {
+			c.spawn = func(fn func()) { sim.spawned <- fn }
+		},
+	}
+}
+
+func (sim *simulation) run(steps int) error {
+	if err := sim.open(); err != nil {
+		return err
+	}
+
+	for i := 0; i < steps; i++ {
+		// background work runs at random points between operations
+		for len(sim.pending) > 0 && sim.rand.Intn(3) == 0 {
+			sim.runPending()
+		}
+
+		var err error
+		switch n := sim.rand.Intn(100); {
+		case n < 30:
+			err = sim.put()
+		case n < 40:
+			err = sim.putExpiring()
+		case n < 55:
+			err = sim.producerPut()
+		case n < 73:
+			err = sim.get()
+		case n < 80:
+			err = sim.flushAsync()
+		case n < 84:
+			err = sim.flush()
+		case n < 89:
+			sim.advance()
+		case n < 92:
+			err = sim.compact()
+		case n < 96:
+			err = sim.restart()
+		case n < 99:
+			err = sim.crash(false)
+		default:
+			err = sim.crash(true)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return sim.checkLog()
+}
+
+func (sim *simulation) logf(format string, args ...interface{}) {
+	sim.steps = append(sim.steps, fmt.Sprintf(format, args...))
+}
+
+func (sim *simulation) lastSteps(n int) string {
+	steps := sim.steps
+	if len(steps) > n {
+		steps = steps[len(steps)-n:]
+	}
+	return strings.Join(steps, "\n")
+}
+
+func (sim *simulation) open() error {
+	sim.queue = make(chan Event, 1)
+	store, err := NewLogStore(sim.queue, sim.options()...)
+	if err != nil {
+		return fmt.Errorf("open: %v", err)
+	}
+	if next := int64(len(sim.records)) + 1; store.MetaData.NextOffset != next {
+		return fmt.Errorf("opened at offset %d, expected %d", store.MetaData.NextOffset, next)
+	}
+	store.Run()
+	return nil
+}
+
+// stop ends the running store. The file system is crashed first so the
+// store's last file operations cannot race whatever opens it next.
+func (sim *simulation) stop() {
+	sim.fs.Crash()
+	sim.queue <- Event{Terminate, nil, nil, nil}
+}
+
+func (sim *simulation) send(event Event) Event {
+	event.ResponseChan = sim.responses
+	sim.queue <- event
+	return <-sim.responses
+}
+
+func (sim *simulation) runPending() {
+	i := sim.rand.Intn(len(sim.pending))
+	fn := sim.pending[i]
+	sim.pending = append(sim.pending[:i], sim.pending[i+1:]...)
+	sim.logf("run background work")
+	fn()
+}
+
+func (sim *simulation) value() []byte {
+	value := make([]byte, 1+sim.rand.Intn(300))
+	for i := range value {
+		value[i] = byte('a' + sim.rand.Intn(26))
+	}
+	return value
+}
+
+// appended checks a put was acknowledged at the next offset and adds it
+// to the model.
+func (sim *simulation) appended(response Event, record simRecord) error {
+	if response.Error != nil {
+		return fmt.Errorf("put failed: %v", response.Error)
+	}
+	offset, _ := binary.Varint(response.Data)
+	if expected := int64(len(sim.records)) + 1; offset != expected {
+		return fmt.Errorf("put acknowledged at offset %d, expected %d", offset, expected)
+	}
+	sim.records = append(sim.records, record)
+	return nil
+}
+
+func (sim *simulation) put() error {
+	value := sim.value()
+	sim.logf("put %d bytes", len(value))
+	return sim.appended(sim.send(Event{Put, value, nil, nil}), simRecord{value: value})
+}
+
+func (sim *simulation) putExpiring() error {
+	record := Record{
+		Value:     sim.value(),
+		ExpiresAt: millis(sim.clock.Now()) + int64(1+sim.rand.Intn(5000)),
+	}
+	sim.logf("put %d bytes expiring at %d", len(record.Value), record.ExpiresAt)
+
+	data, err := record.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	response := sim.send(Event{PutRecord, data, nil, nil})
+	return sim.appended(response, simRecord{record.Value, record.ExpiresAt})
+}
+
+func (sim *simulation) producerPut() error {
+	if len(sim.producers) == 0 || sim.rand.Intn(10) == 0 {
+		response := sim.send(Event{InitProducer, nil, nil, nil})
+		if response.Error != nil {
+			return fmt.Errorf("init producer: %v", response.Error)
+		}
+		id, _ := binary.Varint(response.Data)
+		for _, p := range sim.producers {
+			if p.id == id {
+				return fmt.Errorf("producer id %d handed out twice", id)
+			}
+		}
+		sim.logf("init producer %d", id)
+		sim.producers = append(sim.producers, &simProducer{id: id, offsets: map[int64]int64{}})
+	}
+	p := sim.producers[sim.rand.Intn(len(sim.producers))]
+
+	// retry one of the recent sequences the store still remembers
+	if p.sequence > 0 && sim.rand.Intn(4) == 0 {
+		window := p.sequence
+		if window > producerWindow {
+			window = producerWindow
+		}
+		sequence := p.sequence - sim.rand.Int63n(window)
+		sim.logf("retry producer %d sequence %d", p.id, sequence)
+
+		record := Record{Value: []byte("retry"), ProducerID: p.id, Sequence: sequence}
+		data, _ := record.MarshalBinary()
+		response := sim.send(Event{PutRecord, data, nil, nil})
+		offset, _ := binary.Varint(response.Data)
+		if response.Error != nil || offset != p.offsets[sequence] {
+			return fmt.Errorf(
+				"retry of producer %d sequence %d answered %d %v, expected %d",
+				p.id, sequence, offset, response.Error, p.offsets[sequence],
+			)
+		}
+		return nil
+	}
+
+	record := Record{Value: sim.value(), ProducerID: p.id, Sequence: p.sequence + 1}
+	sim.logf("producer %d sequence %d", p.id, record.Sequence)
+	data, _ := record.MarshalBinary()
+	if err := sim.appended(sim.send(Event{PutRecord, data, nil, nil}), simRecord{value: record.Value}); err != nil {
+		return err
+	}
+	p.sequence++
+	p.offsets[p.sequence] = int64(len(sim.records))
+	return nil
+}
+
+func (sim *simulation) expired(record simRecord) bool {
+	return record.expiresAt != 0 && record.expiresAt <= millis(sim.clock.Now())
+}
+
+func (sim *simulation) get() error {
+	// favour the latest writes to check they are readable straight away
+	n := int64(len(sim.records))
+	offset := 1 + sim.rand.Int63n(n+2)
+	if n > 0 && sim.rand.Intn(2) == 0 {
+		offset = n - sim.rand.Int63n(minInt64(n, 10))
+	}
+	sim.logf("get %d", offset)
+
+	response := sim.send(Event{Get, varint(offset), nil, nil})
+	if offset > n {
+		if response.Error == nil {
+			return fmt.Errorf("get %d past the end of the log succeeded", offset)
+		}
+		return nil
+	}
+
+	record := sim.records[offset-1]
+	if sim.expired(record) {
+		if lsErr, ok := response.Error.(LogStoreErr); !ok || lsErr.ErrType != RecordExpired {
+			return fmt.Errorf("get of expired offset %d answered %v", offset, response.Error)
+		}
+		return nil
+	}
+	if response.Error != nil || !bytes.Equal(response.Data, record.value) {
+		return fmt.Errorf("get %d answered %q %v, expected %q", offset, response.Data, response.Error, record.value)
+	}
+	return nil
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (sim *simulation) flushAsync() error {
+	sim.logf("flush metadata in the background")
+	sim.queue <- Event{FlushMetaData, nil, nil, nil}
+	sim.pending = append(sim.pending, <-sim.spawned)
+	return nil
+}
+
+func (sim *simulation) flush() error {
+	sim.logf("flush")
+	if response := sim.send(Event{FlushMetaData, nil, nil, nil}); response.Error != nil {
+		return fmt.Errorf("flush: %v", response.Error)
+	}
+	sim.synced = len(sim.records)
+	return nil
+}
+
+func (sim *simulation) advance() {
+	d := time.Duration(sim.rand.Intn(3000)) * time.Millisecond
+	sim.logf("advance clock %v", d)
+	sim.clock.Advance(d)
+}
+
+func (sim *simulation) compact() error {
+	sim.logf("compact")
+	if _, err := Compact(sim.options()...); err != nil {
+		return fmt.Errorf("compact: %v", err)
+	}
+	return nil
+}
+
+// restart shuts the store down cleanly and reopens it. Background work
+// the old store started may still finish before the new one opens.
+func (sim *simulation) restart() error {
+	if err := sim.flush(); err != nil {
+		return err
+	}
+	sim.logf("restart")
+	sim.stop()
+	for len(sim.pending) > 0 {
+		sim.runPending()
+	}
+
+	if err := sim.open(); err != nil {
+		return err
+	}
+	return sim.checkLog()
+}
+
+// crash kills the store, dropping its background work, and reopens it
+// after a repair. A process crash keeps everything written, while a power
+// loss may lose anything written since the last sync.
+func (sim *simulation) crash(powerLoss bool) error {
+	sim.logf("crash, power loss %v", powerLoss)
+	if powerLoss {
+		sim.fs.PowerLoss()
+	}
+	sim.stop()
+	sim.pending = nil
+
+	if err := Repair(sim.options()...); err != nil {
+		return fmt.Errorf("repair: %v", err)
+	}
+
+	recovered, err := sim.recovered()
+	if err != nil {
+		return err
+	}
+	if recovered < sim.synced || (!powerLoss && recovered != len(sim.records)) {
+		return fmt.Errorf(
+			"recovered %d of %d records with %d synced",
+			recovered, len(sim.records), sim.synced,
+		)
+	}
+	sim.records = sim.records[:recovered]
+	sim.synced = recovered
+
+	// producer state is only flushed with the metadata, so producers
+	// start afresh after a crash
+	sim.producers = nil
+
+	if err := sim.open(); err != nil {
+		return err
+	}
+	return sim.checkLog()
+}
+
+// recovered returns how many records survived a crash, checking they are
+// the first ones the model holds.
+func (sim *simulation) recovered() (int, error) {
+	bases, err := Segments(sim.options()...)
+	if err != nil || len(bases) == 0 {
+		return 0, err
+	}
+
+	c := newConfig(sim.options())
+	var recovered int
+	for _, base := range bases {
+		entries, _, err := c.readSegment(base)
+		if err != nil {
+			return 0, err
+		}
+		recovered = int(base) - 1 + len(entries)
+	}
+	if recovered > len(sim.records) {
+		return 0, fmt.Errorf("recovered %d records but only %d were written", recovered, len(sim.records))
+	}
+	return recovered, nil
+}
+
+// checkLog scans the whole log and compares it with the model.
+func (sim *simulation) checkLog() error {
+	var expected []int64
+	for i, record := range sim.records {
+		if !sim.expired(record) {
+			expected = append(expected, int64(i+1))
+		}
+	}
+
+	var scanned int
+	_, err := ScanRecords(1, -1, func(record Record) error {
+		if scanned >= len(expected) || record.Offset != expected[scanned] {
+			return fmt.Errorf("scan returned unexpected offset %d", record.Offset)
+		}
+		if want := sim.records[record.Offset-1].value; !bytes.Equal(record.Value, want) {
+			return fmt.Errorf("scan of offset %d returned %q, expected %q", record.Offset, record.Value, want)
+		}
+		scanned++
+		return nil
+	}, sim.options()...)
+	if err != nil {
+		return err
+	}
+	if scanned != len(expected) {
+		return fmt.Errorf("scan returned %d records, expected %d", scanned, len(expected))
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package logstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// snapshot writes a consistent copy of the store to dir. It runs on the
+// event loop, so appends are held off until it returns. Closed segments
+// never change and are hard linked, or copied down from remote storage
+// once offloaded; the active segment is copied up to its last complete
+// record.
+func (store *LogStore) snapshot(dir string) error {
+	fsys := store.fs()
+	if err := fsys.MkdirAll(dir, 0755); err != nil {
+		return NewLogStoreErr(OSErr, "unable to create snapshot directory", err)
+	}
+
+	manifest, err := store.buildManifest()
+	if err != nil {
+		return err
+	}
+	manifest.NextOffset = store.MetaData.NextOffset
+
+	active := store.CurrentSegment
+	for _, s := range manifest.Segments {
+		if s.BaseOffset == active.StartOffset {
+			continue
+		}
+		for _, ext := range []string{"log", "index"} {
+			name := fmt.Sprintf("%s.%s", s.Name(), ext)
+			err := linkOrCopy(fsys, name, filepath.Join(dir, name))
+			if os.IsNotExist(err) && store.Tiered != nil {
+				var data []byte
+				if data, err = store.segmentFile(s.BaseOffset, ext); err == nil {
+					err = writeFile(fsys, filepath.Join(dir, name), data)
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := snapshotActiveSegment(fsys, active, dir); err != nil {
+		return err
+	}
+
+	if err := writeJSON(fsys, filepath.Join(dir, metafile), store.MetaData); err != nil {
+		return err
+	}
+	return writeJSON(fsys, filepath.Join(dir, manifestName), manifest)
+}
+
+func snapshotActiveSegment(fsys FS, segment *LogSegment, dir string) error {
+	size, err := segment.Size()
+	if err != nil {
+		return err
+	}
+
+	logName := fmt.Sprintf("%s.log", segment.Name)
+	if err := copyFile(fsys, logName, filepath.Join(dir, logName), size); err != nil {
+		return err
+	}
+
+	// the index is read straight from the mapping, trimmed to the records
+	// appended so far and padded back out to its mapped size
+	index := make([]byte, len(*segment.Index.Data))
+	used := (segment.NextOffset - segment.StartOffset) * IndexItemWidth
+	copy(index, (*segment.Index.Data)[:used])
+
+	indexName := fmt.Sprintf("%s.index", segment.Name)
+	return writeFile(fsys, filepath.Join(dir, indexName), index)
+}
+
+// OpenSnapshot restores the snapshot in dir into the working directory and
+// opens a store over it. The working directory must not hold any segments.
+func OpenSnapshot(dir string, queue <-chan Event, opts ...Option) (*LogStore, error) {
+	c := newConfig(opts)
+	fsys := c.fs()
+
+	existing, err := c.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) > 0 {
+		return nil, fmt.Errorf("cannot restore snapshot over %d existing segments", len(existing))
+	}
+
+	data, err := readFile(fsys, filepath.Join(dir, manifestName))
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := DecodeManifest(data)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range manifest.Segments {
+		for _, ext := range []string{"log", "index"} {
+			name := fmt.Sprintf("%s.%s", s.Name(), ext)
+			if err := copyFile(fsys, filepath.Join(dir, name), name, -1); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// the snapshot's metadata carries producer state along with the offset
+	if err := copyFile(fsys, filepath.Join(dir, metafile), metafile, -1); err != nil {
+		return nil, err
+	}
+	return NewLogStore(queue, opts...)
+}
+
+func linkOrCopy(fsys FS, src, dst string) error {
+	if err := fsys.Link(src, dst); err == nil {
+		return nil
+	}
+	return copyFile(fsys, src, dst, -1)
+}
+
+// copyFile copies the first n bytes of src to dst, or all of it when n is
+// negative.
+func copyFile(fsys FS, src, dst string, n int64) error {
+	in, err := fsys.OpenFile(src, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := createFile(fsys, dst)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = in
+	if n >= 0 {
+		r = io.LimitReader(in, n)
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+func writeJSON(fsys FS, name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFile(fsys, name, data)
+}
+
+// writeJSONSync replaces name with the JSON encoding of v, syncing a
+// temporary file before renaming it into place so the old or the new
+// contents survive a crash.
+func writeJSONSync(fsys FS, name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmp := name + ".tmp"
+	f, err := createFile(fsys, tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return fsys.Rename(tmp, name)
+}
@@ -0,0 +1,74 @@
+package logstore
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestLogStore_Snapshot(t *testing.T) {
+	dir := "snapshot_test"
+	defer os.RemoveAll(dir)
+
+	eventQueue := make(chan Event, 1000)
+	store, _ := NewLogStore(eventQueue)
+	store.Run()
+
+	pchan := make(chan Event, 500)
+	for i := 1; i <= 500; i++ {
+		data, _ := json.Marshal(TestMessage{"foo", i, 23.0, "bar"})
+		eventQueue <- Event{Put, data, pchan, nil}
+	}
+	for i := 1; i <= 500; i++ {
+		<-pchan
+	}
+
+	eventQueue <- Event{Snapshot, []byte(dir), pchan, nil}
+	response := <-pchan
+	if response.Error != nil {
+		t.Errorf("%v\n", response.Error)
+	}
+
+	// records appended after the snapshot must not show up in it
+	eventQueue <- Event{Put, []byte("after"), pchan, nil}
+	<-pchan
+	eventQueue <- Event{Terminate, nil, nil, nil}
+	close(pchan)
+	close(eventQueue)
+	removeTestFiles()
+
+	restoreQueue := make(chan Event, 10)
+	restored, err := OpenSnapshot(dir, restoreQueue)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	restored.Run()
+
+	if restored.MetaData.NextOffset != 501 {
+		t.Errorf("Expected next offset to be %d. Got %d\n", 501, restored.MetaData.NextOffset)
+	}
+
+	problems, _ := Verify()
+	if len(problems) != 0 {
+		t.Errorf("Expected no problems in restored snapshot. Got %v\n", problems)
+	}
+
+	gchan := make(chan Event)
+	for _, offset := range []int64{1, 356, 500} {
+		b := make([]byte, 8)
+		binary.PutVarint(b, offset)
+		restoreQueue <- Event{Get, b, gchan, nil}
+
+		response := <-gchan
+		var m TestMessage
+		json.Unmarshal(response.Data, &m)
+		if response.Error != nil || int64(m.V2) != offset {
+			t.Errorf("Expected offset %d to hold message %d. Got %v %v\n", offset, offset, m, response.Error)
+		}
+	}
+
+	restoreQueue <- Event{Terminate, nil, nil, nil}
+	close(gchan)
+	removeTestFiles()
+}
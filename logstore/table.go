@@ -0,0 +1,223 @@
+package logstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Table is a materialized view of the log holding the latest value of
+// every key. Records without a key and control markers are ignored, and a
+// record with an empty value deletes its key.
+//
+// A spilling table keeps only the offset of each key's latest record in
+// memory and reads values back from the log.
+type Table struct {
+	Config
+	Name  string
+	Spill bool
+
+	// Applied is the offset following the last record applied.
+	Applied int64
+
+	mu      sync.RWMutex
+	values  map[string][]byte
+	offsets map[string]int64
+}
+
+type tableCheckpoint struct {
+	Applied int64
+	Entries []tableEntry
+}
+
+type tableEntry struct {
+	Key    []byte
+	Value  []byte `json:",omitempty"`
+	Offset int64  `json:",omitempty"`
+}
+
+// OpenTable loads the table checkpointed under name, or starts an empty
+// one at the beginning of the log. Call Update to catch it up. Options
+// apply to reading the log.
+func OpenTable(name string, spill bool, opts ...Option) (*Table, error) {
+	t := &Table{
+		Config:  newConfig(opts),
+		Name:    name,
+		Spill:   spill,
+		Applied: 1,
+		values:  map[string][]byte{},
+		offsets: map[string]int64{},
+	}
+
+	data, err := readFile(t.fs(), t.checkpointName())
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var checkpoint tableCheckpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, fmt.Errorf("invalid table checkpoint: %v", err)
+	}
+	t.Applied = checkpoint.Applied
+	for _, entry := range checkpoint.Entries {
+		if spill {
+			t.offsets[string(entry.Key)] = entry.Offset
+		} else {
+			t.values[string(entry.Key)] = entry.Value
+		}
+	}
+
+	return t, nil
+}
+
+// Update applies every record the store has flushed since the last update
+// and returns the offset following the last one applied.
+func (t *Table) Update() (int64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.update(-1)
+}
+
+func (t *Table) update(to int64) (int64, error) {
+	next, err := t.scanFlushed(t.Applied, to, func(record Record) error {
+		if record.Key == nil || record.Control != 0 {
+			return nil
+		}
+
+		key := string(record.Key)
+		switch {
+		case len(record.Value) == 0:
+			delete(t.values, key)
+			delete(t.offsets, key)
+		case t.Spill:
+			t.offsets[key] = record.Offset
+		default:
+			t.values[key] = append([]byte(nil), record.Value...)
+		}
+		return nil
+	})
+	t.Applied = next
+
+	return next, err
+}
+
+// Get returns the latest value applied for key.
+func (t *Table) Get(key []byte) ([]byte, bool, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.get(key)
+}
+
+// GetAt returns the value of key reflecting every record up to and
+// including offset, first applying records up to it when the table is
+// behind. When the table has moved past offset and key was written since,
+// the value is read back from the log. It fails when the flushed log does
+// not yet reach offset.
+func (t *Table) GetAt(key []byte, offset int64) ([]byte, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if offset < t.Applied-1 {
+		return t.getBefore(key, offset+1)
+	}
+	if t.Applied <= offset {
+		if _, err := t.update(offset + 1); err != nil {
+			return nil, false, err
+		}
+	}
+	if t.Applied <= offset {
+		return nil, false, NewLogStoreErr(
+			OffsetNotFound,
+			fmt.Sprintf("table %s has applied records up to %d", t.Name, t.Applied-1),
+			nil,
+		)
+	}
+
+	return t.get(key)
+}
+
+// getBefore returns the value of key as of the records before to, which
+// the table has already applied.
+func (t *Table) getBefore(key []byte, to int64) ([]byte, bool, error) {
+	var written bool
+	_, err := t.scan(to, t.Applied, func(record Record) error {
+		if record.Control == 0 && bytes.Equal(record.Key, key) {
+			written = true
+			return errStopScan
+		}
+		return nil
+	})
+	if err != nil && err != errStopScan {
+		return nil, false, err
+	}
+	if !written {
+		return t.get(key)
+	}
+
+	var value []byte
+	_, err = t.scan(1, to, func(record Record) error {
+		if record.Control == 0 && bytes.Equal(record.Key, key) {
+			value = record.Value
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return value, len(value) > 0, nil
+}
+
+func (t *Table) get(key []byte) ([]byte, bool, error) {
+	if !t.Spill {
+		value, ok := t.values[string(key)]
+		return value, ok, nil
+	}
+
+	offset, ok := t.offsets[string(key)]
+	if !ok {
+		return nil, false, nil
+	}
+	record, err := t.getFromClosedSegment(offset)
+	if err != nil {
+		return nil, false, err
+	}
+	return record.Value, true, nil
+}
+
+// Len returns the number of keys in the table.
+func (t *Table) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.Spill {
+		return len(t.offsets)
+	}
+	return len(t.values)
+}
+
+// Checkpoint saves the table and its applied offset so OpenTable can
+// resume from them. The file is replaced atomically.
+func (t *Table) Checkpoint() error {
+	t.mu.RLock()
+	checkpoint := tableCheckpoint{Applied: t.Applied}
+	for key, value := range t.values {
+		checkpoint.Entries = append(checkpoint.Entries, tableEntry{Key: []byte(key), Value: value})
+	}
+	for key, offset := range t.offsets {
+		checkpoint.Entries = append(checkpoint.Entries, tableEntry{Key: []byte(key), Offset: offset})
+	}
+	t.mu.RUnlock()
+
+	return writeJSONSync(t.fs(), t.checkpointName(), checkpoint)
+}
+
+func (t *Table) checkpointName() string {
+	return fmt.Sprintf("%s.table", t.Name)
+}
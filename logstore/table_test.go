@@ -0,0 +1,141 @@
+package logstore
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+)
+
+// putKeyed appends a keyed record and flushes it, so tables see it.
+func putKeyed(eventQueue chan Event, pchan chan Event, key, value string) int64 {
+	record := Record{Key: []byte(key), Value: []byte(value)}
+	data, _ := record.MarshalBinary()
+	eventQueue <- Event{PutRecord, data, pchan, nil}
+	offset, _ := binary.Varint((<-pchan).Data)
+	eventQueue <- Event{FlushMetaData, nil, pchan, nil}
+	<-pchan
+	return offset
+}
+
+func TestTable(t *testing.T) {
+	eventQueue := make(chan Event, 1000)
+	store, _ := NewLogStore(eventQueue)
+	store.Run()
+
+	pchan := make(chan Event, 10)
+	putKeyed(eventQueue, pchan, "GOOG", "59.0")
+	putKeyed(eventQueue, pchan, "AAPL", "40.0")
+	putKeyed(eventQueue, pchan, "GOOG", "60.0")
+	putKeyed(eventQueue, pchan, "AAPL", "")
+
+	for _, spill := range []bool{false, true} {
+		table, err := OpenTable("prices", spill)
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if next, err := table.Update(); err != nil || next != 5 {
+			t.Errorf("Expected update to reach %d. Got %d %v\n", 5, next, err)
+		}
+
+		value, ok, err := table.Get([]byte("GOOG"))
+		if err != nil || !ok || string(value) != "60.0" {
+			t.Errorf("Expected GOOG to be 60.0. Got %s %v %v\n", value, ok, err)
+		}
+		if _, ok, _ := table.Get([]byte("AAPL")); ok {
+			t.Errorf("Expected AAPL to be deleted\n")
+		}
+		if table.Len() != 1 {
+			t.Errorf("Expected %d keys. Got %d\n", 1, table.Len())
+		}
+	}
+
+	eventQueue <- Event{Terminate, nil, nil, nil}
+	close(pchan)
+	close(eventQueue)
+	removeTestFiles()
+}
+
+func TestTable_GetAt(t *testing.T) {
+	eventQueue := make(chan Event, 1000)
+	store, _ := NewLogStore(eventQueue)
+	store.Run()
+
+	pchan := make(chan Event, 10)
+	table, _ := OpenTable("prices", false)
+	putKeyed(eventQueue, pchan, "GOOG", "59.0")
+	offset := putKeyed(eventQueue, pchan, "GOOG", "60.0")
+
+	value, ok, err := table.GetAt([]byte("GOOG"), offset)
+	if err != nil || !ok || string(value) != "60.0" {
+		t.Errorf("Expected GOOG to be 60.0 at offset %d. Got %s %v %v\n", offset, value, ok, err)
+	}
+
+	_, _, err = table.GetAt([]byte("GOOG"), offset+1)
+	if err == nil || err.(LogStoreErr).ErrType != OffsetNotFound {
+		t.Errorf("Expected OffsetNotFound error. Got %v\n", err)
+	}
+
+	// the table moves past offset as the key is overwritten and deleted
+	putKeyed(eventQueue, pchan, "AAPL", "40.0")
+	putKeyed(eventQueue, pchan, "GOOG", "61.0")
+	deleted := putKeyed(eventQueue, pchan, "GOOG", "")
+	table.Update()
+
+	value, ok, err = table.GetAt([]byte("GOOG"), offset)
+	if err != nil || !ok || string(value) != "60.0" {
+		t.Errorf("Expected GOOG to still be 60.0 at offset %d. Got %s %v %v\n", offset, value, ok, err)
+	}
+	value, ok, err = table.GetAt([]byte("AAPL"), offset+1)
+	if err != nil || !ok || string(value) != "40.0" {
+		t.Errorf("Expected AAPL to be 40.0 at offset %d. Got %s %v %v\n", offset+1, value, ok, err)
+	}
+	if _, ok, _ := table.GetAt([]byte("GOOG"), deleted); ok {
+		t.Errorf("Expected GOOG to be deleted at offset %d\n", deleted)
+	}
+	if _, ok, _ := table.GetAt([]byte("AAPL"), offset); ok {
+		t.Errorf("Expected no AAPL at offset %d\n", offset)
+	}
+
+	eventQueue <- Event{Terminate, nil, nil, nil}
+	close(pchan)
+	close(eventQueue)
+	removeTestFiles()
+}
+
+func TestTable_Checkpoint(t *testing.T) {
+	eventQueue := make(chan Event, 1000)
+	store, _ := NewLogStore(eventQueue)
+	store.Run()
+
+	pchan := make(chan Event, 10)
+	putKeyed(eventQueue, pchan, "GOOG", "59.0")
+	putKeyed(eventQueue, pchan, "AAPL", "40.0")
+
+	table, _ := OpenTable("prices", false)
+	table.Update()
+	if err := table.Checkpoint(); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.Remove("prices.table")
+
+	putKeyed(eventQueue, pchan, "GOOG", "60.0")
+
+	table, err := OpenTable("prices", false)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if table.Applied != 3 || table.Len() != 2 {
+		t.Errorf("Expected checkpoint at %d with %d keys. Got %d with %d\n", 3, 2, table.Applied, table.Len())
+	}
+
+	table.Update()
+	value, _, _ := table.Get([]byte("GOOG"))
+	if string(value) != "60.0" {
+		t.Errorf("Expected GOOG to be 60.0. Got %s\n", value)
+	}
+
+	eventQueue <- Event{Terminate, nil, nil, nil}
+	close(pchan)
+	close(eventQueue)
+	removeTestFiles()
+}
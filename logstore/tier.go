@@ -0,0 +1,396 @@
+package logstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RemoteStorage holds segment files offloaded from local disk, as objects
+// named like the files themselves.
+type RemoteStorage interface {
+	Put(name string, data []byte) error
+	Get(name string) ([]byte, error)
+	List() ([]string, error)
+	Delete(name string) error
+}
+
+// DirStorage is a RemoteStorage that keeps objects as files in a
+// directory, standing in for an object store.
+type DirStorage struct {
+	Dir string
+}
+
+func NewDirStorage(dir string) (*DirStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DirStorage{dir}, nil
+}
+
+// Put writes the object to a temporary file first, so a partial upload
+// is never listed, and syncs the file and then the directory, so the
+// object survives a crash once Put returns.
+func (s *DirStorage) Put(name string, data []byte) error {
+	tmp := filepath.Join(s.Dir, name+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.Dir, name)); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(s.Dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (s *DirStorage) Get(name string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(s.Dir, name))
+}
+
+func (s *DirStorage) List() ([]string, error) {
+	files, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, f := range files {
+		if !f.IsDir() && filepath.Ext(f.Name()) != ".tmp" {
+			names = append(names, f.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s *DirStorage) Delete(name string) error {
+	return os.Remove(filepath.Join(s.Dir, name))
+}
+
+// TieredStorage offloads closed segments to remote storage. The store
+// uploads each segment's log and index in the background once it is
+// closed, and deletes the local copies of uploaded segments older than the
+// newest LocalSegments closed ones. Reads, key lookups, Verify,
+// VerifyChain, manifests, snapshots and exports fetch segments that are
+// only held remotely, keeping the last CacheSegments of them in memory.
+// Repair checks remote segments but cannot rewrite them, and Compact
+// refuses to run, since it would leave the local and remote copies of a
+// segment different.
+type TieredStorage struct {
+	Remote        RemoteStorage
+	LocalSegments int
+	CacheSegments int
+
+	mu       sync.Mutex
+	loaded   bool
+	uploaded map[int64]bool
+	pending  map[int64]bool
+	cache    map[int64]cachedSegment
+	lru      []int64
+}
+
+type cachedSegment struct {
+	log, index []byte
+}
+
+// WithTieredStorage offloads closed segments as t describes. Share t
+// between the store and the readers of its directory, so they see the
+// same uploads and cache.
+func WithTieredStorage(t *TieredStorage) Option {
+	return func(c *Config) {
+		c.Tiered = t
+	}
+}
+
+// load lists the segments remote storage already holds. A segment counts
+// once its index, which is uploaded last, is there.
+func (t *TieredStorage) load() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.loaded {
+		return nil
+	}
+	names, err := t.Remote.List()
+	if err != nil {
+		return NewLogStoreErr(OSErr, "unable to list remote segments", err)
+	}
+
+	t.uploaded = make(map[int64]bool)
+	t.pending = make(map[int64]bool)
+	for _, name := range names {
+		if filepath.Ext(name) != ".index" {
+			continue
+		}
+		base, err := strconv.ParseInt(strings.TrimSuffix(name, ".index"), 10, 64)
+		if err == nil {
+			t.uploaded[base] = true
+		}
+	}
+	t.loaded = true
+	return nil
+}
+
+func (t *TieredStorage) remoteSegments() ([]int64, error) {
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	bases := make([]int64, 0, len(t.uploaded))
+	for base := range t.uploaded {
+		bases = append(bases, base)
+	}
+	return bases, nil
+}
+
+func (t *TieredStorage) isUploaded(base int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.uploaded[base]
+}
+
+// claim marks base as being uploaded unless it already is or has been.
+func (t *TieredStorage) claim(base int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.uploaded[base] || t.pending[base] {
+		return false
+	}
+	t.pending[base] = true
+	return true
+}
+
+func (t *TieredStorage) finish(base int64, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.pending, base)
+	if err == nil {
+		t.uploaded[base] = true
+	}
+}
+
+// fetch returns a file system holding the log and index of the remote
+// segment at base, downloading them unless they are cached.
+func (t *TieredStorage) fetch(base int64) (FS, error) {
+	name := fmt.Sprintf("%020d", base)
+
+	t.mu.Lock()
+	segment, ok := t.cache[base]
+	if ok {
+		t.touch(base)
+	}
+	t.mu.Unlock()
+
+	if !ok {
+		var err error
+		if segment.log, err = t.Remote.Get(name + ".log"); err != nil {
+			return nil, NewLogStoreErr(OSErr, "unable to fetch remote segment", err)
+		}
+		if segment.index, err = t.Remote.Get(name + ".index"); err != nil {
+			return nil, NewLogStoreErr(OSErr, "unable to fetch remote segment", err)
+		}
+		t.add(base, segment)
+	}
+
+	// the cached bytes are only ever read, so every fetch shares them
+	fsys := NewMemFS()
+	fsys.add(name+".log", segment.log)
+	fsys.add(name+".index", segment.index)
+	return fsys, nil
+}
+
+func (t *TieredStorage) add(base int64, segment cachedSegment) {
+	if t.CacheSegments <= 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.cache == nil {
+		t.cache = make(map[int64]cachedSegment)
+	}
+	if _, ok := t.cache[base]; !ok {
+		t.lru = append(t.lru, base)
+	}
+	t.cache[base] = segment
+	for len(t.lru) > t.CacheSegments {
+		delete(t.cache, t.lru[0])
+		t.lru = t.lru[1:]
+	}
+}
+
+// touch moves base to the most recently used end of the cache.
+func (t *TieredStorage) touch(base int64) {
+	for i, b := range t.lru {
+		if b == base {
+			t.lru = append(append(t.lru[:i:i], t.lru[i+1:]...), base)
+			return
+		}
+	}
+}
+
+// forget removes the segment at base from remote storage, index first so
+// it stops counting as uploaded.
+func (t *TieredStorage) forget(base int64) {
+	if err := t.load(); err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	held := t.uploaded[base]
+	delete(t.uploaded, base)
+	delete(t.cache, base)
+	for i, b := range t.lru {
+		if b == base {
+			t.lru = append(t.lru[:i:i], t.lru[i+1:]...)
+			break
+		}
+	}
+	t.mu.Unlock()
+
+	if held {
+		name := fmt.Sprintf("%020d", base)
+		t.Remote.Delete(name + ".index")
+		t.Remote.Delete(name + ".log")
+	}
+}
+
+// allSegments returns the base offsets of the local segments together
+// with those only held remotely, in ascending order.
+func (c *Config) allSegments() ([]int64, error) {
+	bases, err := c.segments()
+	if err != nil || c.Tiered == nil {
+		return bases, err
+	}
+
+	remote, err := c.Tiered.remoteSegments()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[int64]bool, len(bases))
+	for _, base := range bases {
+		seen[base] = true
+	}
+	for _, base := range remote {
+		if !seen[base] {
+			bases = append(bases, base)
+		}
+	}
+	sort.Slice(bases, func(i, j int) bool { return bases[i] < bases[j] })
+	return bases, nil
+}
+
+// openClosedSegment opens the segment at base for reading, from local
+// disk or, once it has been offloaded, from remote storage.
+func (c *Config) openClosedSegment(base int64) (*LogSegment, error) {
+	segment, err := c.openSegment(base, -1, true)
+	if err == nil || c.Tiered == nil || !os.IsNotExist(err) {
+		return segment, err
+	}
+
+	fsys, err := c.Tiered.fetch(base)
+	if err != nil {
+		return nil, err
+	}
+	return c.openSegmentIn(fsys, base, -1, true)
+}
+
+// segmentFile returns the log or index, named by ext, of the segment at
+// base from local disk or, once it has been offloaded, remote storage.
+func (c *Config) segmentFile(base int64, ext string) ([]byte, error) {
+	name := fmt.Sprintf("%020d.%s", base, ext)
+	data, err := readFile(c.fs(), name)
+	if err == nil || c.Tiered == nil || !os.IsNotExist(err) {
+		return data, err
+	}
+
+	fsys, err := c.Tiered.fetch(base)
+	if err != nil {
+		return nil, err
+	}
+	return readFile(fsys, name)
+}
+
+// upload copies the log and then the index of the segment at base to
+// remote storage.
+func (c *Config) upload(base int64) error {
+	name := fmt.Sprintf("%020d", base)
+	for _, ext := range []string{"log", "index"} {
+		data, err := readFile(c.fs(), fmt.Sprintf("%s.%s", name, ext))
+		if err != nil {
+			return NewLogStoreErr(OSErr, "unable to read segment for upload", err)
+		}
+		if err := c.Tiered.Remote.Put(fmt.Sprintf("%s.%s", name, ext), data); err != nil {
+			return NewLogStoreErr(OSErr, "unable to upload segment", err)
+		}
+	}
+	return nil
+}
+
+// offload starts uploading the closed segments remote storage does not
+// hold yet, and deletes the local copies of uploaded segments beyond the
+// newest LocalSegments closed ones, reporting them offloaded. A failed upload is retried the next
+// time the store rolls.
+func (store *LogStore) offload() {
+	t := store.Tiered
+	if t == nil || t.load() != nil {
+		return
+	}
+
+	bases, err := store.segments()
+	if err != nil {
+		return
+	}
+	var closed []int64
+	for _, base := range bases {
+		if base < store.CurrentSegment.StartOffset {
+			closed = append(closed, base)
+		}
+	}
+
+	for i, base := range closed {
+		if t.isUploaded(base) {
+			if i < len(closed)-t.LocalSegments {
+				store.removeLocalSegment(fmt.Sprintf("%020d", base))
+			}
+			continue
+		}
+		if !t.claim(base) {
+			continue
+		}
+
+		base := base
+		store.goAsync(func() {
+			err := store.upload(base)
+			t.finish(base, err)
+			notify(store.Observers, LifecycleEvent{Type: SegmentUploaded, Segment: base, Err: err})
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package logstore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// inline runs background work, such as uploads, before returning.
+func inline(c *Config) {
+	c.spawn = func(fn func()) { fn() }
+}
+
+// flakyStorage fails every Put while failing is set.
+type flakyStorage struct {
+	RemoteStorage
+	failing bool
+}
+
+func (s *flakyStorage) Put(name string, data []byte) error {
+	if s.failing {
+		return errors.New("remote unavailable")
+	}
+	return s.RemoteStorage.Put(name, data)
+}
+
+func putValues(t *testing.T, eventQueue chan Event, from, to int) {
+	pchan := make(chan Event, 1)
+	for i := from; i <= to; i++ {
+		eventQueue <- Event{Put, []byte(fmt.Sprintf("value-%d", i)), pchan, nil}
+		if err := (<-pchan).Error; err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+}
+
+// countingStorage counts the objects fetched from remote storage.
+type countingStorage struct {
+	RemoteStorage
+	gets int
+}
+
+func (s *countingStorage) Get(name string) ([]byte, error) {
+	s.gets++
+	return s.RemoteStorage.Get(name)
+}
+
+func TestTieredStorage(t *testing.T) {
+	fsys := NewMemFS()
+	remote, err := NewDirStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	tiered := &TieredStorage{Remote: remote, LocalSegments: 2, CacheSegments: 2}
+	r := &recorder{}
+	m := NewMetrics()
+
+	opts := []Option{WithFS(fsys), WithTieredStorage(tiered), WithObserver(r), WithMetrics(m), inline}
+	eventQueue := make(chan Event, 100)
+	store, err := NewLogStore(eventQueue, opts...)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	store.Run()
+	putValues(t, eventQueue, 1, 1000)
+
+	// the active segment and the newest closed ones stay on local disk
+	local, _ := Segments(WithFS(fsys))
+	if len(local) != 3 {
+		t.Errorf("Expected 3 local segments. Got %v\n", local)
+	}
+	uploaded := r.ofType(SegmentUploaded)
+	offloaded := r.ofType(SegmentOffloaded)
+	if len(uploaded) != len(r.ofType(SegmentRolled)) || len(offloaded) != len(uploaded)-2 {
+		t.Errorf("Expected every closed segment uploaded and all but 2 offloaded. Got %v %v\n", uploaded, offloaded)
+	}
+	if deleted := r.ofType(SegmentDeleted); len(deleted) != 0 {
+		t.Errorf("Expected no segment deleted. Got %v\n", deleted)
+	}
+	if segments := scrape(t, m)["logstore_segments"]; segments != 3 {
+		t.Errorf("Expected the segments gauge to count 3 local segments. Got %v\n", segments)
+	}
+	for _, e := range uploaded {
+		if e.Err != nil {
+			t.Errorf("%v\n", e.Err)
+		}
+	}
+
+	pchan := make(chan Event, 1)
+	for _, offset := range []int64{1, 2, 500, 1000} {
+		eventQueue <- Event{Get, varint(offset), pchan, nil}
+		response := <-pchan
+		if expected := fmt.Sprintf("value-%d", offset); string(response.Data) != expected {
+			t.Errorf("Expected %s. Got %s %v\n", expected, response.Data, response.Error)
+		}
+	}
+	if len(tiered.lru) != 2 {
+		t.Errorf("Expected 2 cached segments. Got %v\n", tiered.lru)
+	}
+	eventQueue <- Event{FlushMetaData, nil, pchan, nil}
+	<-pchan
+	eventQueue <- Event{Terminate, nil, nil, nil}
+
+	next, err := ScanRecords(1, -1, func(record Record) error {
+		if expected := fmt.Sprintf("value-%d", record.Offset); string(record.Value) != expected {
+			t.Errorf("Expected %s. Got %s\n", expected, record.Value)
+		}
+		return nil
+	}, opts...)
+	if err != nil || next != 1001 {
+		t.Errorf("Expected to scan through 1001. Got %d %v\n", next, err)
+	}
+
+	// a restarted store finds the offloaded segments in remote storage
+	eventQueue = make(chan Event, 100)
+	store, err = NewLogStore(eventQueue, WithFS(fsys), WithTieredStorage(&TieredStorage{Remote: remote}), inline)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	store.Run()
+	eventQueue <- Event{Get, varint(1), pchan, nil}
+	if response := <-pchan; string(response.Data) != "value-1" {
+		t.Errorf("Expected value-1. Got %s %v\n", response.Data, response.Error)
+	}
+	eventQueue <- Event{Terminate, nil, nil, nil}
+}
+
+func TestTieredStorage_UploadFailure(t *testing.T) {
+	fsys := NewMemFS()
+	dir, err := NewDirStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	remote := &flakyStorage{dir, true}
+	r := &recorder{}
+
+	eventQueue := make(chan Event, 100)
+	store, err := NewLogStore(
+		eventQueue,
+		WithFS(fsys),
+		WithTieredStorage(&TieredStorage{Remote: remote}),
+		WithObserver(r),
+		inline,
+	)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	store.Run()
+	putValues(t, eventQueue, 1, 400)
+
+	// nothing leaves local disk until it is safely uploaded
+	rolled := r.ofType(SegmentRolled)
+	local, _ := Segments(WithFS(fsys))
+	if len(local) != len(rolled)+1 || len(r.ofType(SegmentOffloaded)) != 0 {
+		t.Errorf("Expected every segment kept locally. Got %v\n", local)
+	}
+	for _, e := range r.ofType(SegmentUploaded) {
+		if e.Err == nil {
+			t.Errorf("Expected segment %d to fail to upload\n", e.Segment)
+		}
+	}
+
+	// the next roll retries every segment still waiting, and the one after
+	// deletes them
+	remote.failing = false
+	putValues(t, eventQueue, 401, 700)
+	eventQueue <- Event{Terminate, nil, nil, nil}
+
+	local, _ = Segments(WithFS(fsys))
+	if len(local) != 2 {
+		t.Errorf("Expected only the last closed and active segments locally. Got %v\n", local)
+	}
+	names, _ := dir.List()
+	if len(names) != 2*len(r.ofType(SegmentRolled)) {
+		t.Errorf("Expected the log and index of every closed segment uploaded. Got %v\n", names)
+	}
+}
+
+func TestTieredStorage_ReadPaths(t *testing.T) {
+	fsys := NewMemFS()
+	remote, err := NewDirStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	tiered := &TieredStorage{Remote: remote, LocalSegments: 1}
+	opts := []Option{WithFS(fsys), WithTieredStorage(tiered), inline}
+
+	eventQueue := make(chan Event, 100)
+	store, err := NewLogStore(eventQueue, opts...)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	store.Run()
+
+	pchan := make(chan Event, 1)
+	for i := 1; i <= 1000; i++ {
+		record := Record{Key: []byte(fmt.Sprintf("key-%d", i%10)), Value: []byte("value")}
+		data, _ := record.MarshalBinary()
+		eventQueue <- Event{PutRecord, data, pchan, nil}
+		if err := (<-pchan).Error; err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+	eventQueue <- Event{Snapshot, []byte("snap"), pchan, nil}
+	if err := (<-pchan).Error; err != nil {
+		t.Errorf("%v\n", err)
+	}
+	eventQueue <- Event{FlushMetaData, nil, pchan, nil}
+	<-pchan
+	eventQueue <- Event{Terminate, nil, nil, nil}
+
+	local, _ := Segments(WithFS(fsys))
+	all, _ := Segments(opts...)
+	if len(local) >= len(all) {
+		t.Fatalf("Expected segments offloaded. Got %v of %v local\n", local, all)
+	}
+
+	offsets, err := FindByKey([]byte("key-3"), opts...)
+	if err != nil || len(offsets) != 100 || offsets[0] != 3 {
+		t.Errorf("Expected 100 offsets from 3 on. Got %d %v\n", len(offsets), err)
+	}
+
+	manifest, err := BuildManifest(opts...)
+	if err != nil || len(manifest.Segments) != len(all) || manifest.NextOffset != 1001 {
+		t.Errorf("Expected every segment in the manifest. Got %v %v\n", manifest, err)
+	}
+	if problems, err := Verify(opts...); err != nil || len(problems) != 0 {
+		t.Errorf("Expected no problems. Got %v %v\n", problems, err)
+	}
+	if err := Repair(opts...); err != nil {
+		t.Errorf("%v\n", err)
+	}
+	if _, err := Compact(opts...); err == nil {
+		t.Errorf("Expected compacting a tiered store to fail\n")
+	}
+
+	var buff bytes.Buffer
+	if err := Export(&buff, 1, -1, TarArchive, opts...); err != nil {
+		t.Errorf("%v\n", err)
+	}
+	first := fmt.Sprintf("%020d.log", all[0])
+	if _, err := fsys.Stat(filepath.Join("snap", first)); err != nil {
+		t.Errorf("Expected the offloaded segment in the snapshot. Got %v\n", err)
+	}
+}
+
+func TestTieredStorage_FindByKeyKeepsCaches(t *testing.T) {
+	fsys := NewMemFS()
+	dir, err := NewDirStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	remote := &countingStorage{RemoteStorage: dir}
+	opts := []Option{WithFS(fsys), WithTieredStorage(&TieredStorage{Remote: remote, LocalSegments: 1}), inline}
+
+	eventQueue := make(chan Event, 100)
+	store, err := NewLogStore(eventQueue, opts...)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	store.Run()
+
+	pchan := make(chan Event, 1)
+	for i := 1; i <= 1000; i++ {
+		record := Record{Key: []byte(fmt.Sprintf("key-%d", i%10)), Value: []byte("value")}
+		data, _ := record.MarshalBinary()
+		eventQueue <- Event{PutRecord, data, pchan, nil}
+		if err := (<-pchan).Error; err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+	eventQueue <- Event{Terminate, nil, nil, nil}
+
+	local, _ := Segments(WithFS(fsys))
+	all, _ := Segments(opts...)
+	if len(local) >= len(all) {
+		t.Fatalf("Expected segments offloaded. Got %v of %v local\n", local, all)
+	}
+
+	// the key indexes of offloaded segments rule them out without a fetch
+	offsets, err := FindByKey([]byte("key-missing"), opts...)
+	if err != nil || len(offsets) != 0 || remote.gets != 0 {
+		t.Errorf("Expected no offsets and no fetches. Got %v %v after %d fetches\n", offsets, err, remote.gets)
+	}
+	if _, err := SegmentMerkleTree(all[0], opts...); err != nil || remote.gets != 0 {
+		t.Errorf("Expected the Merkle tree without a fetch. Got %v after %d fetches\n", err, remote.gets)
+	}
+}
@@ -0,0 +1,254 @@
+package logstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ControlType marks a record written by the store rather than a producer.
+type ControlType uint8
+
+const (
+	CommitMarker ControlType = iota + 1
+	AbortMarker
+)
+
+// Isolation controls which records reads return. ReadUncommitted returns
+// everything in the log. ReadCommitted stops at the last stable offset and
+// skips control markers and records from aborted transactions.
+type Isolation int
+
+const (
+	ReadUncommitted Isolation = iota
+	ReadCommitted
+)
+
+// AbortedTransaction is the offset range of a producer's aborted
+// transaction, ending with its abort marker.
+type AbortedTransaction struct {
+	ProducerID  int64
+	FirstOffset int64
+	LastOffset  int64
+}
+
+// LastStableOffset is the first offset that may still belong to an open
+// transaction. Read committed readers see nothing at or after it.
+func (m *MetaData) LastStableOffset() int64 {
+	lso := m.NextOffset
+	for _, first := range m.Transactions {
+		if first < lso {
+			lso = first
+		}
+	}
+	return lso
+}
+
+// visibility is what a read committed reader needs to know: the last
+// stable offset and the aborted transactions that may cover the records
+// it reads.
+type visibility struct {
+	lso     int64
+	aborted []AbortedTransaction
+}
+
+// visibility combines the metadata with the aborted transactions recorded
+// for the closed segments that may hold the markers of records from offset
+// from on.
+func (c *Config) visibility(m MetaData, from int64) (visibility, error) {
+	v := visibility{m.LastStableOffset(), append([]AbortedTransaction(nil), m.Aborted...)}
+
+	files, err := c.fs().Glob("*.aborted")
+	if err != nil {
+		return v, err
+	}
+	sort.Strings(files)
+	for i, file := range files {
+		// a segment's markers all come before the next segment's base
+		if i+1 < len(files) && abortedBase(files[i+1]) <= from {
+			continue
+		}
+		aborted, err := c.readAborted(file)
+		if err != nil {
+			return v, err
+		}
+		v.aborted = append(v.aborted, aborted...)
+	}
+	return v, nil
+}
+
+// committed reports whether a read committed reader may see record.
+func (v visibility) committed(record Record) bool {
+	if record.Control != 0 || record.Offset >= v.lso {
+		return false
+	}
+	if !record.Transactional {
+		return true
+	}
+
+	for _, aborted := range v.aborted {
+		if aborted.ProducerID == record.ProducerID &&
+			aborted.FirstOffset <= record.Offset &&
+			record.Offset <= aborted.LastOffset {
+			return false
+		}
+	}
+	return true
+}
+
+// beginTransaction opens a transaction for producer. The metadata is
+// written before returning so a crash cannot expose records appended to a
+// transaction the store has no record of.
+func (store *LogStore) beginTransaction(producer int64) error {
+	if producer <= 0 || producer > store.MetaData.NextProducerID {
+		return transactionErr(fmt.Sprintf("unknown producer %d", producer))
+	}
+	if _, ok := store.MetaData.Transactions[producer]; ok {
+		return transactionErr(
+			fmt.Sprintf("producer %d already has an open transaction", producer),
+		)
+	}
+
+	if store.MetaData.Transactions == nil {
+		store.MetaData.Transactions = map[int64]int64{}
+	}
+	store.MetaData.Transactions[producer] = store.MetaData.NextOffset
+	if err := store.flush(); err != nil {
+		delete(store.MetaData.Transactions, producer)
+		return err
+	}
+	return nil
+}
+
+// endTransaction appends the marker closing producer's open transaction
+// and returns its offset.
+func (store *LogStore) endTransaction(producer int64, marker ControlType) (int64, error) {
+	first, ok := store.MetaData.Transactions[producer]
+	if !ok {
+		return -1, transactionErr(
+			fmt.Sprintf("producer %d has no open transaction", producer),
+		)
+	}
+
+	offset, err := store.append(Record{
+		ProducerID:    producer,
+		Transactional: true,
+		Control:       marker,
+	})
+	if err != nil {
+		return -1, err
+	}
+
+	delete(store.MetaData.Transactions, producer)
+	if marker == AbortMarker {
+		store.MetaData.Aborted = append(
+			store.MetaData.Aborted,
+			AbortedTransaction{producer, first, offset},
+		)
+	}
+	return offset, store.flush()
+}
+
+func transactionErr(msg string) error {
+	return NewLogStoreErr(InvalidTransactionState, msg, nil)
+}
+
+// abortReplay rebuilds the aborted transactions from the control markers
+// in the log, by the segment holding each abort marker. A transaction
+// starts at its producer's first transactional record after the
+// producer's last marker.
+type abortReplay struct {
+	open    map[int64]int64
+	aborted map[int64][]AbortedTransaction
+}
+
+func newAbortReplay() *abortReplay {
+	return &abortReplay{map[int64]int64{}, map[int64][]AbortedTransaction{}}
+}
+
+func (r *abortReplay) replay(base int64, records []Record) {
+	for _, record := range records {
+		if !record.Transactional {
+			continue
+		}
+		producer := record.ProducerID
+		if record.Control == 0 {
+			if _, ok := r.open[producer]; !ok {
+				r.open[producer] = record.Offset
+			}
+			continue
+		}
+
+		if record.Control == AbortMarker {
+			first, ok := r.open[producer]
+			if !ok {
+				first = record.Offset
+			}
+			r.aborted[base] = append(r.aborted[base], AbortedTransaction{producer, first, record.Offset})
+		}
+		delete(r.open, producer)
+	}
+}
+
+// writeAborted records the aborted transactions whose markers are in the
+// closed segment at base. Readers cannot tell an aborted record from a
+// committed one without it, so it is synced, and it is kept when the
+// segment is offloaded.
+func (c *Config) writeAborted(base int64, aborted []AbortedTransaction) error {
+	name := abortedName(base)
+	if len(aborted) == 0 {
+		if err := c.fs().Remove(name); err != nil && !os.IsNotExist(err) {
+			return NewLogStoreErr(OSErr, "unable to remove aborted transactions", err)
+		}
+		return nil
+	}
+
+	if current, err := c.readAborted(name); err == nil && sameAborted(current, aborted) {
+		return nil
+	}
+	if err := writeJSONSync(c.fs(), name, aborted); err != nil {
+		return NewLogStoreErr(OSErr, "unable to record aborted transactions", err)
+	}
+	return nil
+}
+
+func (c *Config) readAborted(name string) ([]AbortedTransaction, error) {
+	data, err := readFile(c.fs(), name)
+	if err != nil {
+		return nil, NewLogStoreErr(OSErr, "unable to read aborted transactions", err)
+	}
+	var aborted []AbortedTransaction
+	if err := json.Unmarshal(data, &aborted); err != nil {
+		return nil, NewLogStoreErr(
+			CorruptIndex,
+			fmt.Sprintf("aborted transactions file %s is malformed", name),
+			err,
+		)
+	}
+	return aborted, nil
+}
+
+func sameAborted(a, b []AbortedTransaction) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func abortedName(base int64) string {
+	return fmt.Sprintf("%020d.aborted", base)
+}
+
+func abortedBase(name string) int64 {
+	base, _ := strconv.ParseInt(strings.TrimSuffix(filepath.Base(name), ".aborted"), 10, 64)
+	return base
+}
@@ -0,0 +1,242 @@
+package logstore
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func putTransactional(eventQueue chan Event, pchan chan Event, producer, sequence int64) error {
+	record := Record{
+		Value:         []byte("foo"),
+		ProducerID:    producer,
+		Sequence:      sequence,
+		Transactional: true,
+	}
+	data, _ := record.MarshalBinary()
+	eventQueue <- Event{PutRecord, data, pchan, nil}
+	return (<-pchan).Error
+}
+
+func getRecordErr(eventQueue chan Event, pchan chan Event, offset int64) error {
+	eventQueue <- Event{GetRecord, varint(offset), pchan, nil}
+	return (<-pchan).Error
+}
+
+func TestLogStore_Transaction_Commit(t *testing.T) {
+	eventQueue := make(chan Event, 1000)
+	store, _ := NewLogStore(eventQueue, WithIsolation(ReadCommitted))
+	store.Run()
+
+	pchan := make(chan Event, 10)
+	producer := initProducer(t, eventQueue, pchan)
+	eventQueue <- Event{BeginTransaction, varint(producer), pchan, nil}
+	if response := <-pchan; response.Error != nil {
+		t.Fatalf("%v\n", response.Error)
+	}
+	for sequence := int64(1); sequence <= 3; sequence++ {
+		if err := putTransactional(eventQueue, pchan, producer, sequence); err != nil {
+			t.Errorf("%v\n", err)
+		}
+	}
+
+	err := getRecordErr(eventQueue, pchan, 1)
+	if err == nil || err.(LogStoreErr).ErrType != NotCommitted {
+		t.Errorf("Expected NotCommitted error. Got %v\n", err)
+	}
+
+	eventQueue <- Event{CommitTransaction, varint(producer), pchan, nil}
+	response := <-pchan
+	if response.Error != nil {
+		t.Errorf("%v\n", response.Error)
+	}
+	marker, _ := binary.Varint(response.Data)
+	if marker != 4 {
+		t.Errorf("Expected commit marker at offset %d. Got %d\n", 4, marker)
+	}
+
+	for offset := int64(1); offset <= 3; offset++ {
+		if err := getRecordErr(eventQueue, pchan, offset); err != nil {
+			t.Errorf("%v\n", err)
+		}
+	}
+	err = getRecordErr(eventQueue, pchan, marker)
+	if err == nil || err.(LogStoreErr).ErrType != NotCommitted {
+		t.Errorf("Expected NotCommitted error for the marker. Got %v\n", err)
+	}
+
+	eventQueue <- Event{Terminate, nil, nil, nil}
+	close(pchan)
+	close(eventQueue)
+	removeTestFiles()
+}
+
+func TestLogStore_Transaction_Abort(t *testing.T) {
+	eventQueue := make(chan Event, 1000)
+	store, _ := NewLogStore(eventQueue)
+	store.Run()
+
+	pchan := make(chan Event, 10)
+	eventQueue <- Event{Put, []byte("before"), pchan, nil}
+	<-pchan
+
+	producer := initProducer(t, eventQueue, pchan)
+	eventQueue <- Event{BeginTransaction, varint(producer), pchan, nil}
+	<-pchan
+	putTransactional(eventQueue, pchan, producer, 1)
+	putTransactional(eventQueue, pchan, producer, 2)
+
+	// records written after the transaction began are held back while it
+	// is open
+	eventQueue <- Event{Put, []byte("after"), pchan, nil}
+	<-pchan
+	eventQueue <- Event{FlushMetaData, nil, pchan, nil}
+	<-pchan
+
+	var values []string
+	collect := func(record Record) error {
+		values = append(values, string(record.Value))
+		return nil
+	}
+	ScanRecords(1, -1, collect, WithIsolation(ReadCommitted))
+	if len(values) != 1 || values[0] != "before" {
+		t.Errorf("Expected only the record before the transaction. Got %v\n", values)
+	}
+
+	eventQueue <- Event{AbortTransaction, varint(producer), pchan, nil}
+	if response := <-pchan; response.Error != nil {
+		t.Errorf("%v\n", response.Error)
+	}
+
+	values = nil
+	ScanRecords(1, -1, collect, WithIsolation(ReadCommitted))
+	if len(values) != 2 || values[0] != "before" || values[1] != "after" {
+		t.Errorf("Expected aborted records to be hidden. Got %v\n", values)
+	}
+
+	values = nil
+	ScanRecords(1, -1, collect)
+	if len(values) != 5 {
+		t.Errorf("Expected %d records read uncommitted. Got %d\n", 5, len(values))
+	}
+
+	eventQueue <- Event{Terminate, nil, nil, nil}
+	close(pchan)
+	close(eventQueue)
+	removeTestFiles()
+}
+
+func TestLogStore_Transaction_InvalidState(t *testing.T) {
+	eventQueue := make(chan Event, 1000)
+	store, _ := NewLogStore(eventQueue)
+	store.Run()
+
+	pchan := make(chan Event, 10)
+	producer := initProducer(t, eventQueue, pchan)
+
+	err := putTransactional(eventQueue, pchan, producer, 1)
+	if err == nil || err.(LogStoreErr).ErrType != InvalidTransactionState {
+		t.Errorf("Expected InvalidTransactionState error. Got %v\n", err)
+	}
+
+	eventQueue <- Event{CommitTransaction, varint(producer), pchan, nil}
+	err = (<-pchan).Error
+	if err == nil || err.(LogStoreErr).ErrType != InvalidTransactionState {
+		t.Errorf("Expected InvalidTransactionState error. Got %v\n", err)
+	}
+
+	marker := Record{ProducerID: producer, Transactional: true, Control: CommitMarker}
+	data, _ := marker.MarshalBinary()
+	eventQueue <- Event{PutRecord, data, pchan, nil}
+	err = (<-pchan).Error
+	if err == nil || err.(LogStoreErr).ErrType != InvalidTransactionState {
+		t.Errorf("Expected InvalidTransactionState error. Got %v\n", err)
+	}
+
+	eventQueue <- Event{Terminate, nil, nil, nil}
+	close(pchan)
+	close(eventQueue)
+	removeTestFiles()
+}
+
+// writeAbortedTransaction writes 3 records in a transaction that is
+// aborted, between untransactional records at offsets 1 and 6.
+func writeAbortedTransaction(t *testing.T, eventQueue chan Event, pchan chan Event) {
+	putValues(t, eventQueue, 1, 1)
+	producer := initProducer(t, eventQueue, pchan)
+	eventQueue <- Event{BeginTransaction, varint(producer), pchan, nil}
+	<-pchan
+	for sequence := int64(1); sequence <= 3; sequence++ {
+		if err := putTransactional(eventQueue, pchan, producer, sequence); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+	eventQueue <- Event{AbortTransaction, varint(producer), pchan, nil}
+	if err := (<-pchan).Error; err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	putValues(t, eventQueue, 6, 6)
+}
+
+func committedOffsets(fsys FS) []int64 {
+	var offsets []int64
+	ScanRecords(1, -1, func(record Record) error {
+		offsets = append(offsets, record.Offset)
+		return nil
+	}, WithFS(fsys), WithIsolation(ReadCommitted))
+	return offsets
+}
+
+func TestLogStore_Transaction_AbortedFromMarkers(t *testing.T) {
+	fsys := NewMemFS()
+	eventQueue := make(chan Event, 10)
+	store, _ := NewLogStore(eventQueue, WithFS(fsys))
+	store.Run()
+
+	pchan := make(chan Event, 1)
+	writeAbortedTransaction(t, eventQueue, pchan)
+	eventQueue <- Event{FlushMetaData, nil, pchan, nil}
+	<-pchan
+	eventQueue <- Event{Terminate, nil, nil, nil}
+
+	// metadata that lost the aborted transaction
+	c := newConfig([]Option{WithFS(fsys)})
+	metadata, _ := c.readMetaData()
+	metadata.Aborted = nil
+	c.writeMetaData(metadata)
+
+	eventQueue = make(chan Event, 10)
+	store, _ = NewLogStore(eventQueue, WithFS(fsys), WithIsolation(ReadCommitted))
+	store.Run()
+	err := getRecordErr(eventQueue, pchan, 3)
+	if err == nil || err.(LogStoreErr).ErrType != NotCommitted {
+		t.Errorf("Expected NotCommitted error. Got %v\n", err)
+	}
+	eventQueue <- Event{Terminate, nil, nil, nil}
+
+	if offsets := committedOffsets(fsys); len(offsets) != 2 || offsets[0] != 1 || offsets[1] != 6 {
+		t.Errorf("Expected only offsets 1 and 6 visible. Got %v\n", offsets)
+	}
+}
+
+func TestLogStore_Transaction_AbortedPruned(t *testing.T) {
+	fsys := NewMemFS()
+	eventQueue := make(chan Event, 10)
+	store, _ := NewLogStore(eventQueue, WithFS(fsys))
+	store.Run()
+
+	pchan := make(chan Event, 1)
+	writeAbortedTransaction(t, eventQueue, pchan)
+	putValues(t, eventQueue, 7, 300)
+	eventQueue <- Event{FlushMetaData, nil, pchan, nil}
+	<-pchan
+	eventQueue <- Event{Terminate, nil, nil, nil}
+
+	metadata, _ := ReadMetaData(WithFS(fsys))
+	if len(metadata.Aborted) != 0 {
+		t.Errorf("Expected aborted transactions pruned once their segment closed. Got %v\n", metadata.Aborted)
+	}
+	offsets := committedOffsets(fsys)
+	if len(offsets) != 296 || offsets[0] != 1 || offsets[1] != 6 {
+		t.Errorf("Expected the aborted records hidden. Got %d records from %v\n", len(offsets), offsets[:2])
+	}
+}
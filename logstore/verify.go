@@ -0,0 +1,248 @@
+package logstore
+
+import "fmt"
+
+// Problem describes an inconsistency found while verifying a data directory.
+type Problem struct {
+	Segment int64
+	Offset  int64
+	Message string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("segment:%020d offset:%d %s", p.Segment, p.Offset, p.Message)
+}
+
+// Verify walks every segment in the working directory, and any offloaded
+// to remote storage, and cross-checks each index entry against its log
+// file, the segments against each other and the metadata file against the
+// end of the log.
+func Verify(opts ...Option) ([]Problem, error) {
+	c := newConfig(opts)
+	bases, err := c.allSegments()
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []Problem
+	next := int64(-1)
+	for _, base := range bases {
+		if next != -1 && base != next {
+			problems = append(problems, Problem{
+				base,
+				next,
+				fmt.Sprintf("gap between segments: expected base offset %d", next),
+			})
+		}
+
+		entries, size, err := c.readSegment(base)
+		if err != nil {
+			return nil, err
+		}
+		_, segmentProblems := checkSegment(base, entries, size)
+		problems = append(problems, segmentProblems...)
+		next = base + int64(len(entries))
+	}
+
+	metadata, err := c.readMetaData()
+	if err != nil {
+		return nil, err
+	}
+	if len(bases) > 0 && metadata.NextOffset != next {
+		problems = append(problems, Problem{
+			bases[len(bases)-1],
+			metadata.NextOffset,
+			fmt.Sprintf("metadata next offset does not match end of log %d", next),
+		})
+	}
+
+	return problems, nil
+}
+
+// Repair finishes interrupted compactions, truncates torn log tails,
+// rebuilds indexes from their valid entries and rewrites the metadata file
+// to match the end of the log.
+// Gaps between segments are reported by Verify but left in place. Segments
+// only held remotely are checked but cannot be rewritten, so finding one
+// damaged is an error.
+func Repair(opts ...Option) error {
+	c := newConfig(opts)
+	bases, err := c.allSegments()
+	if err != nil {
+		return err
+	}
+	localBases, err := c.segments()
+	if err != nil {
+		return err
+	}
+	local := make(map[int64]bool, len(localBases))
+	for _, base := range localBases {
+		local[base] = true
+	}
+
+	next := int64(-1)
+	for _, base := range bases {
+		if local[base] {
+			if err := c.finishCompaction(base); err != nil {
+				return err
+			}
+		}
+		entries, size, err := c.readSegment(base)
+		if err != nil {
+			return err
+		}
+
+		valid, problems := checkSegment(base, entries, size)
+		var end int64
+		if len(valid) > 0 {
+			last := valid[len(valid)-1]
+			end = last.Position + last.Length
+		}
+
+		damaged := len(valid) != len(entries) || end != size
+		if damaged && !local[base] {
+			return NewLogStoreErr(
+				CorruptIndex,
+				fmt.Sprintf("remote segment %d is damaged: %s", base, problems[0].Message),
+				nil,
+			)
+		}
+		if damaged {
+			for _, p := range problems {
+				notify(c.Observers, LifecycleEvent{
+					Type:    CorruptionDetected,
+					Segment: p.Segment,
+					Offset:  p.Offset,
+					Err:     NewLogStoreErr(CorruptIndex, p.Message, nil),
+				})
+			}
+			if err := c.repairSegment(base, valid, end); err != nil {
+				return err
+			}
+			c.removeMerkleTree(base)
+			c.removeKeyIndex(base)
+		}
+		next = base + int64(len(valid))
+	}
+
+	if next == -1 {
+		return nil
+	}
+
+	metadata, err := c.readMetaData()
+	if err != nil {
+		return err
+	}
+	metadata.NextOffset = next
+	return c.writeMetaData(metadata)
+}
+
+func (c *Config) readSegment(base int64) ([]IndexEntry, int64, error) {
+	segment, err := c.openClosedSegment(base)
+	if err != nil {
+		return nil, -1, err
+	}
+	defer segment.Close()
+
+	size, err := segment.Size()
+	if err != nil {
+		return nil, -1, err
+	}
+	entries, err := segment.Index.Entries()
+	if err != nil {
+		return nil, -1, err
+	}
+
+	return entries, size, nil
+}
+
+// checkSegment returns the leading run of entries that are consistent with
+// the log file along with every problem found in the segment.
+func checkSegment(base int64, entries []IndexEntry, size int64) ([]IndexEntry, []Problem) {
+	var problems []Problem
+	validCount := -1
+
+	for i, entry := range entries {
+		var msg string
+		switch {
+		case entry.Offset != base+int64(i):
+			msg = fmt.Sprintf("offset out of sequence: expected %d", base+int64(i))
+		case entry.Position < 0 || entry.Length < 0 || entry.Position+entry.Length > size:
+			msg = fmt.Sprintf(
+				"record [%d, %d) out of range of log of size %d",
+				entry.Position,
+				entry.Position+entry.Length,
+				size,
+			)
+		case i > 0 && !sameBatch(entry, entries[i-1]) &&
+			entry.Position != entries[i-1].Position+entries[i-1].Length:
+			msg = "record position not contiguous with previous record"
+		default:
+			continue
+		}
+
+		problems = append(problems, Problem{base, entry.Offset, msg})
+		if validCount == -1 {
+			validCount = i
+		}
+	}
+	if validCount == -1 {
+		validCount = len(entries)
+	}
+
+	// bytes past the last record only matter once the index itself checks out
+	var end int64
+	if len(entries) > 0 {
+		last := entries[len(entries)-1]
+		end = last.Position + last.Length
+	}
+	if validCount == len(entries) && size > end {
+		problems = append(problems, Problem{
+			base,
+			base + int64(len(entries)),
+			fmt.Sprintf("%d unindexed bytes at tail of log", size-end),
+		})
+	}
+
+	return entries[:validCount], problems
+}
+
+func sameBatch(a, b IndexEntry) bool {
+	return a.Position == b.Position && a.Length == b.Length
+}
+
+// repairSegment rebuilds the index from the valid entries in a temporary
+// file that replaces the original once synced, and only then cuts the log
+// back to end. A repair interrupted at any point leaves a segment Repair
+// can still fix.
+func (c *Config) repairSegment(base int64, valid []IndexEntry, end int64) error {
+	fsys := c.fs()
+	name := fmt.Sprintf("%020d", base)
+	tmp := fmt.Sprintf("%s.index.repair", name)
+
+	index, err := newIndex(fsys, tmp, int64(4096), false)
+	if err != nil {
+		return err
+	}
+	for _, entry := range valid {
+		if err := index.AddEntry(entry); err != nil {
+			index.Close()
+			return err
+		}
+	}
+	if err := index.Sync(); err != nil {
+		index.Close()
+		return err
+	}
+	if err := index.Close(); err != nil {
+		return err
+	}
+	if err := fsys.Rename(tmp, fmt.Sprintf("%s.index", name)); err != nil {
+		return err
+	}
+
+	if err := fsys.Truncate(fmt.Sprintf("%s.log", name), end); err != nil {
+		return NewLogStoreErr(OSErr, "unable to truncate log", err)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package logstore
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func writeTestSegment(t *testing.T, n int) *LogSegment {
+	segment, err := NewLogSegment(1, 8*1024, false)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	for i := 1; i <= n; i++ {
+		data, _ := json.Marshal(TestMessage{"foo", i, 23.0, "bar"})
+		if _, err := segment.Append(data); err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+	segment.Close()
+	testConfig.writeMetaData(MetaData{NextOffset: segment.NextOffset})
+
+	return segment
+}
+
+func TestVerify(t *testing.T) {
+	writeTestSegment(t, 10)
+
+	problems, err := Verify()
+	if err != nil {
+		t.Errorf("%v\n", err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("Expected no problems. Got %v\n", problems)
+	}
+
+	removeTestFiles()
+}
+
+func TestVerify_TornTail(t *testing.T) {
+	segment := writeTestSegment(t, 10)
+
+	f, _ := os.OpenFile(segment.Name+".log", os.O_WRONLY|os.O_APPEND, Perms)
+	f.Write([]byte(`{"V1":"fo`))
+	f.Close()
+
+	problems, err := Verify()
+	if err != nil {
+		t.Errorf("%v\n", err)
+	}
+	if len(problems) != 1 || problems[0].Offset != 11 {
+		t.Errorf("Expected torn tail at offset %d. Got %v\n", 11, problems)
+	}
+
+	removeTestFiles()
+}
+
+func TestVerify_MetaDataMismatch(t *testing.T) {
+	writeTestSegment(t, 10)
+	testConfig.writeMetaData(MetaData{NextOffset: 5})
+
+	problems, _ := Verify()
+	if len(problems) != 1 || problems[0].Offset != 5 {
+		t.Errorf("Expected metadata mismatch. Got %v\n", problems)
+	}
+
+	removeTestFiles()
+}
+
+func TestRepair(t *testing.T) {
+	segment := writeTestSegment(t, 10)
+
+	// an entry pointing past the end of the log simulates a torn write
+	entry := IndexEntry{11, 8 * 1024, 100}
+	packed, _ := entry.ToBytes()
+	f, _ := os.OpenFile(segment.Name+".index", os.O_RDWR, Perms)
+	f.WriteAt(packed, 10*IndexItemWidth)
+	f.Close()
+	testConfig.writeMetaData(MetaData{NextOffset: 12})
+
+	problems, _ := Verify()
+	if len(problems) != 1 || problems[0].Offset != 11 {
+		t.Errorf("Expected out of range record at offset %d. Got %v\n", 11, problems)
+	}
+
+	if err := Repair(); err != nil {
+		t.Errorf("%v\n", err)
+	}
+
+	problems, _ = Verify()
+	if len(problems) != 0 {
+		t.Errorf("Expected no problems after repair. Got %v\n", problems)
+	}
+
+	metadata, _ := ReadMetaData()
+	if metadata.NextOffset != 11 {
+		t.Errorf("Expected next offset to be %d. Got %d\n", 11, metadata.NextOffset)
+	}
+
+	rosegment, _ := NewLogSegment(1, -1, true)
+	defer rosegment.Close()
+	data, err := rosegment.Get(10)
+	if err != nil {
+		t.Errorf("%v\n", err)
+	}
+	var m TestMessage
+	json.Unmarshal(data, &m)
+	if m.V2 != 10 {
+		t.Errorf("Expected offset %d to hold message %d. Got %v\n", 10, 10, m)
+	}
+
+	removeTestFiles()
+}
+
+// tornSegment writes a segment of 10 records followed by a torn write.
+func tornSegment(t *testing.T, fsys FS) {
+	c := newConfig([]Option{WithFS(fsys)})
+	segment, err := c.openSegment(1, 8*1024, false)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	for i := 0; i < 10; i++ {
+		segment.Append([]byte("foo"))
+	}
+	segment.Sync()
+	segment.Log.Write([]byte("torn"))
+	segment.Close()
+	c.writeMetaData(MetaData{NextOffset: 11})
+}
+
+func TestRepair_Interrupted(t *testing.T) {
+	fsys := NewFaultFS(NewMemFS())
+	tornSegment(t, fsys)
+	start := fsys.Ops()
+	if err := Repair(WithFS(fsys)); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	ops := fsys.Ops() - start
+
+	for op := 1; op <= ops; op++ {
+		fsys := NewFaultFS(NewMemFS())
+		tornSegment(t, fsys)
+		fsys.Inject(fsys.Ops()+op, WriteError)
+		Repair(WithFS(fsys))
+		fsys.Clear()
+
+		// whatever the repair got through, the records stay indexed
+		c := newConfig([]Option{WithFS(fsys)})
+		entries, size, err := c.readSegment(1)
+		if err != nil {
+			t.Fatalf("interrupted at operation %d: %v\n", op, err)
+		}
+		if valid, _ := checkSegment(1, entries, size); len(valid) != 10 {
+			t.Errorf("Expected 10 valid entries after interrupting operation %d. Got %d\n", op, len(valid))
+		}
+		if err := Repair(WithFS(fsys)); err != nil {
+			t.Errorf("%v\n", err)
+		}
+		if problems, _ := Verify(WithFS(fsys)); len(problems) != 0 {
+			t.Errorf("Expected no problems after repairing again from operation %d. Got %v\n", op, problems)
+		}
+	}
+}